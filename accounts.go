@@ -0,0 +1,580 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Errors declaration for the accounts
+var (
+	ErrAccountExists       = fmt.Errorf("Username already used")
+	ErrAccountNameNotValid = fmt.Errorf("Username not valid, use 3 to 32 letters, digits, _ or -")
+	ErrPasswordTooShort    = fmt.Errorf("Password too short, use at least %d characters", minPasswordLength)
+	ErrPasswordTooLong     = fmt.Errorf("Password too long, use at most %d bytes", maxPasswordLength)
+	ErrLoginFailed         = fmt.Errorf("Wrong username or password")
+	ErrAccountNotFound     = fmt.Errorf("Account not found")
+	ErrAPIKeyNotFound      = fmt.Errorf("API key not found")
+	ErrAPIKeyNotValid      = fmt.Errorf("API key not valid")
+	ErrAPIKeyRequired      = fmt.Errorf("API key required, anonymous pastes are disabled")
+	ErrRegistrationClosed  = fmt.Errorf("Registration is disabled")
+	ErrExternalAccount     = fmt.Errorf("API keys are available only for the local accounts")
+)
+
+//Limits of the length of the passwords, bcrypt uses only the first 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+//apiKeyPrefix is the start of every API key, it makes them easy to find in leaked files
+const apiKeyPrefix = "yep_"
+
+var accountNamePattern = regexp.MustCompile("^[a-zA-Z0-9_-]{3,32}$")
+
+//Account is a registered user
+type Account struct {
+	ID      string
+	Name    string
+	Created time.Time
+	//Password is the bcrypt hash of the password
+	Password []byte
+	Keys     []APIKey
+	//Issuer is the OpenID Connect provider of the accounts logged in with it, they are not saved
+	Issuer string `json:",omitempty"`
+}
+
+//APIKey is a key used for creating pastes through the API, only its hash is stored
+type APIKey struct {
+	//ID is the start of the key, it is shown for recognizing the key
+	ID      string
+	Hash    string
+	Created time.Time
+}
+
+//randomToken returns n random bytes encoded in hex
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//hashToken returns the hash stored for an API key or an owner token
+func hashToken(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+//accountStore keeps the accounts in a JSON file, it is rewritten on every change
+type accountStore struct {
+	mu       sync.RWMutex
+	path     string
+	accounts map[string]*Account
+	//names maps the lowercase names to the IDs
+	names map[string]string
+	//keys maps the hashes of the API keys to the IDs
+	keys map[string]string
+}
+
+//openAccountStore reads the accounts from path, the file is created on the first change
+func openAccountStore(path string) (*accountStore, error) {
+	store := &accountStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+		names:    make(map[string]string),
+		keys:     make(map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("Cannot read accounts %s: %v", path, err)
+	}
+	for _, a := range accounts {
+		store.index(a)
+	}
+	return store, nil
+}
+
+func (s *accountStore) index(a *Account) {
+	s.accounts[a.ID] = a
+	s.names[strings.ToLower(a.Name)] = a.ID
+	for _, k := range a.Keys {
+		s.keys[k.Hash] = a.ID
+	}
+}
+
+//save writes atomically the accounts to the file, the lock must be held
+func (s *accountStore) save() error {
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Created.Before(accounts[j].Created) })
+	data, err := json.MarshalIndent(accounts, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	//The file contains the password hashes
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+//create adds an account
+func (s *accountStore) create(name, password string) (Account, error) {
+	if !accountNamePattern.MatchString(name) {
+		return Account{}, ErrAccountNameNotValid
+	}
+	if len(password) < minPasswordLength {
+		return Account{}, ErrPasswordTooShort
+	}
+	if len(password) > maxPasswordLength {
+		return Account{}, ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, err
+	}
+	id, err := randomToken(8)
+	if err != nil {
+		return Account{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.names[strings.ToLower(name)]; ok {
+		return Account{}, ErrAccountExists
+	}
+	a := &Account{ID: id, Name: name, Created: time.Now(), Password: hash}
+	s.index(a)
+	if err := s.save(); err != nil {
+		delete(s.accounts, id)
+		delete(s.names, strings.ToLower(name))
+		return Account{}, err
+	}
+	return *a, nil
+}
+
+//dummyPassword is compared when the account does not exist, so a login takes the same time
+var (
+	dummyPassword     []byte
+	dummyPasswordOnce sync.Once
+)
+
+//login returns the account if the password is right
+func (s *accountStore) login(name, password string) (Account, error) {
+	dummyPasswordOnce.Do(func() {
+		dummyPassword, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+
+	s.mu.RLock()
+	a, ok := s.accounts[s.names[strings.ToLower(name)]]
+	hash := dummyPassword
+	var account Account
+	if ok {
+		hash = a.Password
+		account = *a
+	}
+	s.mu.RUnlock()
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return Account{}, ErrLoginFailed
+	}
+	return account, nil
+}
+
+//get returns the account with the ID
+func (s *accountStore) get(id string) (Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return Account{}, ErrAccountNotFound
+	}
+	return *a, nil
+}
+
+//byKey returns the account owning the API key
+func (s *accountStore) byKey(key string) (Account, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return Account{}, ErrAPIKeyNotValid
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.accounts[s.keys[hashToken(key)]]
+	if !ok {
+		return Account{}, ErrAPIKeyNotValid
+	}
+	return *a, nil
+}
+
+//createKey adds an API key to the account, the key is returned only now
+func (s *accountStore) createKey(id string) (string, error) {
+	secret, err := randomToken(20)
+	if err != nil {
+		return "", err
+	}
+	key := apiKeyPrefix + secret
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return "", ErrAccountNotFound
+	}
+	hash := hashToken(key)
+	a.Keys = append(a.Keys, APIKey{ID: secret[:8], Hash: hash, Created: time.Now()})
+	s.keys[hash] = id
+	if err := s.save(); err != nil {
+		a.Keys = a.Keys[:len(a.Keys)-1]
+		delete(s.keys, hash)
+		return "", err
+	}
+	return key, nil
+}
+
+//revokeKey deletes an API key of the account
+func (s *accountStore) revokeKey(id, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	for i, k := range a.Keys {
+		if k.ID != keyID {
+			continue
+		}
+		a.Keys = append(a.Keys[:i:i], a.Keys[i+1:]...)
+		delete(s.keys, k.Hash)
+		return s.save()
+	}
+	return ErrAPIKeyNotFound
+}
+
+//sessionStore keeps the sessions of the web UI in memory, they are lost on restart
+type sessionStore struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	sessions map[string]session
+}
+
+type session struct {
+	accountID string
+	//external is the account logged in with OpenID Connect, nil for the local accounts
+	external *Account
+	expire   time.Time
+}
+
+func newSessionStore(timeout time.Duration) *sessionStore {
+	return &sessionStore{timeout: timeout, sessions: make(map[string]session)}
+}
+
+//create starts a session for the local account, the token is the value of the cookie
+func (s *sessionStore) create(accountID string) (string, error) {
+	return s.start(session{accountID: accountID})
+}
+
+//createExternal starts a session for an account logged in with OpenID Connect
+func (s *sessionStore) createExternal(account Account) (string, error) {
+	return s.start(session{accountID: account.ID, external: &account})
+}
+
+func (s *sessionStore) start(sess session) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for t, sess := range s.sessions {
+		if !sess.expire.After(now) {
+			delete(s.sessions, t)
+		}
+	}
+	sess.expire = now.Add(s.timeout)
+	s.sessions[token] = sess
+	return token, nil
+}
+
+//get returns the session of the token
+func (s *sessionStore) get(token string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok || !sess.expire.After(time.Now()) {
+		return session{}, false
+	}
+	return sess, true
+}
+
+//delete ends the session
+func (s *sessionStore) delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+//sessionCookie is the cookie with the session token
+const sessionCookie = "yep_session"
+
+//sessionAccount returns the account logged in the web UI, nil if the request is anonymous
+func (s Server) sessionAccount(req *http.Request) *Account {
+	if s.sessions == nil {
+		return nil
+	}
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	sess, ok := s.sessions.get(cookie.Value)
+	if !ok {
+		return nil
+	}
+	if sess.external != nil {
+		account := *sess.external
+		return &account
+	}
+	if s.accounts == nil {
+		return nil
+	}
+	account, err := s.accounts.get(sess.accountID)
+	if err != nil {
+		return nil
+	}
+	return &account
+}
+
+//apiAccount returns the account of the API key in the Authorization header, nil if the request is anonymous
+func (s Server) apiAccount(req *http.Request) (*Account, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" || s.accounts == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, ErrAPIKeyNotValid
+	}
+	account, err := s.accounts.byKey(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+//anonymousAllowed reports if the pastes can be created without an account
+func (s Server) anonymousAllowed() bool {
+	if s.oidc != nil && s.cfg.OIDC.Required {
+		return false
+	}
+	return s.accounts == nil || s.cfg.Accounts.Anonymous
+}
+
+//handleAccountRoutes registers the routes of the accounts
+func (s *Server) handleAccountRoutes() {
+	s.handleRoute("/login", handleLogin)
+	s.handleRoute("/register", handleRegister)
+	s.handleRoute("/account", handleAccount)
+}
+
+//accountPage is the data of the account templates
+type accountPage struct {
+	Header       string
+	Error        string
+	Register     bool
+	Registration bool
+	//Local and OIDC show the login with the local accounts and with OpenID Connect
+	Local   bool
+	OIDC    bool
+	Account *Account
+	//NewKey is the API key just created, it is shown only once
+	NewKey string
+}
+
+//renderAccountPage renders a template of the accounts
+func renderAccountPage(s Server, w http.ResponseWriter, req *http.Request, name string, page accountPage) {
+	t, err := getTemplate(s.cfg.AssetsDir, name)
+	if err != nil {
+		s.logger(req).Error("Cannot get template", "template", name, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	page.Header = s.cfg.Header
+	page.Registration = s.cfg.Accounts.Registration
+	page.Local = s.accounts != nil
+	page.OIDC = s.oidc != nil
+	if err := t.Execute(w, page); err != nil {
+		s.logger(req).Error("Cannot execute template", "template", name, "error", err)
+	}
+}
+
+//startSession logs in the account and redirects to the account page
+func startSession(s Server, w http.ResponseWriter, req *http.Request, account Account) {
+	token, err := s.sessions.create(account.ID)
+	if err != nil {
+		s.logger(req).Error("Cannot create session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	setSessionCookie(s, w, req, token)
+	http.Redirect(w, req, "/account", http.StatusFound)
+}
+
+//setSessionCookie sends the cookie with the session token
+func setSessionCookie(s Server, w http.ResponseWriter, req *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(s.sessions.timeout.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//Handle: /login GET, POST
+func handleLogin(s Server, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		renderAccountPage(s, w, req, "login", accountPage{})
+		return
+	}
+
+	account, err := s.accounts.login(req.PostFormValue("name"), req.PostFormValue("password"))
+	if err != nil {
+		s.logger(req).Info("Login failed", "name", req.PostFormValue("name"))
+		w.WriteHeader(http.StatusUnauthorized)
+		renderAccountPage(s, w, req, "login", accountPage{Error: err.Error()})
+		return
+	}
+	s.logger(req).Info("Logged in", "account", account.ID)
+	startSession(s, w, req, account)
+}
+
+//Handle: /register GET, POST
+func handleRegister(s Server, w http.ResponseWriter, req *http.Request) {
+	if !s.cfg.Accounts.Registration {
+		w.WriteHeader(http.StatusForbidden)
+		renderAccountPage(s, w, req, "login", accountPage{Error: ErrRegistrationClosed.Error()})
+		return
+	}
+	if req.Method != http.MethodPost {
+		renderAccountPage(s, w, req, "login", accountPage{Register: true})
+		return
+	}
+
+	account, err := s.accounts.create(req.PostFormValue("name"), req.PostFormValue("password"))
+	switch err {
+	case nil:
+	case ErrAccountNameNotValid, ErrPasswordTooShort, ErrPasswordTooLong, ErrAccountExists:
+		w.WriteHeader(http.StatusBadRequest)
+		renderAccountPage(s, w, req, "login", accountPage{Register: true, Error: err.Error()})
+		return
+	default:
+		s.logger(req).Error("Cannot create account", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	s.logger(req).Info("Account created", "account", account.ID, "name", account.Name)
+	startSession(s, w, req, account)
+}
+
+//Handle: /logout POST
+func handleLogout(s Server, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		s.sessions.delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+//Handle: /account GET, POST
+//POST creates an API key, or revokes the key in the field revoke
+func handleAccount(s Server, w http.ResponseWriter, req *http.Request) {
+	account := s.sessionAccount(req)
+	if account == nil {
+		http.Redirect(w, req, "/login", http.StatusFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		renderAccountPage(s, w, req, "account", accountPage{Account: account})
+		return
+	}
+	if account.Issuer != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		renderAccountPage(s, w, req, "account", accountPage{Account: account, Error: ErrExternalAccount.Error()})
+		return
+	}
+
+	if keyID := req.PostFormValue("revoke"); keyID != "" {
+		if err := s.accounts.revokeKey(account.ID, keyID); err != nil {
+			if err != ErrAPIKeyNotFound {
+				s.logger(req).Error("Cannot revoke API key", "error", err)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			renderAccountPage(s, w, req, "account", accountPage{Account: account, Error: err.Error()})
+			return
+		}
+		s.logger(req).Info("API key revoked", "account", account.ID, "key", keyID)
+		http.Redirect(w, req, "/account", http.StatusFound)
+		return
+	}
+
+	key, err := s.accounts.createKey(account.ID)
+	if err != nil {
+		s.logger(req).Error("Cannot create API key", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	s.logger(req).Info("API key created", "account", account.ID)
+	if updated, err := s.accounts.get(account.ID); err == nil {
+		account = &updated
+	}
+	renderAccountPage(s, w, req, "account", accountPage{Account: account, NewKey: key})
+}
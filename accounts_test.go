@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := openAccountStore(path)
+	if err != nil {
+		t.Fatalf("Could not open accounts: %v", err)
+	}
+
+	tt := []struct {
+		name     string
+		user     string
+		password string
+		err      error
+	}{
+		{"OK", "alice", "password1", nil},
+		{"Exists", "Alice", "password2", ErrAccountExists},
+		{"Name not valid", "a b", "password1", ErrAccountNameNotValid},
+		{"Name too short", "al", "password1", ErrAccountNameNotValid},
+		{"Password too short", "bob", "short", ErrPasswordTooShort},
+		{"Password too long", "bob", strings.Repeat("p", 73), ErrPasswordTooLong},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := store.create(tc.user, tc.password); err != tc.err {
+				t.Errorf("Expected: %v; got: %v", tc.err, err)
+			}
+		})
+	}
+
+	alice, err := store.login("ALICE", "password1")
+	if err != nil || alice.Name != "alice" {
+		t.Fatalf("Expected: alice; got: %q, %v", alice.Name, err)
+	}
+	if _, err := store.login("alice", "password2"); err != ErrLoginFailed {
+		t.Errorf("Expected: %v; got: %v", ErrLoginFailed, err)
+	}
+	if _, err := store.login("nobody", "password1"); err != ErrLoginFailed {
+		t.Errorf("Expected: %v; got: %v", ErrLoginFailed, err)
+	}
+
+	key, err := store.createKey(alice.ID)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		t.Errorf("Expected: prefix %s; got: %s", apiKeyPrefix, key)
+	}
+
+	//The accounts and the keys are read again from the file
+	store, err = openAccountStore(path)
+	if err != nil {
+		t.Fatalf("Could not open accounts: %v", err)
+	}
+	if a, err := store.byKey(key); err != nil || a.ID != alice.ID {
+		t.Fatalf("Expected: %s; got: %q, %v", alice.ID, a.ID, err)
+	}
+	if _, err := store.byKey(key + "0"); err != ErrAPIKeyNotValid {
+		t.Errorf("Expected: %v; got: %v", ErrAPIKeyNotValid, err)
+	}
+
+	a, _ := store.get(alice.ID)
+	if len(a.Keys) != 1 || a.Keys[0].Hash == key {
+		t.Fatalf("Expected: 1 hashed key; got: %+v", a.Keys)
+	}
+	if err := store.revokeKey(alice.ID, a.Keys[0].ID); err != nil {
+		t.Fatalf("Could not revoke API key: %v", err)
+	}
+	if err := store.revokeKey(alice.ID, a.Keys[0].ID); err != ErrAPIKeyNotFound {
+		t.Errorf("Expected: %v; got: %v", ErrAPIKeyNotFound, err)
+	}
+	if _, err := store.byKey(key); err != ErrAPIKeyNotValid {
+		t.Errorf("Expected: %v; got: %v", ErrAPIKeyNotValid, err)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	sessions := newSessionStore(time.Hour)
+	token, err := sessions.create("id")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if sess, ok := sessions.get(token); !ok || sess.accountID != "id" || sess.external != nil {
+		t.Errorf("Expected: id; got: %+v, %v", sess, ok)
+	}
+	token, _ = sessions.createExternal(Account{ID: "oidc:id", Name: "alice", Issuer: "issuer"})
+	if sess, ok := sessions.get(token); !ok || sess.external == nil || sess.external.Name != "alice" {
+		t.Errorf("Expected: alice; got: %+v, %v", sess, ok)
+	}
+	sessions.delete(token)
+	if _, ok := sessions.get(token); ok {
+		t.Error("Session not deleted")
+	}
+
+	expired := newSessionStore(-time.Second)
+	token, _ = expired.create("id")
+	if _, ok := expired.get(token); ok {
+		t.Error("Expired session accepted")
+	}
+}
+
+//newAccountsServer creates a server with the accounts enabled and an account with an API key
+func newAccountsServer(t *testing.T, anonymous bool) (Server, Account, string) {
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.Accounts.Enabled = true
+	cfg.Accounts.Anonymous = anonymous
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	var err error
+	if s.accounts, err = openAccountStore(filepath.Join(t.TempDir(), "users.json")); err != nil {
+		t.Fatalf("Could not open accounts: %v", err)
+	}
+	s.sessions = newSessionStore(time.Hour)
+
+	account, err := s.accounts.create("alice", "password1")
+	if err != nil {
+		t.Fatalf("Could not create account: %v", err)
+	}
+	key, err := s.accounts.createKey(account.ID)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+	return s, account, key
+}
+
+func TestAPIKeys(t *testing.T) {
+	tt := []struct {
+		name      string
+		anonymous bool
+		auth      string
+		code      int
+		user      bool
+	}{
+		{"Anonymous", true, "", http.StatusOK, false},
+		{"Anonymous disabled", false, "", http.StatusUnauthorized, false},
+		{"Key", false, "key", http.StatusOK, true},
+		{"Wrong key", true, "Bearer yep_wrong", http.StatusUnauthorized, false},
+		{"Not bearer", true, "Basic dXNlcg==", http.StatusUnauthorized, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, account, key := newAccountsServer(t, tc.anonymous)
+			body, _ := json.Marshal(newPasteRequest{Name: "mallory", Code: "example paste", ExpireTime: getExpireTime(t)})
+			req := httptest.NewRequest(http.MethodPost, "/api/new", bytes.NewReader(body))
+			if tc.auth == "key" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			} else if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			res := httptest.NewRecorder()
+			handleAPINewPaste(s, res, req)
+			if res.Code != tc.code {
+				t.Fatalf("Expected: %d; got: %d, %s", tc.code, res.Code, res.Body)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+
+			var output newPasteResponse
+			if err := json.Unmarshal(res.Body.Bytes(), &output); err != nil {
+				t.Fatalf("Could not decode output: %v", err)
+			}
+			paste, err := s.db.Get(context.Background(), output.Path)
+			if err != nil {
+				t.Fatalf("Could not get paste: %v", err)
+			}
+			if tc.user && (paste.UserID != account.ID || paste.User != account.Name) {
+				t.Errorf("Expected: %s %s; got: %s %s", account.ID, account.Name, paste.UserID, paste.User)
+			}
+			if !tc.user && (paste.UserID != "" || paste.User != "mallory") {
+				t.Errorf("Expected: anonymous mallory; got: %s %s", paste.UserID, paste.User)
+			}
+		})
+	}
+}
+
+func TestAccountPages(t *testing.T) {
+	s, _, _ := newAccountsServer(t, false)
+	s.handleRoute("/", handleHome)
+	s.handleAccountRoutes()
+	s.handleRoute("/logout", handleLogout)
+
+	do := func(method, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+
+	paste := url.Values{"code": {"example paste"}, "expire": {getExpireTime(t)}}
+	if res := do(http.MethodPost, "/", paste, nil); res.Code != http.StatusFound || res.Header().Get("Location") != "/login" {
+		t.Errorf("Expected: redirect to /login; got: %d %s", res.Code, res.Header().Get("Location"))
+	}
+	if res := do(http.MethodPost, "/login", url.Values{"name": {"alice"}, "password": {"wrong"}}, nil); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected: %d; got: %d", http.StatusUnauthorized, res.Code)
+	}
+
+	res := do(http.MethodPost, "/register", url.Values{"name": {"bob"}, "password": {"password2"}}, nil)
+	cookies := res.Result().Cookies()
+	if res.Code != http.StatusFound || len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("Expected: session cookie; got: %d %v", res.Code, cookies)
+	}
+	cookie := cookies[0]
+
+	res = do(http.MethodPost, "/account", nil, cookie)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), apiKeyPrefix) {
+		t.Errorf("Expected: new API key; got: %d", res.Code)
+	}
+
+	res = do(http.MethodPost, "/", paste, cookie)
+	if res.Code != http.StatusFound {
+		t.Fatalf("Expected: %d; got: %d", http.StatusFound, res.Code)
+	}
+	created, err := s.db.Get(context.Background(), strings.TrimPrefix(res.Header().Get("Location"), "/"))
+	if err != nil || created.User != "bob" || created.UserID == "" {
+		t.Errorf("Expected: paste by bob; got: %+v, %v", created, err)
+	}
+
+	do(http.MethodPost, "/logout", nil, cookie)
+	if res := do(http.MethodGet, "/account", nil, cookie); res.Code != http.StatusFound {
+		t.Errorf("Expected: %d; got: %d", http.StatusFound, res.Code)
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
 )
 
 //Error strings for the APIs
@@ -20,6 +21,12 @@ type newPasteRequest struct {
 	Code       string
 	Lang       string
 	ExpireTime string
+	//Path is the path chosen by the user, empty for a generated one
+	Path string
+	//Visibility is public, unlisted or private, empty for unlisted
+	Visibility string
+	//ExpireAt is the expiration date in RFC 3339, if set it replaces ExpireTime
+	ExpireAt string
 }
 
 type newPasteResponse struct {
@@ -31,6 +38,21 @@ type newPasteResponse struct {
 type getPasteRequest struct {
 	Name   string
 	Render bool
+	//Revision is the revision requested, 0 for the latest
+	Revision int
+}
+
+type expirePasteRequest struct {
+	Name string
+	//ExpireTime is one of ExpireAfter, counted from now
+	ExpireTime string
+}
+
+type expirePasteResponse struct {
+	OK    bool
+	Error string
+	//Expire is the new expiration, 0 if the paste never expires
+	Expire int64
 }
 
 type getPasteResponse struct {
@@ -43,15 +65,23 @@ type getPasteResponse struct {
 	Created int64
 	Expire  int64
 	User    string
+	//UserID is the ID of the account that created the paste, empty if the paste is anonymous
+	UserID string `json:",omitempty"`
+	//Visibility is public, unlisted or private
+	Visibility string
+	//Revision is the number of the revision returned, the pastes never edited are the first revision
+	Revision int
 }
 
 func handleAPINewPaste(s Server, w http.ResponseWriter, req *http.Request) {
 	res := newPasteResponse{}
-	var path string
+	var created Paste
 	var err error
 	var body []byte
+	var account *Account
 	paste := newPasteRequest{}
-	duration := &pasteDuration{}
+	var duration *pasteDuration
+	var expire time.Time
 
 	if req.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -62,10 +92,23 @@ func handleAPINewPaste(s Server, w http.ResponseWriter, req *http.Request) {
 		goto response
 	}
 
+	account, err = s.apiAccount(req)
+	if err == nil && account == nil && !s.anonymousAllowed() {
+		err = ErrAPIKeyRequired
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		res = newPasteResponse{
+			OK:    false,
+			Error: err.Error(),
+		}
+		goto response
+	}
+
 	body, err = ioutil.ReadAll(req.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Cannot read body:", err)
+		s.logger(req).Error("Cannot read body", "error", err)
 		res = newPasteResponse{
 			OK:    false,
 			Error: ErrInternalServerError,
@@ -81,35 +124,59 @@ func handleAPINewPaste(s Server, w http.ResponseWriter, req *http.Request) {
 		goto response
 	}
 
-	if err := duration.UnmarshalText([]byte(paste.ExpireTime)); err != nil {
+	if paste.ExpireAt != "" {
+		expire, err = validateExpireDate(paste.ExpireAt, time.Now(), s.cfg.ExpireDate)
+	} else if duration, err = validateExpire(paste.ExpireTime, s.cfg.ExpireAfter); err != nil {
+		err = ErrExpireTimeNotValid
+	} else {
+		expire = duration.after(time.Now())
+	}
+	if err != nil {
+		metricPastesRejected.WithLabelValues(rejectReason(err)).Inc()
 		w.WriteHeader(http.StatusBadRequest)
 		res = newPasteResponse{
 			OK:    false,
-			Error: ErrExpireTimeNotValid.Error(),
+			Error: err.Error(),
+		}
+		goto response
+	}
+	created, err = NewPaste(req.Context(), &s, account, "", paste.Name, paste.Path, paste.Code, paste.Lang, paste.Visibility, expire)
+	if errors.Is(err, ErrPathNotValid) || errors.Is(err, ErrPathReserved) || errors.Is(err, ErrPathDisabled) || errors.Is(err, ErrPathUsed) ||
+		errors.Is(err, ErrVisibilityNotValid) || errors.Is(err, ErrPrivateNeedsOwner) {
+		if errors.Is(err, ErrPathUsed) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		res = newPasteResponse{
+			OK:    false,
+			Error: err.Error(),
 		}
 		goto response
 	}
-	path, err = NewPaste(&s, paste.Name, paste.Code, paste.Lang, duration)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Cannot create paste:", err)
+		status := databaseErrorStatus(err)
+		w.WriteHeader(status)
+		s.logger(req).Error("Cannot create paste", "error", err)
 		res = newPasteResponse{
 			OK:    false,
-			Error: ErrInternalServerError,
+			Error: http.StatusText(status),
 		}
 		goto response
 	}
 
+	s.logPaste(req, eventPasteCreate, created)
+
 	res = newPasteResponse{
 		OK:   true,
-		Path: path,
+		Path: created.Path,
 	}
 
 response:
 	response, _ := json.Marshal(res)
 
 	if _, err := w.Write(response); err != nil {
-		log.Println("Cannot write response:", err)
+		s.logger(req).Warn("Cannot write response", "error", err)
 		return
 	}
 }
@@ -120,7 +187,7 @@ func handleAPIGetPaste(s Server, w http.ResponseWriter, req *http.Request) {
 	var body []byte
 	var paste Paste
 	var err error
-	var style, render string
+	var style, render, name string
 
 	if req.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -134,7 +201,7 @@ func handleAPIGetPaste(s Server, w http.ResponseWriter, req *http.Request) {
 	body, err = ioutil.ReadAll(req.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Cannot read body:", err)
+		s.logger(req).Error("Cannot read body", "error", err)
 		goto response
 	}
 
@@ -148,8 +215,16 @@ func handleAPIGetPaste(s Server, w http.ResponseWriter, req *http.Request) {
 		goto response
 	}
 
-	paste, err = s.db.Get(request.Name)
-	if err != nil {
+	name = request.Name
+	if request.Revision > 0 {
+		name = revisionPath(name, request.Revision)
+	}
+	paste, err = getRevision(req.Context(), name, s.db.Get)
+	//Private pastes of other users are hidden as they do not exist
+	if err == nil && !s.canView(req, paste) {
+		err = ErrDatabaseNotFound
+	}
+	if errors.Is(err, ErrDatabaseNotFound) {
 		w.WriteHeader(http.StatusNotFound)
 		res = getPasteResponse{
 			OK:    false,
@@ -157,6 +232,20 @@ func handleAPIGetPaste(s Server, w http.ResponseWriter, req *http.Request) {
 		}
 		goto response
 	}
+	if err != nil {
+		status := databaseErrorStatus(err)
+		w.WriteHeader(status)
+		s.logger(req).Error("Cannot get from Database", "error", err)
+		res = getPasteResponse{
+			OK:    false,
+			Error: http.StatusText(status),
+		}
+		goto response
+	}
+
+	metricPastesRead.Inc()
+	s.views.add(paste.Path)
+	s.logPaste(req, eventPasteView, paste)
 
 	if request.Render {
 		render = string(paste.Content)
@@ -164,21 +253,212 @@ func handleAPIGetPaste(s Server, w http.ResponseWriter, req *http.Request) {
 	}
 
 	res = getPasteResponse{
-		OK:      true,
-		Name:    request.Name,
-		Code:    paste.Source,
-		Render:  render,
-		Style:   style,
-		Created: paste.Created.Unix(),
-		User:    paste.User,
-		Expire:  paste.Expire.UnixNano(),
+		OK:         true,
+		Name:       request.Name,
+		Code:       paste.Source,
+		Render:     render,
+		Style:      style,
+		Created:    paste.Created.Unix(),
+		User:       paste.User,
+		UserID:     paste.UserID,
+		Visibility: paste.visibility(),
+		Revision:   paste.revision(),
+	}
+	if paste.Expires() {
+		res.Expire = paste.Expire.UnixNano()
 	}
 
 response:
 	result, _ := json.Marshal(res)
 
 	if _, err := w.Write(result); err != nil {
-		log.Println("Cannot write response:", err)
+		s.logger(req).Warn("Cannot write response", "error", err)
 		return
 	}
 }
+
+//handleAPIExpirePaste changes the expiration of a paste, only its owner can change it
+func handleAPIExpirePaste(s Server, w http.ResponseWriter, req *http.Request) {
+	var request expirePasteRequest
+	var res expirePasteResponse
+	var body []byte
+	var paste Paste
+	var err error
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: ErrMethodNotAllowed,
+		}
+		goto response
+	}
+
+	body, err = ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		s.logger(req).Error("Cannot read body", "error", err)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: ErrInternalServerError,
+		}
+		goto response
+	}
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: ErrCannotDecodeJSON,
+		}
+		goto response
+	}
+
+	//The old revisions expire with the paste
+	paste, err = s.db.Get(req.Context(), request.Name)
+	if err == nil && (paste.isRevision() || !s.canView(req, paste)) {
+		err = ErrDatabaseNotFound
+	}
+	if err == nil && !s.requestOwns(req, paste) {
+		w.WriteHeader(http.StatusForbidden)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: ErrPasteNotOwned.Error(),
+		}
+		goto response
+	}
+	if err == nil {
+		paste, err = s.changeExpire(req.Context(), paste, request.ExpireTime)
+	}
+	if errors.Is(err, ErrDatabaseNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: ErrPasteNotFound,
+		}
+		goto response
+	}
+	if errors.Is(err, ErrExpireTimeNotValid) {
+		w.WriteHeader(http.StatusBadRequest)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: err.Error(),
+		}
+		goto response
+	}
+	if err != nil {
+		status := databaseErrorStatus(err)
+		w.WriteHeader(status)
+		s.logger(req).Error("Cannot change expiration", "error", err)
+		res = expirePasteResponse{
+			OK:    false,
+			Error: http.StatusText(status),
+		}
+		goto response
+	}
+
+	s.logPaste(req, eventPasteExpireChange, paste)
+	res = expirePasteResponse{OK: true}
+	if paste.Expires() {
+		res.Expire = paste.Expire.UnixNano()
+	}
+
+response:
+	result, _ := json.Marshal(res)
+
+	if _, err := w.Write(result); err != nil {
+		s.logger(req).Warn("Cannot write response", "error", err)
+		return
+	}
+}
+
+type searchResponse struct {
+	OK    bool
+	Error string
+	//Total is the number of results, Results are the ones selected by offset and limit
+	Total   int
+	Results []searchResponseResult
+}
+
+type searchResponseResult struct {
+	Path    string
+	User    string
+	UserID  string `json:",omitempty"`
+	Lang    string
+	Created int64
+	Expire  int64
+	//Snippet is the part of the source around the words searched
+	//Highlights are the start and the end in bytes of the words searched in Snippet
+	Snippet    string
+	Highlights [][2]int
+}
+
+//Handle: /api/v1/search GET
+//The query parameters are the ones of parseSearchRequest
+func handleAPISearch(s Server, w http.ResponseWriter, req *http.Request) {
+	var res searchResponse
+	var r searchRequest
+	var results []searchResult
+	var err error
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		res = searchResponse{
+			OK:    false,
+			Error: ErrMethodNotAllowed,
+		}
+		goto response
+	}
+
+	r, err = parseSearchRequest(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		res = searchResponse{
+			OK:    false,
+			Error: err.Error(),
+		}
+		goto response
+	}
+
+	results, res.Total, err = s.searchPastes(req, r)
+	if err != nil {
+		status := databaseErrorStatus(err)
+		w.WriteHeader(status)
+		s.logger(req).Error("Cannot search pastes", "error", err)
+		res = searchResponse{
+			OK:    false,
+			Error: http.StatusText(status),
+		}
+		goto response
+	}
+
+	res.OK = true
+	res.Results = make([]searchResponseResult, len(results))
+	for i, result := range results {
+		res.Results[i] = searchResponseResult{
+			Path:       result.Path,
+			User:       result.User,
+			UserID:     result.UserID,
+			Lang:       result.Lang,
+			Created:    result.Created.Unix(),
+			Highlights: [][2]int{},
+		}
+		if result.Expires() {
+			res.Results[i].Expire = result.Expire.UnixNano()
+		}
+		for _, part := range result.Snippet {
+			if part.Match {
+				start := len(res.Results[i].Snippet)
+				res.Results[i].Highlights = append(res.Results[i].Highlights, [2]int{start, start + len(part.Text)})
+			}
+			res.Results[i].Snippet += part.Text
+		}
+	}
+
+response:
+	result, _ := json.Marshal(res)
+
+	if _, err := w.Write(result); err != nil {
+		s.logger(req).Warn("Cannot write response", "error", err)
+	}
+}
@@ -70,9 +70,86 @@ func TestNewPaste(t *testing.T) {
 			true,
 			false,
 		},
+		{
+			"ExpireTime not allowed",
+			"POST",
+			http.StatusBadRequest,
+			newPasteRequest{
+				ExpireTime: "100000h",
+				Code:       "example paste",
+			},
+			newPasteResponse{false, ErrExpireTimeNotValid.Error(), ""},
+			true,
+			false,
+		},
+		{
+			"ExpireTime negative",
+			"POST",
+			http.StatusBadRequest,
+			newPasteRequest{
+				ExpireTime: "-30m",
+				Code:       "example paste",
+			},
+			newPasteResponse{false, ErrExpireTimeNotValid.Error(), ""},
+			true,
+			false,
+		},
+		{
+			"Custom path",
+			"POST",
+			http.StatusOK,
+			newPasteRequest{
+				ExpireTime: getExpireTime(t),
+				Code:       "example paste",
+				Path:       "deploy-runbook",
+			},
+			newPasteResponse{true, "", "deploy-runbook"},
+			true,
+			false,
+		},
+		{
+			"Custom path used",
+			"POST",
+			http.StatusConflict,
+			newPasteRequest{
+				ExpireTime: getExpireTime(t),
+				Code:       "example paste",
+				Path:       "deploy-runbook",
+			},
+			newPasteResponse{false, ErrPathUsed.Error() + ": deploy-runbook", ""},
+			true,
+			false,
+		},
+		{
+			"Custom path reserved",
+			"POST",
+			http.StatusBadRequest,
+			newPasteRequest{
+				ExpireTime: getExpireTime(t),
+				Code:       "example paste",
+				Path:       "raw",
+			},
+			newPasteResponse{false, ErrPathReserved.Error() + ": raw", ""},
+			true,
+			false,
+		},
+		{
+			"Custom path not valid",
+			"POST",
+			http.StatusBadRequest,
+			newPasteRequest{
+				ExpireTime: getExpireTime(t),
+				Code:       "example paste",
+				Path:       "../etc",
+			},
+			newPasteResponse{},
+			false,
+			false,
+		},
 	}
 
-	server := NewServer(MemoryDB{}, defaultCfg)
+	server := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+	server.handleRoute("/raw/", handleRawPaste)
 
 	for _, tt := range tm {
 		t.Run(tt.name, func(t *testing.T) {
@@ -150,13 +227,15 @@ func TestGetPaste(t *testing.T) {
 				Render: false,
 			},
 			getPasteResponse{
-				OK:      true,
-				Error:   "",
-				Name:    "test",
-				Code:    "test",
-				User:    "test",
-				Created: 0,
-				Expire:  0,
+				OK:         true,
+				Error:      "",
+				Name:       "test",
+				Code:       "test",
+				User:       "test",
+				Created:    0,
+				Expire:     0,
+				Visibility: VisibilityUnlisted,
+				Revision:   1,
 			},
 		},
 		{
@@ -168,15 +247,17 @@ func TestGetPaste(t *testing.T) {
 				Render: true,
 			},
 			getPasteResponse{
-				OK:      true,
-				Error:   "",
-				Name:    "test",
-				Code:    "test",
-				User:    "test",
-				Created: 0,
-				Expire:  0,
-				Render:  "<h1>test</h1>",
-				Style:   "",
+				OK:         true,
+				Error:      "",
+				Name:       "test",
+				Code:       "test",
+				User:       "test",
+				Created:    0,
+				Expire:     0,
+				Render:     "<h1>test</h1>",
+				Style:      "",
+				Visibility: VisibilityUnlisted,
+				Revision:   1,
 			},
 		},
 		{
@@ -194,7 +275,7 @@ func TestGetPaste(t *testing.T) {
 		},
 	}
 
-	server := NewServer(NewTestDB(), defaultCfg)
+	server := NewServer(AdaptDatabase(NewTestDB()), defaultCfg)
 
 	for _, tt := range tm {
 		t.Run(tt.name, func(t *testing.T) {
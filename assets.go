@@ -3,7 +3,6 @@ package main
 import (
 	"html/template"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 )
@@ -17,7 +16,6 @@ func getAsset(assetsDir, filename string) (http.File, error) {
 	} else if assets.Has(filename) {
 		file, err = assets.Open(filename)
 	} else {
-		log.Println("Cannot find file:", filename)
 		return nil, os.ErrNotExist
 	}
 
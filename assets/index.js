@@ -12,8 +12,22 @@ function insertTab(event) {
     return false
 }
 
+//setExpireOffset sends the time zone of the expire date, the picker has none
+function setExpireOffset() {
+    const date = document.getElementById("expire_date")
+    if (date.value) {
+        document.getElementById("expire_offset").value = new Date(date.value).getTimezoneOffset()
+    }
+    return true
+}
+
 window.onload = () => {
     let code = document.getElementById("code")
     code.onkeydown = insertTab
     code.focus()
+
+    let date = document.getElementById("expire_date")
+    if (date) {
+        date.form.onsubmit = setExpireOffset
+    }
 }
\ No newline at end of file
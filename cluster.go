@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Errors declaration for the cluster mode
+var (
+	ErrClusterNotValid    = fmt.Errorf("Cluster.Self and Cluster.Secret are needed by the cluster mode")
+	ErrClusterSecret      = fmt.Errorf("Cluster secret not valid")
+	ErrClusterNodeMissing = fmt.Errorf("Node missing")
+)
+
+//clusterSecretHeader is the header with the secret shared by the nodes
+const clusterSecretHeader = "X-Cluster-Secret"
+
+//clusterTimeout is the timeout of the requests between the nodes
+const clusterTimeout = 30 * time.Second
+
+//hashRing assigns the paths to the nodes with consistent hashing
+//Every node has many points on the ring, a path is owned by the node of the first point after its hash
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func newHashRing(nodes []string, replicas int) *hashRing {
+	r := &hashRing{nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+//owner returns the node owning the path, empty if there are no nodes
+func (r *hashRing) owner(path string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(path))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+//clusterDB is a Database wrapper spreading the pastes over the nodes of a cluster
+//Every node stores the pastes it owns in its local database, the others are requested to their owner
+//Listing and statistics are about the pastes of every node
+type clusterDB struct {
+	local    DatabaseV2
+	self     string
+	secret   string
+	replicas int
+	client   *http.Client
+	log      *slog.Logger
+
+	mu    sync.RWMutex
+	nodes []string
+	ring  *hashRing
+	//previous is the ring before the last change, pastes not moved yet are still on their previous owner
+	previous *hashRing
+}
+
+//newClusterDB wraps local for the cluster described by cfg
+func newClusterDB(local DatabaseV2, cfg clusterConfig, logger *slog.Logger) (*clusterDB, error) {
+	if cfg.Self == "" || cfg.Secret == "" {
+		return nil, ErrClusterNotValid
+	}
+
+	if cfg.Replicas < 1 {
+		cfg.Replicas = 1
+	}
+
+	db := &clusterDB{
+		local:    local,
+		self:     cfg.Self,
+		secret:   cfg.Secret,
+		replicas: cfg.Replicas,
+		client:   &http.Client{Timeout: clusterTimeout},
+		log:      logger,
+	}
+	nodes := cfg.Nodes
+	if !containsNode(nodes, cfg.Self) {
+		nodes = append(nodes, cfg.Self)
+	}
+	db.setRing(nodes)
+	return db, nil
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+//setRing replaces the nodes of the cluster, the pastes are not moved
+func (db *clusterDB) setRing(nodes []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.nodes = append([]string(nil), nodes...)
+	db.previous = db.ring
+	db.ring = newHashRing(db.nodes, db.replicas)
+	if db.previous == nil {
+		db.previous = db.ring
+	}
+}
+
+//Nodes returns the nodes of the cluster
+func (db *clusterDB) Nodes() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]string(nil), db.nodes...)
+}
+
+//owners returns the node owning the path and the one owning it before the last change
+func (db *clusterDB) owners(path string) (string, string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.ring.owner(path), db.previous.owner(path)
+}
+
+//request sends a request to a node, in and out are encoded as JSON
+func (db *clusterDB) request(ctx context.Context, method, node, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(node, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(clusterSecretHeader, db.secret)
+	res, err := db.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(res.Body).Decode(out)
+	case http.StatusNotFound:
+		return ErrDatabaseNotFound
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: node %s", ErrDatabaseUnavailable, node)
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("Node %s: %s: %s", node, res.Status, strings.TrimSpace(string(msg)))
+}
+
+func clusterPastePath(name string) string { return "/api/cluster/paste/" + url.PathEscape(name) }
+
+//getFrom returns a paste stored on a node
+func (db *clusterDB) getFrom(ctx context.Context, node, name string) (Paste, error) {
+	if node == db.self {
+		return db.local.Get(ctx, name)
+	}
+	var p Paste
+	err := db.request(ctx, http.MethodGet, node, clusterPastePath(name), nil, &p)
+	return p, err
+}
+
+//Get implements DatabaseV2
+func (db *clusterDB) Get(ctx context.Context, name string) (Paste, error) {
+	owner, previous := db.owners(name)
+	p, err := db.getFrom(ctx, owner, name)
+	if errors.Is(err, ErrDatabaseNotFound) && previous != owner {
+		return db.getFrom(ctx, previous, name)
+	}
+	return p, err
+}
+
+//GetEncoded implements encodedDatabase
+func (db *clusterDB) GetEncoded(ctx context.Context, name string) (Paste, error) {
+	edb, encoded := db.local.(encodedDatabase)
+	if owner, _ := db.owners(name); owner == db.self && encoded {
+		p, err := edb.GetEncoded(ctx, name)
+		if !errors.Is(err, ErrDatabaseNotFound) {
+			return p, err
+		}
+	}
+	return db.Get(ctx, name)
+}
+
+//Store implements DatabaseV2
+func (db *clusterDB) Store(ctx context.Context, name string, value Paste) error {
+	owner, _ := db.owners(name)
+	if owner == db.self {
+		return db.local.Store(ctx, name, value)
+	}
+	return db.request(ctx, http.MethodPut, owner, clusterPastePath(name), value, nil)
+}
+
+//Delete implements DatabaseV2
+func (db *clusterDB) Delete(ctx context.Context, name string) error {
+	owner, _ := db.owners(name)
+	if owner == db.self {
+		return db.local.Delete(ctx, name)
+	}
+	return db.request(ctx, http.MethodDelete, owner, clusterPastePath(name), nil, nil)
+}
+
+//ReservePath implements DatabaseV2
+//Only the paths owned by this node are used, so new pastes are stored locally
+func (db *clusterDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	if !containsNode(db.Nodes(), db.self) {
+		return false, fmt.Errorf("%w: this node left the cluster", ErrClusterNodeMissing)
+	}
+	owner, previous := db.owners(path)
+	if owner != db.self {
+		return false, errPathSkipped
+	}
+	if previous != db.self {
+		//The path may be used by a paste not moved yet
+		_, err := db.getFrom(ctx, previous, path)
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, ErrDatabaseNotFound) {
+			return false, err
+		}
+	}
+	return db.local.ReservePath(ctx, path)
+}
+
+//clusterReservation is the response of the reserve route
+type clusterReservation struct{ Reserved bool }
+
+//reserveOnOwner reserves a path on the node owning it
+func (db *clusterDB) reserveOnOwner(ctx context.Context, path string) (bool, error) {
+	owner, _ := db.owners(path)
+	if owner == db.self {
+		return db.ReservePath(ctx, path)
+	}
+	var res clusterReservation
+	err := db.request(ctx, http.MethodPost, owner, "/api/cluster/reserve/"+url.PathEscape(path), nil, &res)
+	return res.Reserved, err
+}
+
+//clusterNode is the database of a single node of the cluster
+type clusterNode struct {
+	*clusterDB
+	node string
+}
+
+//clusterListResponse is the response of the list route
+type clusterListResponse struct {
+	Pastes []Paste
+	Cursor string
+}
+
+//List implements DatabaseV2, it lists the pastes stored on the node
+func (n clusterNode) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	if n.node == n.self {
+		return n.local.List(ctx, opts)
+	}
+	var res clusterListResponse
+	err := n.request(ctx, http.MethodPost, n.node, "/api/cluster/list", opts, &res)
+	return res.Pastes, res.Cursor, err
+}
+
+//Stats implements DatabaseV2, it returns the statistics of the pastes stored on the node
+func (n clusterNode) Stats(ctx context.Context) (DatabaseStats, error) {
+	if n.node == n.self {
+		return n.local.Stats(ctx)
+	}
+	var stats DatabaseStats
+	err := n.request(ctx, http.MethodGet, n.node, "/api/cluster/stats", nil, &stats)
+	return stats, err
+}
+
+//List implements DatabaseV2
+//The pages of every node are merged, the cursor is the position of the last paste so it is valid on every node
+//A paste stored on two nodes while it is moved is listed once
+func (db *clusterDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	var streams []*listStream
+	for _, node := range db.Nodes() {
+		streams = append(streams, newListStream(ctx, clusterNode{db, node}, opts))
+	}
+
+	var page []Paste
+	//One more paste tells if there is a next page
+	for opts.Limit == 0 || len(page) <= opts.Limit {
+		var first *listStream
+		var p Paste
+		for _, s := range streams {
+			next, ok, err := s.peek()
+			if err != nil {
+				return nil, "", err
+			}
+			if ok && (first == nil || opts.before(next, p)) {
+				first, p = s, next
+			}
+		}
+		if first == nil {
+			break
+		}
+		first.next()
+		if len(page) > 0 && page[len(page)-1].Path == p.Path {
+			continue
+		}
+		page = append(page, p)
+	}
+
+	if opts.Limit == 0 || len(page) <= opts.Limit {
+		return page, "", nil
+	}
+	page = page[:opts.Limit]
+	return page, listCursor(page[len(page)-1]), nil
+}
+
+//Stats implements DatabaseV2, the statistics of every node are added
+func (db *clusterDB) Stats(ctx context.Context) (DatabaseStats, error) {
+	var total DatabaseStats
+	for _, node := range db.Nodes() {
+		stats, err := clusterNode{db, node}.Stats(ctx)
+		if err != nil {
+			return DatabaseStats{}, err
+		}
+		total.Count += stats.Count
+		total.Size += stats.Size
+	}
+	return total, nil
+}
+
+//clusterSearchRequest is a search sent to the nodes of the cluster
+//UserID and Owner identify the uploader, their pastes are found with the public ones
+type clusterSearchRequest struct {
+	Terms   []string
+	Options ListOptions
+	UserID  string
+	Owner   string
+	//Limit is the maximum number of hits returned
+	Limit int
+}
+
+//clusterSearchResponse is the response of the search route
+type clusterSearchResponse struct {
+	Hits []clusterSearchHit
+	//Total is the number of hits found, also the ones not returned
+	Total int
+}
+
+type clusterSearchHit struct {
+	Paste Paste
+	Score int
+}
+
+//run searches the pastes in the index
+func (r clusterSearchRequest) run(index *searchIndex) clusterSearchResponse {
+	u := uploader{owner: r.Owner}
+	if r.UserID != "" {
+		u.account = &Account{ID: r.UserID}
+	}
+	hits := index.search(r.Terms, r.Options, func(p Paste) bool {
+		return p.visibility() == VisibilityPublic || u.owns(p)
+	})
+
+	res := clusterSearchResponse{Total: len(hits)}
+	if len(hits) > r.Limit {
+		hits = hits[:r.Limit]
+	}
+	for _, hit := range hits {
+		res.Hits = append(res.Hits, clusterSearchHit{hit.paste, hit.score})
+	}
+	return res
+}
+
+//search runs the search on every node, index is the one of this node
+//It returns the first limit hits and the total number of hits
+func (db *clusterDB) search(ctx context.Context, index *searchIndex, terms []string, opts ListOptions, u uploader, limit int) ([]searchHit, int, error) {
+	r := clusterSearchRequest{Terms: terms, Options: opts, Owner: u.owner, Limit: limit}
+	if u.account != nil {
+		r.UserID = u.account.ID
+	}
+
+	var hits []searchHit
+	total := 0
+	for _, node := range db.Nodes() {
+		var res clusterSearchResponse
+		if node == db.self {
+			res = r.run(index)
+		} else if err := db.request(ctx, http.MethodPost, node, "/api/cluster/search", r, &res); err != nil {
+			return nil, 0, err
+		}
+		total += res.Total
+		for _, hit := range res.Hits {
+			hits = append(hits, searchHit{hit.Paste, hit.Score})
+		}
+	}
+
+	sortHits(hits)
+	//A paste indexed on two nodes while it is moved is found once
+	unique := hits[:0]
+	for _, hit := range hits {
+		if len(unique) > 0 && unique[len(unique)-1].paste.Path == hit.paste.Path {
+			total--
+			continue
+		}
+		unique = append(unique, hit)
+	}
+	if len(unique) > limit {
+		unique = unique[:limit]
+	}
+	return unique, total, nil
+}
+
+//ExpiresPastes implements expiringDatabase
+func (db *clusterDB) ExpiresPastes() bool { return expiresPastes(db.local) }
+
+//Close implements DatabaseV2
+func (db *clusterDB) Close() error { return db.local.Close() }
+
+//setNodes replaces the nodes of the cluster and moves the local pastes owned by other nodes
+func (db *clusterDB) setNodes(ctx context.Context, nodes []string) error {
+	db.setRing(nodes)
+	return db.rebalance(ctx)
+}
+
+//rebalance moves the local pastes owned by other nodes to their owner
+func (db *clusterDB) rebalance(ctx context.Context) error {
+	var moving []Paste
+	err := eachPaste(ctx, db.local, ListOptions{}, func(p Paste) error {
+		if owner, _ := db.owners(p.Path); owner != db.self {
+			moving = append(moving, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range moving {
+		owner, _ := db.owners(p.Path)
+		if err := db.request(ctx, http.MethodPut, owner, clusterPastePath(p.Path), p, nil); err != nil {
+			return fmt.Errorf("Cannot move %s to %s: %w", p.Path, owner, err)
+		}
+		if err := db.local.Delete(ctx, p.Path); err != nil {
+			return err
+		}
+	}
+	db.log.Info("Rebalanced cluster", "nodes", len(db.Nodes()), "moved", len(moving))
+	return nil
+}
+
+//broadcast sends the nodes to every node in them, this node is updated last
+func (db *clusterDB) broadcast(ctx context.Context, nodes []string) error {
+	for _, node := range nodes {
+		if node == db.self {
+			continue
+		}
+		if err := db.request(ctx, http.MethodPut, node, "/api/cluster/nodes", nodes, nil); err != nil {
+			return err
+		}
+	}
+	return db.setNodes(ctx, nodes)
+}
+
+//join adds this node to the cluster of the node seed
+func (db *clusterDB) join(ctx context.Context, seed string) error {
+	return db.request(ctx, http.MethodPost, seed, "/api/cluster/join", clusterJoinRequest{Node: db.self}, nil)
+}
+
+//leave removes this node from the cluster, its pastes are moved to the other nodes
+func (db *clusterDB) leave(ctx context.Context) error {
+	var nodes []string
+	for _, node := range db.Nodes() {
+		if node != db.self {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("%w: this is the last node of the cluster", ErrClusterNodeMissing)
+	}
+	return db.broadcast(ctx, nodes)
+}
+
+//handleClusterRoutes registers the routes used by the nodes of the cluster
+func (s *Server) handleClusterRoutes() {
+	s.handleRoute("/api/cluster/paste/", handleClusterPaste)
+	s.handleRoute("/api/cluster/reserve/", handleClusterReserve)
+	s.handleRoute("/api/cluster/list", handleClusterList)
+	s.handleRoute("/api/cluster/stats", handleClusterStats)
+	s.handleRoute("/api/cluster/search", handleClusterSearch)
+	s.handleRoute("/api/cluster/nodes", handleClusterNodes)
+	s.handleRoute("/api/cluster/join", handleClusterJoin)
+	s.handleRoute("/api/cluster/leave", handleClusterLeave)
+}
+
+//checkClusterSecret writes an error if the request is not sent by a node of the cluster
+func checkClusterSecret(s Server, w http.ResponseWriter, req *http.Request) bool {
+	secret := req.Header.Get(clusterSecretHeader)
+	if s.cluster == nil || subtle.ConstantTimeCompare([]byte(secret), []byte(s.cluster.secret)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, ErrClusterSecret)
+		return false
+	}
+	return true
+}
+
+//writeClusterResponse writes the response of a cluster route
+func writeClusterResponse(s Server, w http.ResponseWriter, req *http.Request, out interface{}, err error) {
+	if err != nil {
+		status := databaseErrorStatus(err)
+		if status != http.StatusNotFound {
+			s.logger(req).Error("Cluster request failed", "error", err)
+		}
+		w.WriteHeader(status)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if out == nil {
+		out = struct{}{}
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		s.logger(req).Warn("Cannot write response", "error", err)
+	}
+}
+
+//Handle: /api/cluster/paste/PASTE GET, PUT, DELETE
+//Operates on the local database
+func handleClusterPaste(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/api/cluster/paste/")
+	local := s.cluster.local
+
+	switch req.Method {
+	case http.MethodGet:
+		paste, err := local.Get(req.Context(), name)
+		writeClusterResponse(s, w, req, paste, err)
+	case http.MethodPut:
+		var paste Paste
+		if err := json.NewDecoder(req.Body).Decode(&paste); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, ErrCannotDecodeJSON)
+			return
+		}
+		paste.Path = name
+		err := local.Store(req.Context(), name, paste)
+		if err == nil {
+			s.scheduleExpire(paste)
+		}
+		writeClusterResponse(s, w, req, nil, err)
+	case http.MethodDelete:
+		err := local.Delete(req.Context(), name)
+		if err == nil {
+			s.timers.cancel(name)
+		}
+		writeClusterResponse(s, w, req, nil, err)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+	}
+}
+
+//Handle: /api/cluster/reserve/PASTE POST
+//Reserves a path owned by this node
+func handleClusterReserve(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/api/cluster/reserve/")
+	reserved, err := s.cluster.ReservePath(req.Context(), path)
+	if errors.Is(err, errPathSkipped) {
+		err = fmt.Errorf("%w: %s is not the owner of %s", ErrDatabaseUnavailable, s.cluster.self, path)
+	}
+	writeClusterResponse(s, w, req, clusterReservation{reserved}, err)
+}
+
+//Handle: /api/cluster/list POST
+//Lists the pastes of the local database, the body is the ListOptions
+func handleClusterList(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+	var opts ListOptions
+	if err := json.NewDecoder(req.Body).Decode(&opts); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, ErrCannotDecodeJSON)
+		return
+	}
+	pastes, cursor, err := s.cluster.local.List(req.Context(), opts)
+	writeClusterResponse(s, w, req, clusterListResponse{pastes, cursor}, err)
+}
+
+//Handle: /api/cluster/stats GET
+//Returns the statistics of the local database
+func handleClusterStats(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+	stats, err := s.cluster.local.Stats(req.Context())
+	writeClusterResponse(s, w, req, stats, err)
+}
+
+//Handle: /api/cluster/search POST
+//Searches the pastes of this node, the body is the clusterSearchRequest
+func handleClusterSearch(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+	var r clusterSearchRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, ErrCannotDecodeJSON)
+		return
+	}
+	if s.search == nil {
+		writeClusterResponse(s, w, req, nil, fmt.Errorf("%w: search disabled on %s", ErrDatabaseUnavailable, s.cluster.self))
+		return
+	}
+	writeClusterResponse(s, w, req, r.run(s.search.index), nil)
+}
+
+//Handle: /api/cluster/nodes GET, PUT
+func handleClusterNodes(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeClusterResponse(s, w, req, s.cluster.Nodes(), nil)
+	case http.MethodPut:
+		var nodes []string
+		if err := json.NewDecoder(req.Body).Decode(&nodes); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, ErrCannotDecodeJSON)
+			return
+		}
+		err := s.cluster.setNodes(req.Context(), nodes)
+		writeClusterResponse(s, w, req, nil, err)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+	}
+}
+
+type clusterJoinRequest struct {
+	Node string
+}
+
+//Handle: /api/cluster/join POST
+//Adds the node to the cluster and sends the new nodes to all the nodes
+func handleClusterJoin(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+
+	var join clusterJoinRequest
+	if err := json.NewDecoder(req.Body).Decode(&join); err != nil || join.Node == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, ErrCannotDecodeJSON)
+		return
+	}
+
+	nodes := s.cluster.Nodes()
+	if !containsNode(nodes, join.Node) {
+		nodes = append(nodes, join.Node)
+	}
+	err := s.cluster.broadcast(req.Context(), nodes)
+	if err == nil {
+		s.logger(req).Info("Node joined the cluster", "node", join.Node)
+	}
+	writeClusterResponse(s, w, req, nodes, err)
+}
+
+//Handle: /api/cluster/leave POST
+//Removes this node from the cluster, when it returns the node can be stopped
+func handleClusterLeave(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkClusterSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+
+	err := s.cluster.leave(req.Context())
+	if err == nil {
+		s.logger(req).Info("Left the cluster")
+	}
+	writeClusterResponse(s, w, req, nil, err)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	ring := newHashRing(nodes, 100)
+	grown := newHashRing(append(nodes, "http://d"), 100)
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		path := "paste" + strconv.Itoa(i)
+		owner := ring.owner(path)
+		owned[owner]++
+		if newOwner := grown.owner(path); newOwner != owner && newOwner != "http://d" {
+			t.Fatalf("Path %s moved between old nodes: %s to %s", path, owner, newOwner)
+		}
+	}
+	for _, node := range nodes {
+		if owned[node] < 500 {
+			t.Errorf("Node %s owns too few paths: %d", node, owned[node])
+		}
+	}
+
+	if owner := newHashRing(nil, 100).owner("paste"); owner != "" {
+		t.Errorf("Owner without nodes: %s", owner)
+	}
+}
+
+//testNode is a node of a cluster served by httptest
+type testNode struct {
+	srv    Server
+	server *httptest.Server
+}
+
+func newTestNode(t *testing.T, nodes ...string) *testNode {
+	node := &testNode{}
+	node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		node.srv.ServeHTTP(w, req)
+	}))
+	t.Cleanup(node.server.Close)
+
+	cfg := defaultCfg
+	cfg.Cluster = clusterConfig{Self: node.server.URL, Nodes: nodes, Secret: "secret", Replicas: 100}
+	local, err := newSearchDB(context.Background(), AdaptDatabase(NewMemoryDB()))
+	if err != nil {
+		t.Fatalf("Could not create search index: %v", err)
+	}
+	db, err := newClusterDB(local, cfg.Cluster, newLogger(cfg))
+	if err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+	node.srv = NewServer(db, cfg)
+	node.srv.handleRoute("/raw/", handleRawPaste)
+	node.srv.handleClusterRoutes()
+	t.Cleanup(func() { node.srv.Close() })
+	return node
+}
+
+func (n *testNode) url() string { return n.server.URL }
+
+func (n *testNode) localCount(t *testing.T) int {
+	stats, err := n.srv.cluster.local.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	return stats.Count
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	a := newTestNode(t)
+	b := newTestNode(t, a.url())
+	a.srv.cluster.setRing([]string{a.url(), b.url()})
+
+	var paths []string
+	for i := 0; i < 20; i++ {
+		paste, err := NewPaste(ctx, &a.srv, nil, "", "", "", "paste "+strconv.Itoa(i), "", VisibilityPublic, time.Time{})
+		if err != nil {
+			t.Fatalf("Could not create paste: %v", err)
+		}
+		if owner, _ := a.srv.cluster.owners(paste.Path); owner != a.url() {
+			t.Fatalf("Paste created on a node not owning it: %s", owner)
+		}
+		paths = append(paths, paste.Path)
+	}
+
+	checkPastes := func(t *testing.T, nodes ...*testNode) {
+		total := 0
+		for _, n := range nodes {
+			total += n.localCount(t)
+			for _, path := range paths {
+				if _, err := n.srv.db.Get(ctx, path); err != nil {
+					t.Errorf("Paste %s not found from %s: %v", path, n.url(), err)
+				}
+			}
+		}
+		if total != len(paths) {
+			t.Errorf("Wrong number of stored pastes: expected: %d; got: %d", len(paths), total)
+		}
+	}
+
+	t.Run("Proxy", func(t *testing.T) {
+		checkPastes(t, a, b)
+		res, err := http.Get(b.url() + "/raw/" + paths[0])
+		if err != nil {
+			t.Fatalf("Could not get paste: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Wrong code: expected: %d; got: %d", http.StatusOK, res.StatusCode)
+		}
+	})
+
+	c := newTestNode(t)
+	t.Run("Join", func(t *testing.T) {
+		if err := c.srv.cluster.join(ctx, a.url()); err != nil {
+			t.Fatalf("Could not join: %v", err)
+		}
+		for _, n := range []*testNode{a, b, c} {
+			if nodes := n.srv.cluster.Nodes(); len(nodes) != 3 {
+				t.Errorf("Wrong nodes on %s: %v", n.url(), nodes)
+			}
+		}
+		if c.localCount(t) == 0 {
+			t.Errorf("No paste moved to the new node")
+		}
+		checkPastes(t, a, b, c)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		for _, reverse := range []bool{false, true} {
+			opts := ListOptions{Limit: 3, Reverse: reverse}
+			var listed []Paste
+			for {
+				page, cursor, err := b.srv.db.List(ctx, opts)
+				if err != nil {
+					t.Fatalf("Could not list pastes: %v", err)
+				}
+				listed = append(listed, page...)
+				if cursor == "" {
+					break
+				}
+				opts.Cursor = cursor
+			}
+			if len(listed) != len(paths) {
+				t.Errorf("Expected: %d pastes; got: %d", len(paths), len(listed))
+			}
+			for i := 1; i < len(listed); i++ {
+				if !opts.before(listed[i-1], listed[i]) {
+					t.Errorf("Reverse %v, wrong order: %s listed before %s", reverse, listed[i-1].Path, listed[i].Path)
+				}
+			}
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := b.srv.db.Stats(ctx)
+		if err != nil {
+			t.Fatalf("Could not get stats: %v", err)
+		}
+		if stats.Count != len(paths) {
+			t.Errorf("Expected: %d; got: %d", len(paths), stats.Count)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		r, _ := parseSearchRequest(url.Values{"q": {"paste"}, "limit": {"5"}, "offset": {"10"}})
+		results, total, err := b.srv.searchPastes(httptest.NewRequest(http.MethodGet, "/search", nil), r)
+		if err != nil {
+			t.Fatalf("Could not search: %v", err)
+		}
+		if total != len(paths) || len(results) != 5 {
+			t.Errorf("Expected: %d results, 5 returned; got: %d, %d returned", len(paths), total, len(results))
+		}
+	})
+
+	t.Run("Leave", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, b.url()+"/api/cluster/leave", nil)
+		req.Header.Set(clusterSecretHeader, "secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not leave: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Wrong code: expected: %d; got: %d", http.StatusOK, res.StatusCode)
+		}
+		if b.localCount(t) != 0 {
+			t.Errorf("Pastes left on the node")
+		}
+		if _, err := b.srv.createPastePath(ctx); !errors.Is(err, ErrClusterNodeMissing) {
+			t.Errorf("Expected: %v; got: %v", ErrClusterNodeMissing, err)
+		}
+		checkPastes(t, a, c)
+	})
+
+	t.Run("Secret not valid", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, a.url()+"/api/cluster/nodes", nil)
+		req.Header.Set(clusterSecretHeader, "wrong")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not send request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("Wrong code: expected: %d; got: %d", http.StatusForbidden, res.StatusCode)
+		}
+	})
+}
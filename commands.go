@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+//runCommand runs a subcommand, it returns the exit code
+func runCommand(name string, args []string, cfg config, logger *slog.Logger) int {
+	var err error
+	switch name {
+	case "export":
+		err = commandExport(args, cfg, logger)
+	case "import":
+		err = commandImport(args, cfg, logger)
+	case "migrate":
+		err = commandMigrate(args, cfg, logger)
+	case "adduser":
+		err = commandAddUser(args, cfg, logger)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\nCommands: export, import, migrate, adduser\n", name)
+		return 2
+	}
+
+	if err == flag.ErrHelp {
+		return 2
+	}
+	if err != nil {
+		logger.Error("Command failed", "command", name, "error", err)
+		return 1
+	}
+	return 0
+}
+
+//filterFlags adds the flags selecting the pastes to the FlagSet
+func filterFlags(flags *flag.FlagSet) (since, until, lang *string) {
+	since = flags.String("since", "", "Only pastes created after this time (RFC 3339)")
+	until = flags.String("until", "", "Only pastes created before this time (RFC 3339)")
+	lang = flags.String("lang", "", "Only pastes in this language")
+	return
+}
+
+//yep export [-o file] [-since time] [-until time] [-lang lang]
+func commandExport(args []string, cfg config, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "-", "Output file, - for stdout")
+	since, until, lang := filterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := parseExportFilter(*since, *until, *lang)
+	if err != nil {
+		return err
+	}
+
+	srv, err := openServer(cfg, logger, false)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	exported, err := exportPastes(context.Background(), w, srv.db, filter)
+	if err != nil {
+		return err
+	}
+	logger.Info("Exported pastes", "exported", exported)
+	return nil
+}
+
+//yep import [-i file] [-conflict policy] [-since time] [-until time] [-lang lang]
+func commandImport(args []string, cfg config, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := flags.String("i", "-", "Input file, - for stdin")
+	conflict := flags.String("conflict", ConflictSkip, "What to do with existing paths: skip, overwrite, rename or fail")
+	since, until, lang := filterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := parseExportFilter(*since, *until, *lang)
+	if err != nil {
+		return err
+	}
+
+	//The pastes would be lost when the command exits
+	if !cfg.Database.persistent() {
+		return fmt.Errorf("Import needs a persistent database, set Database.SnapshotPath or use the admin API")
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	srv, err := openServer(cfg, logger, true)
+	if err != nil {
+		return err
+	}
+
+	res, importErr := importPastes(context.Background(), srv, r, filter, *conflict)
+	//Save what has been imported even if the import failed
+	if err := srv.Close(); err != nil {
+		return err
+	}
+	if importErr != nil {
+		return importErr
+	}
+	logger.Info("Imported pastes", "imported", res.Imported, "skipped", res.Skipped, "renamed", res.Renamed)
+	return nil
+}
+
+//yep adduser NAME
+//The password is read from the first line of stdin
+//The server keeps the accounts in memory, it must be stopped while adding them
+func commandAddUser(args []string, cfg config, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("adduser", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: yep adduser NAME")
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	accounts, err := openAccountStore(cfg.Accounts.Path)
+	if err != nil {
+		return err
+	}
+	account, err := accounts.create(flags.Arg(0), strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	logger.Info("Account created", "account", account.ID, "name", account.Name, "path", cfg.Accounts.Path)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Compression algorithms supported by CompressDB
+//The names are the same used by the HTTP Content-Encoding header
+const (
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+//ErrUnknownCompression is used when the compression algorithm is not supported
+var ErrUnknownCompression = fmt.Errorf("Unknown compression algorithm")
+
+//encodedDatabase is implemented by the databases that can return a paste without decoding it
+type encodedDatabase interface {
+	//GetEncoded returns the paste as it is stored, Paste.Encoding reports the encoding used
+	GetEncoded(ctx context.Context, name string) (Paste, error)
+}
+
+//CompressDB is a Database wrapper that compresses the pastes when they are stored
+//and decompresses them when they are requested
+//Pastes smaller than the threshold are stored as they are
+type CompressDB struct {
+	db        DatabaseV2
+	algorithm string
+	threshold int
+}
+
+//NewCompressDB creates a new CompressDB wrapping db
+//threshold is the minimum size in bytes of a paste for being compressed
+func NewCompressDB(db DatabaseV2, algorithm string, threshold int) (*CompressDB, error) {
+	if _, err := newCompressWriter(algorithm, ioutil.Discard); err != nil {
+		return nil, err
+	}
+
+	return &CompressDB{
+		db:        db,
+		algorithm: algorithm,
+		threshold: threshold,
+	}, nil
+}
+
+//Get implements DatabaseV2
+func (db *CompressDB) Get(ctx context.Context, name string) (Paste, error) {
+	paste, err := db.db.Get(ctx, name)
+	if err != nil {
+		return paste, err
+	}
+	return decodePaste(paste)
+}
+
+//GetEncoded implements encodedDatabase
+func (db *CompressDB) GetEncoded(ctx context.Context, name string) (Paste, error) {
+	return db.db.Get(ctx, name)
+}
+
+//Store implements DatabaseV2
+func (db *CompressDB) Store(ctx context.Context, name string, value Paste) error {
+	if value.Encoding != "" || len(value.Source)+len(value.Content) < db.threshold {
+		return db.db.Store(ctx, name, value)
+	}
+
+	source, err := compress(db.algorithm, value.Source)
+	if err != nil {
+		return err
+	}
+	content, err := compress(db.algorithm, string(value.Content))
+	if err != nil {
+		return err
+	}
+
+	value.Source = source
+	value.Content = template.HTML(content)
+	value.Encoding = db.algorithm
+	return db.db.Store(ctx, name, value)
+}
+
+//Delete implements DatabaseV2
+func (db *CompressDB) Delete(ctx context.Context, name string) error { return db.db.Delete(ctx, name) }
+
+//ReservePath implements DatabaseV2
+func (db *CompressDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	return db.db.ReservePath(ctx, path)
+}
+
+//Close implements DatabaseV2
+func (db *CompressDB) Close() error { return db.db.Close() }
+
+//List implements DatabaseV2
+func (db *CompressDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	pastes, cursor, err := db.db.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range pastes {
+		if pastes[i], err = decodePaste(pastes[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	return pastes, cursor, nil
+}
+
+//Stats implements DatabaseV2
+func (db *CompressDB) Stats(ctx context.Context) (DatabaseStats, error) { return db.db.Stats(ctx) }
+
+//ExpiresPastes implements expiringDatabase
+func (db *CompressDB) ExpiresPastes() bool { return expiresPastes(db.db) }
+
+//decodePaste returns the paste with Source and Content decompressed
+func decodePaste(paste Paste) (Paste, error) {
+	if paste.Encoding == "" {
+		return paste, nil
+	}
+
+	source, err := decompress(paste.Encoding, paste.Source)
+	if err != nil {
+		return paste, err
+	}
+	content, err := decompress(paste.Encoding, string(paste.Content))
+	if err != nil {
+		return paste, err
+	}
+
+	paste.Source = source
+	paste.Content = template.HTML(content)
+	paste.Encoding = ""
+	return paste, nil
+}
+
+func newCompressWriter(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionDeflate:
+		return zlib.NewWriter(w), nil
+	}
+	return nil, ErrUnknownCompression
+}
+
+func newDecompressReader(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionDeflate:
+		return zlib.NewReader(r)
+	}
+	return nil, ErrUnknownCompression
+}
+
+func compress(algorithm, data string) (string, error) {
+	buf := new(bytes.Buffer)
+	w, err := newCompressWriter(algorithm, buf)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decompress(algorithm, data string) (string, error) {
+	r, err := newDecompressReader(algorithm, strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	return string(content), err
+}
+
+//acceptsEncoding reports if the client accepts the given Content-Encoding
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(accepted, ";")
+		name := strings.TrimSpace(params[0])
+		if name != "*" && !strings.EqualFold(name, encoding) {
+			continue
+		}
+
+		//q=0 means not acceptable
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
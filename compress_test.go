@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressDB(t *testing.T) {
+	tm := []struct {
+		name       string
+		algorithm  string
+		source     string
+		compressed bool
+	}{
+		{"Gzip", CompressionGzip, strings.Repeat("gzip paste\n", 100), true},
+		{"Deflate", CompressionDeflate, strings.Repeat("deflate paste\n", 100), true},
+		{"Under threshold", CompressionGzip, "small paste", false},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemoryDB()
+			db, err := NewCompressDB(AdaptDatabase(mem), tt.algorithm, 100)
+			if err != nil {
+				t.Fatalf("Could not create database: %v", err)
+			}
+
+			if err := db.Store(context.Background(), "test", Paste{Path: "test", Source: tt.source, Content: "<h1>test</h1>"}); err != nil {
+				t.Fatalf("Could not store paste: %v", err)
+			}
+
+			stored, err := mem.Get("test")
+			if err != nil {
+				t.Fatalf("Could not get stored paste: %v", err)
+			}
+			if compressed := stored.Encoding != ""; compressed != tt.compressed {
+				t.Errorf("Wrong encoding: compressed: %v; got: %q", tt.compressed, stored.Encoding)
+			}
+
+			paste, err := db.Get(context.Background(), "test")
+			if err != nil {
+				t.Fatalf("Could not get paste: %v", err)
+			}
+			if paste.Source != tt.source || paste.Content != "<h1>test</h1>" || paste.Encoding != "" {
+				t.Errorf("Paste not decoded: %+v", paste)
+			}
+		})
+	}
+
+	t.Run("Unknown algorithm", func(t *testing.T) {
+		if _, err := NewCompressDB(AdaptDatabase(NewMemoryDB()), "lzma", 0); err != ErrUnknownCompression {
+			t.Errorf("Expected: %v; got: %v", ErrUnknownCompression, err)
+		}
+	})
+}
+
+func TestRawPaste(t *testing.T) {
+	source := strings.Repeat("raw paste\n", 100)
+	db, err := NewCompressDB(AdaptDatabase(NewMemoryDB()), CompressionGzip, 0)
+	if err != nil {
+		t.Fatalf("Could not create database: %v", err)
+	}
+	if err := db.Store(context.Background(), "test", Paste{Path: "test", Source: source}); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	server := NewServer(db, defaultCfg)
+
+	tm := []struct {
+		name           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"Compressed", "deflate, gzip;q=0.8", CompressionGzip},
+		{"Wildcard", "*", CompressionGzip},
+		{"Not accepted", "gzip;q=0, deflate", ""},
+		{"No header", "", ""},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/raw/test", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			handleRawPaste(server, res, req)
+
+			if res.Code != http.StatusOK {
+				t.Fatalf("Wrong code: expected: %d; got: %d", http.StatusOK, res.Code)
+			}
+			if got := res.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Wrong encoding: expected: %q; got: %q", tt.encoding, got)
+			}
+
+			var body []byte
+			if tt.encoding == CompressionGzip {
+				r, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("Could not decompress body: %v", err)
+				}
+				body, err = ioutil.ReadAll(r)
+			} else {
+				body, err = ioutil.ReadAll(res.Body)
+			}
+			if err != nil {
+				t.Fatalf("Could not read body: %v", err)
+			}
+
+			if string(body) != source {
+				t.Errorf("Wrong body: %q", body)
+			}
+		})
+	}
+
+	t.Run("Not Found", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		handleRawPaste(server, res, httptest.NewRequest("GET", "/raw/notfound", nil))
+		if res.Code != http.StatusNotFound {
+			t.Errorf("Wrong code: expected: %d; got: %d", http.StatusNotFound, res.Code)
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Errors declaration for the dashboard
+var (
+	ErrNoPasteSelected = fmt.Errorf("No paste selected")
+	ErrActionNotValid  = fmt.Errorf("Action not valid")
+)
+
+//ownerCookie is the cookie with the owner token of the browser
+//The pastes created without an account are owned by the hash of the token
+const ownerCookie = "yep_owner"
+
+//ownerCookieAge is how long the browser keeps the owner token
+const ownerCookieAge = 365 * 24 * time.Hour
+
+//ownerToken returns the owner token of the browser, empty if it has none
+func ownerToken(req *http.Request) string {
+	cookie, err := req.Cookie(ownerCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+//setOwnerToken returns the owner token of the browser, a new one is created if it has none
+func setOwnerToken(w http.ResponseWriter, req *http.Request) (string, error) {
+	if token := ownerToken(req); token != "" {
+		return token, nil
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ownerCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(ownerCookieAge.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+//viewCounter counts the views of the pastes since the server started
+type viewCounter struct {
+	mu    sync.Mutex
+	views map[string]int64
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{views: make(map[string]int64)}
+}
+
+func (c *viewCounter) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.views[path]++
+}
+
+func (c *viewCounter) get(path string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.views[path]
+}
+
+func (c *viewCounter) delete(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.views, path)
+}
+
+//uploader identifies who is using the dashboard
+type uploader struct {
+	account *Account
+	//owner is the hash of the owner token, empty if the browser has none
+	owner string
+}
+
+//requestUploader returns the uploader of the request, ok is false if it cannot be identified
+func (s Server) requestUploader(req *http.Request) (u uploader, ok bool) {
+	u.account = s.sessionAccount(req)
+	if token := ownerToken(req); token != "" {
+		u.owner = hashToken(token)
+	}
+	return u, u.account != nil || u.owner != ""
+}
+
+//requestOwns reports if the request comes from the owner of the paste, with a session, the owner token or an API key
+func (s Server) requestOwns(req *http.Request, p Paste) bool {
+	if u, ok := s.requestUploader(req); ok && u.owns(p) {
+		return true
+	}
+	account, err := s.apiAccount(req)
+	return err == nil && account != nil && account.ID == p.UserID
+}
+
+//owns reports if the paste has been created by the uploader
+func (u uploader) owns(p Paste) bool {
+	if u.account != nil && p.UserID == u.account.ID {
+		return true
+	}
+	return u.owner != "" && p.UserID == "" && p.Owner == u.owner
+}
+
+//pastes returns the pastes of the uploader, the newest first
+func (u uploader) pastes(ctx context.Context, db DatabaseV2) ([]Paste, error) {
+	var filters []ListOptions
+	if u.account != nil {
+		filters = append(filters, ListOptions{UserID: u.account.ID, Latest: true})
+	}
+	if u.owner != "" {
+		filters = append(filters, ListOptions{Owner: u.owner, Latest: true})
+	}
+
+	var pastes []Paste
+	for _, filter := range filters {
+		err := eachPaste(ctx, db, filter, func(p Paste) error {
+			if u.owns(p) {
+				pastes = append(pastes, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(pastes, func(i, j int) bool { return pasteBefore(pastes[j], pastes[i]) })
+	return pastes, nil
+}
+
+//myPaste is a row of the dashboard
+type myPaste struct {
+	Paste
+	Size             int
+	Views            int64
+	CreatedFormatted string
+	ExpireFormatted  string
+}
+
+//Handle: /mine GET, POST
+//POST deletes the selected pastes, extends their expiration or changes it
+func handleMyPastes(s Server, w http.ResponseWriter, req *http.Request) {
+	u, ok := s.requestUploader(req)
+	if !ok && s.sessions != nil {
+		http.Redirect(w, req, "/login", http.StatusFound)
+		return
+	}
+
+	status := http.StatusOK
+	var actionErr error
+	if req.Method == http.MethodPost {
+		actionErr = myPastesAction(s, req, u)
+		if actionErr == nil {
+			http.Redirect(w, req, "/mine", http.StatusFound)
+			return
+		}
+		if errors.Is(actionErr, ErrDatabaseNotFound) || errors.Is(actionErr, ErrNoPasteSelected) ||
+			errors.Is(actionErr, ErrActionNotValid) || errors.Is(actionErr, ErrExpireTimeNotValid) {
+			status = http.StatusBadRequest
+		} else {
+			s.logger(req).Error("Cannot update pastes", "error", actionErr)
+			status = databaseErrorStatus(actionErr)
+		}
+	}
+
+	t, err := getTemplate(s.cfg.AssetsDir, "mine")
+	if err != nil {
+		s.logger(req).Error("Cannot get template", "template", "mine", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+
+	var pastes []Paste
+	if ok {
+		if pastes, err = u.pastes(req.Context(), s.db); err != nil {
+			handleDatabaseError(s, w, req, "/mine", err)
+			return
+		}
+	}
+	rows := make([]myPaste, len(pastes))
+	for i, p := range pastes {
+		rows[i] = myPaste{
+			Paste:            p,
+			Size:             len(p.Source),
+			Views:            s.views.get(p.Path),
+			CreatedFormatted: p.Created.Format(s.cfg.TimeFormat),
+			ExpireFormatted:  PasteNeverExpire,
+		}
+		if p.Expires() {
+			rows[i].ExpireFormatted = p.Expire.Format(s.cfg.TimeFormat)
+		}
+	}
+
+	var errMsg string
+	if actionErr != nil {
+		errMsg = actionErr.Error()
+	}
+	w.WriteHeader(status)
+	err = t.Execute(w, struct {
+		Header     string
+		Error      string
+		Account    *Account
+		Pastes     []myPaste
+		ExpireTime []*pasteDuration
+	}{
+		s.cfg.Header,
+		errMsg,
+		u.account,
+		rows,
+		s.cfg.ExpireAfter,
+	})
+	if err != nil {
+		s.logger(req).Error("Cannot execute template", "template", "mine", "error", err)
+	}
+}
+
+//myPastesAction runs the bulk action of the form on the selected pastes
+//The pastes not owned by the uploader are reported as not found
+func myPastesAction(s Server, req *http.Request, u uploader) error {
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+	paths := req.PostForm["path"]
+	if len(paths) == 0 {
+		return ErrNoPasteSelected
+	}
+
+	action := req.PostForm.Get("action")
+	var expireTime *pasteDuration
+	switch action {
+	case "delete":
+	case "extend", "expire":
+		var err error
+		if expireTime, err = validateExpire(req.PostForm.Get("expire"), s.cfg.ExpireAfter); err != nil {
+			return ErrExpireTimeNotValid
+		}
+	default:
+		return ErrActionNotValid
+	}
+
+	ctx := req.Context()
+	for _, path := range paths {
+		p, err := s.db.Get(ctx, path)
+		if err == nil && (!u.owns(p) || p.isRevision()) {
+			err = ErrDatabaseNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if action == "delete" {
+			if err := s.deletePaste(ctx, p); err != nil {
+				return err
+			}
+			s.logPaste(req, eventPasteDelete, p)
+			continue
+		}
+
+		//Extending never makes a paste expire earlier, setting the expiration can
+		expire := expireTime.after(time.Now())
+		if action == "extend" && (!p.Expires() || !expire.IsZero() && !expire.After(p.Expire)) {
+			continue
+		}
+		if err := s.setExpire(ctx, p, expire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
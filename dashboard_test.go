@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMyPastes(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.ExpireAfter = []*pasteDuration{{time.Minute}, {time.Hour}, {0}}
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/", handleHome)
+	s.handleRoute("/mine", handleMyPastes)
+
+	do := func(method, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+	create := func(cookie *http.Cookie) (string, *http.Cookie) {
+		res := do(http.MethodPost, "/", url.Values{"code": {"example paste"}, "expire": {"1m0s"}}, cookie)
+		if res.Code != http.StatusFound {
+			t.Fatalf("Could not create paste: %d", res.Code)
+		}
+		if cookies := res.Result().Cookies(); len(cookies) == 1 {
+			cookie = cookies[0]
+		}
+		return strings.TrimPrefix(res.Header().Get("Location"), "/"), cookie
+	}
+
+	first, cookie := create(nil)
+	if cookie == nil || cookie.Name != ownerCookie {
+		t.Fatalf("Expected: owner cookie; got: %v", cookie)
+	}
+	second, _ := create(cookie)
+	third, _ := create(cookie)
+	other, otherCookie := create(nil)
+	do(http.MethodGet, "/"+first, nil, nil)
+
+	res := do(http.MethodGet, "/mine", nil, cookie)
+	body := res.Body.String()
+	if res.Code != http.StatusOK || !strings.Contains(body, first) || !strings.Contains(body, second) || strings.Contains(body, other) {
+		t.Fatalf("Expected: %s and %s; got: %d\n%s", first, second, res.Code, body)
+	}
+
+	tt := []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{"No paste", url.Values{"action": {"delete"}}, http.StatusBadRequest},
+		{"Action not valid", url.Values{"action": {"rename"}, "path": {first}}, http.StatusBadRequest},
+		{"Expire not valid", url.Values{"action": {"extend"}, "path": {first}, "expire": {"2h0m0s"}}, http.StatusBadRequest},
+		{"Not owned", url.Values{"action": {"delete"}, "path": {other}}, http.StatusBadRequest},
+		{"Extend", url.Values{"action": {"extend"}, "path": {first, second}, "expire": {"1h0m0s"}}, http.StatusFound},
+		{"Extend never shortens", url.Values{"action": {"extend"}, "path": {third}, "expire": {"1m0s"}}, http.StatusFound},
+		{"Set never", url.Values{"action": {"expire"}, "path": {third}, "expire": {"Never"}}, http.StatusFound},
+		{"Shorten", url.Values{"action": {"expire"}, "path": {third}, "expire": {"1m0s"}}, http.StatusFound},
+		{"Delete", url.Values{"action": {"delete"}, "path": {second}}, http.StatusFound},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := do(http.MethodPost, "/mine", tc.form, cookie); res.Code != tc.code {
+				t.Errorf("Expected: %d; got: %d", tc.code, res.Code)
+			}
+		})
+	}
+
+	if p, err := s.db.Get(ctx, first); err != nil || time.Until(p.Expire) < 59*time.Minute {
+		t.Errorf("Expected: extended paste; got: %v, %v", p.Expire, err)
+	}
+	if p, err := s.db.Get(ctx, third); err != nil || !p.Expires() || time.Until(p.Expire) > time.Minute {
+		t.Errorf("Expected: shortened paste; got: %v, %v", p.Expire, err)
+	}
+	if _, err := s.db.Get(ctx, second); err != ErrDatabaseNotFound {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+	if _, err := s.db.Get(ctx, other); err != nil {
+		t.Errorf("Paste of another owner changed: %v", err)
+	}
+	if res := do(http.MethodGet, "/mine", nil, otherCookie); !strings.Contains(res.Body.String(), other) {
+		t.Errorf("Expected: %s", other)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//expireTimers keeps the timers used for deleting the pastes when they expire
+type expireTimers struct {
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	stopped bool
+}
+
+func newExpireTimers() *expireTimers {
+	return &expireTimers{timers: make(map[string]*time.Timer)}
+}
+
+//schedule calls fn at the given time, replacing the previous timer of the path
+func (t *expireTimers) schedule(path string, at time.Time, fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+
+	if old, ok := t.timers[path]; ok {
+		old.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(at), func() {
+		t.mu.Lock()
+		if t.timers[path] == timer {
+			delete(t.timers, path)
+		}
+		t.mu.Unlock()
+		fn()
+	})
+	t.timers[path] = timer
+}
+
+//cancel stops the timer of the path
+func (t *expireTimers) cancel(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, ok := t.timers[path]; ok {
+		timer.Stop()
+		delete(t.timers, path)
+	}
+}
+
+//stop stops all the timers, no other timers can be scheduled after this
+func (t *expireTimers) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for path, timer := range t.timers {
+		timer.Stop()
+		delete(t.timers, path)
+	}
+	t.stopped = true
+}
+
+//scheduleExpire schedules the deletion of the paste when it expires
+//Nothing is scheduled if the database deletes the expired pastes by itself
+func (s Server) scheduleExpire(paste Paste) {
+	if !paste.Expires() || expiresPastes(s.db) {
+		s.timers.cancel(paste.Path)
+		return
+	}
+
+	s.timers.schedule(paste.Path, paste.Expire, func() {
+		s.expirePaste(paste)
+	})
+}
+
+//changeExpire sets the expiration of the paste to one of ExpireAfter from now, it can be earlier than before
+func (s Server) changeExpire(ctx context.Context, p Paste, expire string) (Paste, error) {
+	dur, err := validateExpire(expire, s.cfg.ExpireAfter)
+	if err != nil {
+		return Paste{}, ErrExpireTimeNotValid
+	}
+	p.Expire = dur.after(time.Now())
+	if err := s.setExpire(ctx, p, p.Expire); err != nil {
+		return Paste{}, err
+	}
+	return p, nil
+}
+
+//expirePaste deletes an expired paste
+func (s Server) expirePaste(paste Paste) {
+	if err := s.db.Delete(context.Background(), paste.Path); err != nil {
+		s.log.Error("Cannot delete expired paste", "path", paste.Path, "error", err)
+		return
+	}
+	if paste.isRevision() {
+		return
+	}
+	metricPastesExpired.Inc()
+	s.views.delete(paste.Path)
+	s.logPaste(nil, eventPasteExpire, paste)
+}
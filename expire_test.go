@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireTimers(t *testing.T) {
+	timers := newExpireTimers()
+	fired := make(chan string, 3)
+	fire := func(path string) func() {
+		return func() { fired <- path }
+	}
+
+	timers.schedule("expire", time.Now(), fire("expire"))
+	timers.schedule("cancel", time.Now().Add(50*time.Millisecond), fire("cancel"))
+	timers.cancel("cancel")
+	timers.schedule("replace", time.Now().Add(time.Hour), fire("old"))
+	timers.schedule("replace", time.Now().Add(10*time.Millisecond), fire("replace"))
+
+	for _, expected := range []string{"expire", "replace"} {
+		select {
+		case path := <-fired:
+			if path != expected {
+				t.Errorf("Expected: %s; got: %s", expected, path)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timer not fired: %s", expected)
+		}
+	}
+
+	timers.schedule("stop", time.Now().Add(50*time.Millisecond), fire("stop"))
+	timers.stop()
+	timers.schedule("stopped", time.Now(), fire("stopped"))
+
+	select {
+	case path := <-fired:
+		t.Errorf("Timer fired after stop: %s", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestChangeExpire(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.ExpireAfter = []*pasteDuration{{time.Hour}, {50 * time.Millisecond}, {0}}
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/", handleHome)
+	s.handleRoute("/api/expire", handleAPIExpirePaste)
+
+	do := func(method, target, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+	create := func() (string, *http.Cookie) {
+		res := do(http.MethodPost, "/", url.Values{"code": {"example paste"}, "expire": {"1h0m0s"}}.Encode(), nil)
+		cookies := res.Result().Cookies()
+		if res.Code != http.StatusFound || len(cookies) != 1 {
+			t.Fatalf("Could not create paste: %d", res.Code)
+		}
+		return strings.TrimPrefix(res.Header().Get("Location"), "/"), cookies[0]
+	}
+	apiExpire := func(path, expire string) string {
+		body, _ := json.Marshal(expirePasteRequest{Name: path, ExpireTime: expire})
+		return string(body)
+	}
+	path, cookie := create()
+	_, stranger := create()
+
+	tt := []struct {
+		name   string
+		target string
+		body   string
+		cookie *http.Cookie
+		code   int
+		never  bool
+	}{
+		{"Form", "/" + path, url.Values{"expire": {"Never"}}.Encode(), cookie, http.StatusFound, true},
+		{"Form not valid", "/" + path, url.Values{"expire": {"2h0m0s"}}.Encode(), cookie, http.StatusBadRequest, true},
+		{"Form not owned", "/" + path, url.Values{"expire": {"1h0m0s"}}.Encode(), stranger, http.StatusBadRequest, true},
+		{"API", "/api/expire", apiExpire(path, "1h0m0s"), cookie, http.StatusOK, false},
+		{"API not valid", "/api/expire", apiExpire(path, "30m0s"), cookie, http.StatusBadRequest, false},
+		{"API not owned", "/api/expire", apiExpire(path, "Never"), stranger, http.StatusForbidden, false},
+		{"API not found", "/api/expire", apiExpire("missing", "Never"), cookie, http.StatusNotFound, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := do(http.MethodPost, tc.target, tc.body, tc.cookie); res.Code != tc.code {
+				t.Fatalf("Expected: %d; got: %d\n%s", tc.code, res.Code, res.Body)
+			}
+			if p, err := s.db.Get(ctx, path); err != nil || p.Expires() == tc.never {
+				t.Errorf("Expected: never expires %v; got: %v, %v", tc.never, p.Expire, err)
+			}
+		})
+	}
+
+	//Shortening the expiration replaces the timer set when the paste was created
+	if res := do(http.MethodPost, "/api/expire", apiExpire(path, "50ms"), cookie); res.Code != http.StatusOK {
+		t.Fatalf("Expected: %d; got: %d", http.StatusOK, res.Code)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := s.db.Get(ctx, path); err != ErrDatabaseNotFound {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+}
+
+func TestValidateExpireDate(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := expireDateConfig{Enabled: true, MinLifetime: pasteDuration{time.Hour}, MaxLifetime: pasteDuration{7 * 24 * time.Hour}}
+	tt := []struct {
+		name   string
+		date   string
+		cfg    expireDateConfig
+		expire time.Time
+		err    error
+	}{
+		{"Valid", "2024-05-02T12:00:00Z", cfg, now.Add(24 * time.Hour), nil},
+		{"Time zone", "2024-05-02T14:00:00+02:00", cfg, now.Add(24 * time.Hour), nil},
+		{"Not RFC 3339", "2024-05-02 12:00", cfg, time.Time{}, ErrExpireDateNotValid},
+		{"Too early", "2024-05-01T12:30:00Z", cfg, time.Time{}, ErrExpireDateOutOfRange},
+		{"Past", "2024-04-01T12:00:00Z", expireDateConfig{Enabled: true}, time.Time{}, ErrExpireDateOutOfRange},
+		{"Too late", "2024-06-01T12:00:00Z", cfg, time.Time{}, ErrExpireDateOutOfRange},
+		{"No limit", "2034-06-01T12:00:00Z", expireDateConfig{Enabled: true}, time.Date(2034, 6, 1, 12, 0, 0, 0, time.UTC), nil},
+		{"Disabled", "2024-05-02T12:00:00Z", expireDateConfig{}, time.Time{}, ErrExpireDateDisabled},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expire, err := validateExpireDate(tc.date, now, tc.cfg)
+			if !expire.Equal(tc.expire) || !errors.Is(err, tc.err) {
+				t.Errorf("Expected: %v, %v; got: %v, %v", tc.expire, tc.err, expire, err)
+			}
+		})
+	}
+}
+
+func TestFormExpire(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := defaultCfg
+	cfg.ExpireDate.Enabled = true
+	s := Server{cfg: cfg}
+	tt := []struct {
+		name   string
+		form   url.Values
+		expire time.Time
+		err    error
+	}{
+		{"Expire time", url.Values{"expire": {"30m0s"}}, now.Add(30 * time.Minute), nil},
+		{"Expire time not valid", url.Values{"expire": {"1h0m0s"}}, time.Time{}, ErrExpireTimeNotValid},
+		{"Picker", url.Values{"expire": {"30m0s"}, "expire_date": {"2024-05-02T14:00"}, "expire_offset": {"-120"}}, now.Add(24 * time.Hour), nil},
+		{"Picker in UTC", url.Values{"expire_date": {"2024-05-02T12:00"}}, now.Add(24 * time.Hour), nil},
+		{"RFC 3339", url.Values{"expire_date": {"2024-05-02T12:00:00Z"}}, now.Add(24 * time.Hour), nil},
+		{"Too late", url.Values{"expire_date": {"2025-05-02T12:00"}}, time.Time{}, ErrExpireDateOutOfRange},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expire, err := s.formExpire(tc.form, now)
+			if !expire.Equal(tc.expire) || !errors.Is(err, tc.err) {
+				t.Errorf("Expected: %v, %v; got: %v, %v", tc.expire, tc.err, expire, err)
+			}
+		})
+	}
+}
+
+func TestAPIExpireDate(t *testing.T) {
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.ExpireDate.Enabled = true
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/api/new", handleAPINewPaste)
+
+	expire := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	tt := []struct {
+		name     string
+		expireAt string
+		code     int
+	}{
+		{"Valid", expire.Format(time.RFC3339), http.StatusOK},
+		{"Not valid", expire.Format(time.RFC1123), http.StatusBadRequest},
+		{"Too late", time.Now().AddDate(1, 0, 0).Format(time.RFC3339), http.StatusBadRequest},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			body, _ := json.Marshal(newPasteRequest{Code: "example paste", ExpireTime: "Never", ExpireAt: tc.expireAt})
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/api/new", strings.NewReader(string(body))))
+			if res.Code != tc.code {
+				t.Fatalf("Expected: %d; got: %d\n%s", tc.code, res.Code, res.Body)
+			}
+			var output newPasteResponse
+			json.Unmarshal(res.Body.Bytes(), &output)
+			if !output.OK {
+				return
+			}
+			if p, err := s.db.Get(context.Background(), output.Path); err != nil || !p.Expire.Equal(expire) {
+				t.Errorf("Expected: %v; got: %v, %v", expire, p.Expire, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+)
+
+//Conflict policies used when an imported paste has the same path of an existing one
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+	ConflictFail      = "fail"
+)
+
+//Errors declaration for export and import
+var (
+	ErrImportConflict   = fmt.Errorf("Paste already exists")
+	ErrConflictNotValid = fmt.Errorf("Conflict policy not valid")
+)
+
+//exportedPaste is a line of the JSON Lines export format
+type exportedPaste struct {
+	Path       string
+	User       string
+	UserID     string `json:",omitempty"`
+	Owner      string `json:",omitempty"`
+	Visibility string `json:",omitempty"`
+	Lang       string
+	Source     string
+	Created    time.Time
+	Expire     time.Time
+	Revision   int `json:",omitempty"`
+}
+
+//parseExportFilter parses the options selecting the pastes to export or import, times are in RFC 3339
+func parseExportFilter(since, until, lang string) (ListOptions, error) {
+	filter := ListOptions{Lang: lang}
+	var err error
+	if since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+	if until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+//importResult is the outcome of an import
+type importResult struct {
+	Imported int
+	Skipped  int
+	Renamed  int
+}
+
+//exportPastes writes the pastes of db matching the filter as JSON Lines
+func exportPastes(ctx context.Context, w io.Writer, db DatabaseV2, filter ListOptions) (int, error) {
+	enc := json.NewEncoder(w)
+	exported := 0
+	err := eachPaste(ctx, db, filter, func(p Paste) error {
+		exported++
+		return enc.Encode(exportedPaste{
+			Path:       p.Path,
+			User:       p.User,
+			UserID:     p.UserID,
+			Owner:      p.Owner,
+			Visibility: p.Visibility,
+			Lang:       p.Lang,
+			Source:     p.Source,
+			Created:    p.Created,
+			Expire:     p.Expire,
+			Revision:   p.Revision,
+		})
+	})
+	return exported, err
+}
+
+//importPastes reads the pastes in the JSON Lines format and stores the ones matching the filter
+//Expired pastes are skipped, existing paths are handled with the conflict policy
+//The old revisions are skipped or renamed with their paste
+func importPastes(ctx context.Context, s Server, r io.Reader, filter ListOptions, conflict string) (importResult, error) {
+	var res importResult
+	switch conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictRename, ConflictFail:
+	default:
+		return res, ErrConflictNotValid
+	}
+
+	dec := json.NewDecoder(r)
+	now := time.Now()
+	//bases are the paths where the imported pastes and their revisions are stored, empty if they are skipped
+	bases := make(map[string]string)
+	for {
+		var e exportedPaste
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+
+		paste := Paste{
+			Path:       e.Path,
+			User:       e.User,
+			UserID:     e.UserID,
+			Owner:      e.Owner,
+			Visibility: e.Visibility,
+			Lang:       e.Lang,
+			Source:     e.Source,
+			Created:    e.Created,
+			Expire:     e.Expire,
+			Revision:   e.Revision,
+		}
+		if !filter.match(paste) || (paste.Expires() && !paste.Expire.After(now)) {
+			res.Skipped++
+			continue
+		}
+
+		//The revisions follow their paste, they can come before it
+		base, rev, ok := splitRevisionPath(paste.Path)
+		if !ok {
+			base, rev = paste.Path, 0
+		}
+		dest, seen := bases[base]
+		if !seen {
+			if dest, err = importPath(ctx, s, base, conflict, &res); err != nil {
+				return res, err
+			}
+			bases[base] = dest
+		}
+		if dest == "" {
+			res.Skipped++
+			continue
+		}
+		paste.Path = dest
+		if rev > 0 {
+			paste.Path = revisionPath(dest, rev)
+		}
+
+		//A revision can be left without its paste
+		if rev > 0 && dest == base && conflict != ConflictOverwrite {
+			_, err = s.db.Get(ctx, paste.Path)
+			if err != nil && !errors.Is(err, ErrDatabaseNotFound) {
+				return res, err
+			}
+			if err == nil && conflict == ConflictFail {
+				return res, fmt.Errorf("%w: %s", ErrImportConflict, paste.Path)
+			}
+			if err == nil {
+				res.Skipped++
+				continue
+			}
+		}
+
+		lang := paste.Lang
+		if lang == s.cfg.UndefinedLang {
+			lang = ""
+		}
+		css, code, lang := highlightCode(paste.Source, lang, s.cfg.UndefinedLang, s.cfg.HighlightStyle)
+		paste.Lang = lang
+		paste.Style = template.CSS(css)
+		paste.Content = template.HTML(code)
+
+		if err := s.db.Store(ctx, paste.Path, paste); err != nil {
+			return res, err
+		}
+		s.scheduleExpire(paste)
+		res.Imported++
+	}
+}
+
+//importPath returns the path of an imported paste, empty if it is skipped
+//The conflict policy is used if a local paste has the path
+func importPath(ctx context.Context, s Server, path, conflict string, res *importResult) (string, error) {
+	_, err := s.db.Get(ctx, path)
+	if errors.Is(err, ErrDatabaseNotFound) {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch conflict {
+	case ConflictSkip:
+		return "", nil
+	case ConflictFail:
+		return "", fmt.Errorf("%w: %s", ErrImportConflict, path)
+	case ConflictRename:
+		res.Renamed++
+		return s.createPastePath(ctx)
+	}
+	return path, nil
+}
+
+//Handle: /api/admin/export GET
+func handleAPIExport(s Server, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	filter, err := parseExportFilter(query.Get("since"), query.Get("until"), query.Get("lang"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	exported, err := exportPastes(req.Context(), w, s.db, filter)
+	if err != nil {
+		s.logger(req).Error("Cannot export pastes", "exported", exported, "error", err)
+		return
+	}
+	s.logger(req).Info("Exported pastes", "exported", exported)
+}
+
+type importResponse struct {
+	OK    bool
+	Error string
+	importResult
+}
+
+//Handle: /api/admin/import POST
+func handleAPIImport(s Server, w http.ResponseWriter, req *http.Request) {
+	var res importResponse
+	var filter ListOptions
+	var err error
+	query := req.URL.Query()
+	conflict := query.Get("conflict")
+	if conflict == "" {
+		conflict = ConflictSkip
+	}
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		res.Error = ErrMethodNotAllowed
+		goto response
+	}
+
+	filter, err = parseExportFilter(query.Get("since"), query.Get("until"), query.Get("lang"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		res.Error = err.Error()
+		goto response
+	}
+
+	res.importResult, err = importPastes(req.Context(), s, req.Body, filter, conflict)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		res.Error = err.Error()
+		s.logger(req).Error("Cannot import pastes", "imported", res.Imported, "error", err)
+		goto response
+	}
+	s.logger(req).Info("Imported pastes", "imported", res.Imported, "skipped", res.Skipped, "renamed", res.Renamed)
+	res.OK = true
+
+response:
+	result, _ := json.Marshal(res)
+
+	if _, err := w.Write(result); err != nil {
+		s.logger(req).Warn("Cannot write response", "error", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Round(0)
+	src := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+	defer src.Close()
+	for _, p := range []Paste{
+		{Path: "goPaste", User: "user", Lang: "Go", Source: "package main", Created: now.Add(-time.Hour)},
+		{Path: "pyPaste", User: "user", Lang: "Python", Source: "import os", Created: now, Expire: now.Add(time.Hour)},
+		{Path: "oldPaste", User: "user", Lang: "Go", Source: "package old", Created: now.Add(-48 * time.Hour)},
+	} {
+		src.db.Store(ctx, p.Path, p)
+	}
+
+	buf := new(bytes.Buffer)
+	filter := ListOptions{Since: now.Add(-24 * time.Hour)}
+	exported, err := exportPastes(ctx, buf, src.db, filter)
+	if err != nil {
+		t.Fatalf("Could not export: %v", err)
+	}
+	if exported != 2 || strings.Count(buf.String(), "\n") != 2 {
+		t.Fatalf("Wrong export: expected 2 lines; got: %d, %q", exported, buf.String())
+	}
+	export := buf.String()
+
+	tm := []struct {
+		name     string
+		conflict string
+		filter   ListOptions
+		result   importResult
+		fail     bool
+	}{
+		{"Skip", ConflictSkip, ListOptions{}, importResult{Imported: 1, Skipped: 1}, false},
+		{"Overwrite", ConflictOverwrite, ListOptions{}, importResult{Imported: 2}, false},
+		{"Rename", ConflictRename, ListOptions{}, importResult{Imported: 2, Renamed: 1}, false},
+		{"Fail", ConflictFail, ListOptions{}, importResult{}, true},
+		{"Filter lang", ConflictOverwrite, ListOptions{Lang: "Python"}, importResult{Imported: 1, Skipped: 1}, false},
+		{"Not valid", "merge", ListOptions{}, importResult{}, true},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+			defer dst.Close()
+			dst.db.Store(ctx, "goPaste", Paste{Path: "goPaste", Source: "existing"})
+
+			res, err := importPastes(ctx, dst, strings.NewReader(export), tt.filter, tt.conflict)
+			if tt.fail {
+				if err == nil {
+					t.Fatal("Import did not fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not import: %v", err)
+			}
+			if res != tt.result {
+				t.Errorf("Wrong result: expected: %+v; got: %+v", tt.result, res)
+			}
+
+			if tt.filter.Lang != "" {
+				return
+			}
+			paste, err := dst.db.Get(ctx, "pyPaste")
+			if err != nil {
+				t.Fatalf("Paste not imported: %v", err)
+			}
+			if paste.User != "user" || paste.Lang != "Python" || !paste.Created.Equal(now) || !paste.Expire.Equal(now.Add(time.Hour)) || paste.Content == "" {
+				t.Errorf("Wrong paste: %+v", paste)
+			}
+		})
+	}
+}
+
+func TestImportRevisions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Round(0)
+	src := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+	defer src.Close()
+	//The revision is exported before its paste
+	src.db.Store(ctx, "abc/1", Paste{Path: "abc/1", Source: "imported first", Created: now.Add(-time.Hour), Revision: 1})
+	src.db.Store(ctx, "abc", Paste{Path: "abc", Source: "imported second", Created: now, Revision: 2})
+	buf := new(bytes.Buffer)
+	if _, err := exportPastes(ctx, buf, src.db, ListOptions{}); err != nil {
+		t.Fatalf("Could not export: %v", err)
+	}
+
+	tt := []struct {
+		conflict string
+		result   importResult
+	}{
+		{ConflictSkip, importResult{Skipped: 2}},
+		{ConflictRename, importResult{Imported: 2, Renamed: 1}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.conflict, func(t *testing.T) {
+			dst := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+			defer dst.Close()
+			local := Paste{Path: "abc", Source: "local", Created: now}
+			dst.db.Store(ctx, "abc", local)
+
+			res, err := importPastes(ctx, dst, bytes.NewReader(buf.Bytes()), ListOptions{}, tc.conflict)
+			if err != nil {
+				t.Fatalf("Could not import: %v", err)
+			}
+			if res != tc.result {
+				t.Errorf("Expected: %+v; got: %+v", tc.result, res)
+			}
+			if _, err := dst.db.Get(ctx, "abc/1"); err != ErrDatabaseNotFound {
+				t.Errorf("Revision attached to the local paste, expected: %v; got: %v", ErrDatabaseNotFound, err)
+			}
+			if edited, err := dst.editPaste(ctx, local, "local edited", ""); err != nil || edited.Revision != 2 {
+				t.Errorf("Could not edit the local paste: %v", err)
+			}
+
+			if tc.conflict != ConflictRename {
+				return
+			}
+			var renamed []string
+			eachPaste(ctx, dst.db, ListOptions{}, func(p Paste) error {
+				if strings.HasPrefix(p.Source, "imported") {
+					renamed = append(renamed, p.Path)
+				}
+				return nil
+			})
+			if len(renamed) != 2 || renamed[0] != revisionPath(renamed[1], 1) {
+				t.Errorf("Expected: the revision of the renamed paste; got: %v", renamed)
+			}
+		})
+	}
+}
+
+func TestAPIExportImport(t *testing.T) {
+	src := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+	defer src.Close()
+	src.db.Store(context.Background(), "test", Paste{Path: "test", Lang: "Go", Source: "package main", Created: time.Now()})
+
+	res := httptest.NewRecorder()
+	handleAPIExport(src, res, httptest.NewRequest("GET", "/api/admin/export?lang=Go", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Wrong code: expected: %d; got: %d", http.StatusOK, res.Code)
+	}
+
+	dst := NewServer(AdaptDatabase(NewMemoryDB()), defaultCfg)
+	defer dst.Close()
+	importRes := httptest.NewRecorder()
+	handleAPIImport(dst, importRes, httptest.NewRequest("POST", "/api/admin/import?conflict=fail", res.Body))
+
+	output := importResponse{}
+	if err := json.Unmarshal(importRes.Body.Bytes(), &output); err != nil {
+		t.Fatalf("Could not decode output: %v", err)
+	}
+	if !output.OK || output.Imported != 1 {
+		t.Errorf("Wrong output: %+v", output)
+	}
+	if _, err := dst.db.Get(context.Background(), "test"); err != nil {
+		t.Errorf("Paste not imported: %v", err)
+	}
+
+	t.Run("Method not allowed", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		handleAPIImport(dst, res, httptest.NewRequest("GET", "/api/admin/import", nil))
+		if res.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Wrong code: expected: %d; got: %d", http.StatusMethodNotAllowed, res.Code)
+		}
+	})
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //Handle: /
@@ -28,7 +33,7 @@ func handleHome(s Server, w http.ResponseWriter, req *http.Request) {
 func handleNewPaste(s Server, w http.ResponseWriter, req *http.Request) {
 	t, err := getTemplate(s.cfg.AssetsDir, "new")
 	if err != nil {
-		log.Println("Cannot get template: new", err)
+		s.logger(req).Error("Cannot get template", "template", "new", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Internal server error")
 		return
@@ -40,91 +45,317 @@ func handleNewPaste(s Server, w http.ResponseWriter, req *http.Request) {
 		Header        string
 		ExpireTime    []*pasteDuration
 		ExpireTimeLen int
+		CustomPaths   bool
+		Recent        bool
+		Search        bool
+		ExpireDate    bool
+		Accounts      bool
+		Account       *Account
 	}{
 		getLanguages(),
 		s.cfg.DefaultName,
 		s.cfg.Header,
 		s.cfg.ExpireAfter,
 		len(s.cfg.ExpireAfter),
+		s.customPath != nil,
+		s.cfg.RecentPastes > 0,
+		s.search != nil,
+		s.cfg.ExpireDate.Enabled,
+		s.sessions != nil,
+		s.sessionAccount(req),
 	})
 
 	if err != nil {
-		log.Println("Error in executin template new:", err)
+		s.logger(req).Error("Cannot execute template", "template", "new", "error", err)
 	}
 }
 
 //Handle: / POST
 func handlePostPaste(s Server, w http.ResponseWriter, req *http.Request) {
 	if err := req.ParseForm(); err != nil {
-		log.Println("Cannot parse form", err)
+		s.logger(req).Error("Cannot parse form", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, "Internal Server Error")
 	}
+	account := s.sessionAccount(req)
+	if account == nil && !s.anonymousAllowed() {
+		http.Redirect(w, req, "/login", http.StatusFound)
+		return
+	}
 	name := req.PostForm.Get("name")
 	code := req.PostForm.Get("code")
 	lang := req.PostForm.Get("lang")
-	expireTimeS := req.PostForm.Get("expire")
+	path := req.PostForm.Get("path")
+	visibility := req.PostForm.Get("visibility")
 
-	expireTime, err := validateExpire(expireTimeS, s.cfg.ExpireAfter)
+	expire, err := s.formExpire(req.PostForm, time.Now())
 	if err != nil {
-		handleError(w, req, s.cfg.AssetsDir, err)
+		metricPastesRejected.WithLabelValues(rejectReason(err)).Inc()
+		handleError(s, w, req, err)
 		return
 	}
 
-	path, err := NewPaste(&s, name, code, lang, expireTime)
+	var owner string
+	if account == nil {
+		token, err := setOwnerToken(w, req)
+		if err != nil {
+			s.logger(req).Error("Cannot create owner token", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Internal Server Error")
+			return
+		}
+		owner = hashToken(token)
+	}
+
+	paste, err := NewPaste(req.Context(), &s, account, owner, name, path, code, lang, visibility, expire)
+	if errors.Is(err, ErrPathUsed) {
+		handleErrorStatus(s, w, req, http.StatusConflict, err)
+		return
+	}
+	if errors.Is(err, ErrEmptyPaste) || errors.Is(err, ErrPasteTooBig) ||
+		errors.Is(err, ErrPathNotValid) || errors.Is(err, ErrPathReserved) || errors.Is(err, ErrPathDisabled) ||
+		errors.Is(err, ErrVisibilityNotValid) || errors.Is(err, ErrPrivateNeedsOwner) {
+		handleError(s, w, req, err)
+		return
+	}
 	if err != nil {
-		handleError(w, req, s.cfg.AssetsDir, err)
+		handleDatabaseError(s, w, req, path, err)
 		return
 	}
+	s.logPaste(req, eventPasteCreate, paste)
 
-	http.Redirect(w, req, path, http.StatusFound)
+	http.Redirect(w, req, paste.Path, http.StatusFound)
 }
 
-//Handle: /PASTE
+//expireDateLocal is the format of the dates sent by the datetime-local inputs
+const expireDateLocal = "2006-01-02T15:04"
+
+//formExpire returns when the paste created with the form expires, an expire_date replaces the expire time
+//The expire_date of the picker is in the time zone of the browser, expire_offset is its difference from UTC in minutes
+func (s Server) formExpire(form url.Values, now time.Time) (time.Time, error) {
+	date := form.Get("expire_date")
+	if date == "" {
+		expireTime, err := validateExpire(form.Get("expire"), s.cfg.ExpireAfter)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return expireTime.after(now), nil
+	}
+
+	offset, _ := strconv.Atoi(form.Get("expire_offset"))
+	if local, err := time.ParseInLocation(expireDateLocal, date, time.FixedZone("", -offset*60)); err == nil {
+		date = local.Format(time.RFC3339)
+	}
+	return validateExpireDate(date, now, s.cfg.ExpireDate)
+}
+
+//revisionLink is a revision in the history of the paste page
+type revisionLink struct {
+	Number           int
+	Path             string
+	User             string
+	CreatedFormatted string
+}
+
+//Handle: /PASTE, /PASTE/REV
+//Transfer to: /PASTE POST
 func handleGetPaste(s Server, w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		handleEditPaste(s, w, req)
+		return
+	}
+
 	t, err := getTemplate(s.cfg.AssetsDir, "paste")
 	if err != nil {
-		log.Println("Cannot get template: paste", err)
+		s.logger(req).Error("Cannot get template", "template", "paste", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Internal server error")
 		return
 	}
-	paste, err := s.db.Get(req.URL.Path[1:])
-	if err == ErrDatabaseNotFound {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Could not find paste: %s", req.URL.Path)
-		return
+	paste, err := getRevision(req.Context(), req.URL.Path[1:], s.db.Get)
+	if err == nil && !s.canView(req, paste) {
+		err = ErrDatabaseNotFound
+	}
+	var revisions []Paste
+	latest := paste
+	if err == nil {
+		if paste.isRevision() {
+			path, _, _ := splitRevisionPath(paste.Path)
+			latest, err = s.db.Get(req.Context(), path)
+		}
+		if err == nil {
+			revisions, err = s.history(req.Context(), latest)
+		}
 	}
-
 	if err != nil {
-		log.Println("Cannot get from Database", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Internal server error")
+		handleDatabaseError(s, w, req, req.URL.Path, err)
 		return
 	}
+	metricPastesRead.Inc()
+	//The views of the revisions are counted as views of the paste
+	s.views.add(latest.Path)
+	s.logPaste(req, eventPasteView, paste)
+
+	history := make([]revisionLink, len(revisions))
+	var diff []diffLine
+	for i, rev := range revisions {
+		history[i] = revisionLink{
+			Number:           rev.revision(),
+			Path:             revisionPath(latest.Path, rev.revision()),
+			User:             rev.User,
+			CreatedFormatted: rev.Created.Format(s.cfg.TimeFormat),
+		}
+		//The changes made by the revision shown
+		if i > 0 && rev.revision() == paste.revision() {
+			diff = diffLines(revisions[i-1].Source, rev.Source)
+		}
+	}
+	expireFormatted := PasteNeverExpire
+	if paste.Expires() {
+		expireFormatted = paste.Expire.Format(s.cfg.TimeFormat)
+	}
 
 	if err := t.Execute(w, struct {
 		Paste
 		CreatedFormatted string
+		ExpireFormatted  string
+		Number           int
+		History          []revisionLink
+		Diff             []diffLine
+		//Editable is set when the owner sees the latest revision
+		Editable   bool
+		Langs      []string
+		ExpireTime []*pasteDuration
 	}{
 		paste,
 		paste.Created.Format(s.cfg.TimeFormat),
+		expireFormatted,
+		paste.revision(),
+		history,
+		diff,
+		!paste.isRevision() && s.requestOwns(req, paste),
+		getLanguages(),
+		s.cfg.ExpireAfter,
 	}); err != nil {
-		log.Println("Cannot execute template:", err)
+		s.logger(req).Error("Cannot execute template", "template", "paste", "error", err)
+	}
+}
+
+//Handle: /PASTE POST
+//The owner replaces the source with a new revision or changes the expiration with the expire field
+func handleEditPaste(s Server, w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		handleError(s, w, req, err)
+		return
+	}
+	path := req.URL.Path[1:]
+	if strings.Contains(path, "/") {
+		handleError(s, w, req, ErrRevisionNotEditable)
+		return
+	}
+	paste, err := s.db.Get(req.Context(), path)
+	if err == nil && !s.canView(req, paste) {
+		err = ErrDatabaseNotFound
 	}
+	if err != nil {
+		handleDatabaseError(s, w, req, req.URL.Path, err)
+		return
+	}
+	if !s.requestOwns(req, paste) {
+		handleError(s, w, req, ErrPasteNotOwned)
+		return
+	}
+
+	event := eventPasteEdit
+	if _, ok := req.PostForm["expire"]; ok {
+		event = eventPasteExpireChange
+		paste, err = s.changeExpire(req.Context(), paste, req.PostForm.Get("expire"))
+	} else {
+		paste, err = s.editPaste(req.Context(), paste, req.PostForm.Get("code"), req.PostForm.Get("lang"))
+	}
+	if errors.Is(err, ErrEmptyPaste) || errors.Is(err, ErrPasteTooBig) || errors.Is(err, ErrExpireTimeNotValid) {
+		handleError(s, w, req, err)
+		return
+	}
+	if err != nil {
+		handleDatabaseError(s, w, req, req.URL.Path, err)
+		return
+	}
+	s.logPaste(req, event, paste)
+	http.Redirect(w, req, "/"+paste.Path, http.StatusFound)
+}
+
+//Handle: /raw/PASTE, /raw/PASTE/REV
+func handleRawPaste(s Server, w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/raw/")
+
+	var paste Paste
+	var err error
+	edb, encoded := s.db.(encodedDatabase)
+	if encoded {
+		paste, err = getRevision(req.Context(), name, edb.GetEncoded)
+	} else {
+		paste, err = getRevision(req.Context(), name, s.db.Get)
+	}
+	if err == nil && !s.canView(req, paste) {
+		err = ErrDatabaseNotFound
+	}
+
+	if err != nil {
+		handleDatabaseError(s, w, req, name, err)
+		return
+	}
+
+	metricPastesRead.Inc()
+	s.views.add(paste.Path)
+	s.logPaste(req, eventPasteView, paste)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	//Send the compressed paste as it is if the client supports it
+	if paste.Encoding != "" && acceptsEncoding(req, paste.Encoding) {
+		w.Header().Set("Content-Encoding", paste.Encoding)
+	} else if paste, err = decodePaste(paste); err != nil {
+		s.logger(req).Error("Cannot decode paste", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+
+	if _, err := io.WriteString(w, paste.Source); err != nil {
+		s.logger(req).Warn("Cannot write response", "error", err)
+	}
+}
+
+//handleDatabaseError writes the response for an error returned by the database
+func handleDatabaseError(s Server, w http.ResponseWriter, req *http.Request, name string, err error) {
+	status := databaseErrorStatus(err)
+	w.WriteHeader(status)
+	if status == http.StatusNotFound {
+		fmt.Fprintf(w, "Could not find paste: %s", name)
+		return
+	}
+
+	s.logger(req).Error("Cannot get from Database", "error", err)
+	fmt.Fprint(w, http.StatusText(status))
+}
+
+func handleError(s Server, w http.ResponseWriter, req *http.Request, err error) {
+	handleErrorStatus(s, w, req, http.StatusBadRequest, err)
 }
 
-func handleError(w http.ResponseWriter, req *http.Request, assetsDir string, err error) {
-	w.WriteHeader(http.StatusBadRequest)
-	t, tErr := getTemplate(assetsDir, "error")
+//handleErrorStatus shows the error to the user with the status
+func handleErrorStatus(s Server, w http.ResponseWriter, req *http.Request, status int, err error) {
+	w.WriteHeader(status)
+	t, tErr := getTemplate(s.cfg.AssetsDir, "error")
 
 	//Cannot get template
 	if tErr != nil {
-		log.Printf("Cannot get template while handling error:\nTemplate Error: %v\nError: %v\n", tErr, err)
+		s.logger(req).Error("Cannot get template while handling error", "template", "error", "template_error", tErr, "error", err)
 		fmt.Fprintf(w, "Error: %v", err)
 		return
 	}
 
-	log.Println(err)
+	s.logger(req).Info("Bad request", "error", err)
 	t.Execute(w, err)
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+//Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+//Paste events
+const (
+	eventPasteCreate       = "paste created"
+	eventPasteView         = "paste viewed"
+	eventPasteDelete       = "paste deleted"
+	eventPasteExpire       = "paste expired"
+	eventPasteEdit         = "paste edited"
+	eventPasteExpireChange = "paste expiration changed"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+//logWriter writes to the output of the standard logger
+//The output is resolved on every write so log.SetOutput is honored
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+//newLogger creates the structured logger described by the config
+func newLogger(cfg config) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	if cfg.LogFormat == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(logWriter{}, opts))
+	}
+	return slog.New(slog.NewTextHandler(logWriter{}, opts))
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+//requestID returns the ID assigned to the request
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
+
+//logger returns the logger for the request
+func (s Server) logger(req *http.Request) *slog.Logger {
+	return s.log.With("request_id", requestID(req))
+}
+
+//logPaste logs an event regarding a paste, req is nil if the event is not caused by a request
+func (s Server) logPaste(req *http.Request, event string, paste Paste) {
+	logger := s.log
+	attrs := []interface{}{"path", paste.Path, "size", len(paste.Source), "lang", paste.Lang}
+	if req != nil {
+		logger = s.logger(req)
+		attrs = append(attrs, "ip", clientIP(req, s.cfg.AnonymizeIP))
+	}
+	logger.Info(event, attrs...)
+}
+
+//clientIP returns the IP of the client
+//If anonymize is set the host part of the address is removed
+func clientIP(req *http.Request, anonymize bool) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !anonymize {
+		return host
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+//statusRecorder records the status and the size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.size += n
+	return n, err
+}
+
+//Unwrap returns the wrapped http.ResponseWriter, it is used by http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+//serveLogged assigns an ID to the request and logs it after it has been served
+func (s Server) serveLogged(h http.Handler, w http.ResponseWriter, req *http.Request) {
+	id := newRequestID()
+	w.Header().Set("X-Request-ID", id)
+	req = req.WithContext(context.WithValue(req.Context(), requestIDKey, id))
+
+	if !s.cfg.AccessLog {
+		h.ServeHTTP(w, req)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	h.ServeHTTP(rec, req)
+
+	s.logger(req).Info("request",
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", rec.status,
+		"size", rec.size,
+		"duration", time.Since(start),
+		"ip", clientIP(req, s.cfg.AnonymizeIP),
+		"user_agent", req.UserAgent(),
+	)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tm := []struct {
+		name       string
+		remoteAddr string
+		anonymize  bool
+		ip         string
+	}{
+		{"IPv4", "192.168.1.42:1234", false, "192.168.1.42"},
+		{"IPv4 anonymized", "192.168.1.42:1234", true, "192.168.1.0"},
+		{"IPv6", "[2001:db8:1:2::42]:1234", false, "2001:db8:1:2::42"},
+		{"IPv6 anonymized", "[2001:db8:1:2::42]:1234", true, "2001:db8:1::"},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if ip := clientIP(req, tt.anonymize); ip != tt.ip {
+				t.Errorf("Expected: %s; got: %s", tt.ip, ip)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := defaultCfg
+	cfg.LogFormat = LogFormatJSON
+	cfg.AccessLog = true
+	server := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+
+	var routeID string
+	server.handleRoute("/test", func(s Server, w http.ResponseWriter, req *http.Request) {
+		routeID = requestID(req)
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest("GET", "/test", nil))
+
+	if routeID == "" || res.Header().Get("X-Request-ID") != routeID {
+		t.Errorf("Request ID not propagated: header: %q; route: %q", res.Header().Get("X-Request-ID"), routeID)
+	}
+
+	entry := struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+		Status    int    `json:"status"`
+		Path      string `json:"path"`
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Could not decode log entry %q: %v", buf.String(), err)
+	}
+
+	if entry.Msg != "request" || entry.RequestID != routeID || entry.Status != http.StatusTeapot || entry.Path != "/test" {
+		t.Errorf("Wrong log entry: %+v", entry)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
-	"log"
-	"math/rand"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gobuffalo/packr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //Default Config
@@ -22,6 +29,87 @@ var defaultCfg = config{
 	AssetsDir:      "assets/",
 	ExpireAfter:    []*pasteDuration{&pasteDuration{30 * time.Minute}},
 	MaxPasteSize:   15000, //15KB
+	RecentPastes:   20,
+	Search:         true,
+
+	ExpireDate: expireDateConfig{
+		Enabled:     false,
+		MinLifetime: pasteDuration{time.Minute},
+		MaxLifetime: pasteDuration{30 * 24 * time.Hour},
+	},
+
+	Paths: pathsConfig{
+		Generator: PathsRandom,
+		WordList:  "",
+		GrowAfter: 3,
+	},
+	CustomPaths: customPathsConfig{
+		Pattern:  "[a-zA-Z0-9][a-zA-Z0-9_-]{2,63}",
+		Reserved: []string{"favicon.ico", "robots.txt"},
+	},
+
+	Compression:          "",
+	CompressionThreshold: 1000, //1KB
+
+	AdminAddr: "",
+
+	LogFormat:   LogFormatText,
+	LogLevel:    "info",
+	AccessLog:   true,
+	AnonymizeIP: false,
+
+	ShutdownTimeout: pasteDuration{30 * time.Second},
+
+	Database: databaseConfig{
+		Type:             DatabaseMemory,
+		SnapshotPath:     "",
+		SnapshotInterval: pasteDuration{5 * time.Minute},
+		Path:             "yep.db",
+		SweepInterval:    pasteDuration{time.Minute},
+		URL:              "redis://localhost:6379/0",
+		Prefix:           "yep:",
+		Endpoint:         "https://s3.amazonaws.com",
+		Region:           "",
+		Bucket:           "yep",
+		AccessKey:        "",
+		SecretKey:        "",
+		Lifecycle:        true,
+	},
+
+	Cluster: clusterConfig{
+		Self:     "",
+		Nodes:    nil,
+		Join:     "",
+		Secret:   "",
+		Replicas: 100,
+	},
+
+	Replication: replicationConfig{
+		Secret:  "",
+		Primary: "",
+		LogSize: 10000,
+	},
+
+	Accounts: accountsConfig{
+		Enabled:        false,
+		Path:           "users.json",
+		Registration:   true,
+		Anonymous:      true,
+		SessionTimeout: pasteDuration{7 * 24 * time.Hour},
+	},
+
+	OIDC: oidcConfig{
+		Issuer:         "",
+		ClientID:       "",
+		ClientSecret:   "",
+		RedirectURL:    "",
+		Scopes:         []string{"openid", "profile", "email"},
+		Required:       false,
+		AllowedDomains: nil,
+		AllowedGroups:  nil,
+		GroupsClaim:    "groups",
+		NameClaim:      "name",
+	},
 }
 
 const (
@@ -32,26 +120,141 @@ const (
 var assets packr.Box
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
 	cfg := defaultCfg
-	if err := readConfig(configPath, &cfg); err == nil {
-		log.Println("Loaded config from:", configPath)
-	} else if err == ErrNoConfigFound {
-		log.Println("Not loading config file")
+	cfgErr := readConfig(configPath, &cfg)
+
+	logger := newLogger(cfg)
+	if cfgErr == nil {
+		logger.Info("Loaded config", "path", configPath)
+	} else if cfgErr == ErrNoConfigFound {
+		logger.Info("Not loading config file")
 	} else {
-		log.Println("Error during loading config:", err)
+		logger.Error("Error during loading config", "path", configPath, "error", cfgErr)
 	}
 
-	log.SetPrefix("[YEP] ")
-	log.SetFlags(log.Flags() | log.Lshortfile)
 	assets = packr.NewBox(compileAssets)
 
-	srv := NewServer(&MemoryDB{}, cfg)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:], cfg, logger))
+	}
+	os.Exit(serve(cfg, logger))
+}
 
-	srv.handleRoute("/", handleHome)
-	srv.handleRoute("/api/new", handleAPINewPaste)
-	srv.handleRoute("/api/get", handleAPIGetPaste)
+//openServer creates the server described by the config
+//If persist is false the database is opened only for reading the pastes
+func openServer(cfg config, logger *slog.Logger, persist bool) (Server, error) {
+	db, loaded, err := openDatabase(cfg, cfg.Database, logger, persist)
+	if err != nil {
+		return Server{}, err
+	}
+
+	if cfg.MigrateFrom != nil {
+		old, oldLoaded, err := openDatabase(cfg, *cfg.MigrateFrom, logger, persist)
+		if err != nil {
+			db.Close()
+			return Server{}, fmt.Errorf("Cannot open the database to migrate from: %v", err)
+		}
+		logger.Info("Migration mode, writing to both databases")
+		db = newDualDB(old, db)
+		loaded = append(loaded, oldLoaded...)
+	}
 
+	//The index is kept by every node of the cluster for its own pastes
+	//It is kept in memory, so it would miss the pastes stored by the other instances sharing the database
+	if cfg.Search && persist && (cfg.Database.shared() || (cfg.MigrateFrom != nil && cfg.MigrateFrom.shared())) {
+		logger.Warn("Search disabled, the database is shared with other instances", "type", cfg.Database.Type)
+	} else if cfg.Search && persist {
+		sdb, err := newSearchDB(context.Background(), db)
+		if err != nil {
+			db.Close()
+			return Server{}, fmt.Errorf("Cannot build the search index: %v", err)
+		}
+		db = sdb
+	}
+
+	if cfg.Cluster.Self != "" {
+		cdb, err := newClusterDB(db, cfg.Cluster, logger)
+		if err != nil {
+			db.Close()
+			return Server{}, err
+		}
+		logger.Info("Cluster mode", "self", cfg.Cluster.Self, "nodes", len(cdb.Nodes()))
+		db = cdb
+	}
+
+	if cfg.Replication.Secret != "" {
+		rdb := newReplicaDB(db, cfg.Replication, logger)
+		if cfg.Replication.Primary != "" {
+			logger.Info("Replication mode, following the primary", "primary", cfg.Replication.Primary)
+		}
+		db = rdb
+	}
+
+	srv := NewServer(db, cfg)
+	if cfg.Accounts.Enabled {
+		accounts, err := openAccountStore(cfg.Accounts.Path)
+		if err != nil {
+			db.Close()
+			return Server{}, err
+		}
+		srv.accounts = accounts
+		srv.sessions = newSessionStore(cfg.Accounts.SessionTimeout.Duration)
+	}
+	for _, p := range loaded {
+		srv.scheduleExpire(p)
+	}
+	return srv, nil
+}
+
+//serve runs the server until it is stopped by a signal, it returns the exit code
+func serve(cfg config, logger *slog.Logger) int {
+	srv, err := openServer(cfg, logger, true)
+	if err != nil {
+		logger.Error("Cannot create server", "error", err)
+		return 1
+	}
+	if cfg.OIDC.Issuer != "" {
+		if srv.oidc, err = newOIDCLogin(context.Background(), cfg.OIDC); err != nil {
+			logger.Error("Cannot set up OpenID Connect", "issuer", cfg.OIDC.Issuer, "error", err)
+			srv.Close()
+			return 1
+		}
+		if srv.sessions == nil {
+			srv.sessions = newSessionStore(cfg.Accounts.SessionTimeout.Duration)
+		}
+	}
+
+	srv.handleRoute("/", requireLogin(handleHome))
+	srv.handleRoute("/api/new", requireLogin(handleAPINewPaste))
+	srv.handleRoute("/api/get", requireLogin(handleAPIGetPaste))
+	srv.handleRoute("/api/expire", requireLogin(handleAPIExpirePaste))
+	srv.handleRoute("/raw/", requireLogin(handleRawPaste))
+	srv.handleRoute("/mine", requireLogin(handleMyPastes))
+	if cfg.RecentPastes > 0 {
+		srv.handleRoute("/recent", requireLogin(handleRecent))
+		srv.handleRoute("/recent/", requireLogin(handleRecent))
+	}
+	if srv.search != nil {
+		srv.handleRoute("/search", requireLogin(handleSearch))
+		srv.handleRoute("/api/v1/search", requireLogin(handleAPISearch))
+	}
+	if srv.cluster != nil {
+		srv.handleClusterRoutes()
+	}
+	if srv.replica != nil {
+		srv.handleReplicationRoutes()
+	}
+	if srv.accounts != nil {
+		srv.handleAccountRoutes()
+	}
+	if srv.oidc != nil {
+		srv.handleOIDCRoutes()
+	}
+	if srv.sessions != nil {
+		srv.handleRoute("/logout", handleLogout)
+	}
+
+	srv.routes.add("/static/")
 	for _, filename := range assets.List() {
 		//Do not return templates
 		if strings.HasSuffix(filename, ".tmpl") {
@@ -60,6 +263,92 @@ func main() {
 		srv.mux.HandleFunc("/static/"+filename, routeToHandler(handlePackrFile(filename), &srv))
 	}
 
-	log.Println("Listening on", cfg.Addr)
-	http.ListenAndServe(cfg.Addr, srv)
+	prometheus.MustRegister(newDatabaseCollector(srv.db))
+
+	errs := make(chan error, 2)
+	servers := []*http.Server{{Addr: cfg.Addr, Handler: srv}}
+	if cfg.AdminAddr == "" {
+		srv.routes.add("/metrics")
+		srv.mux.Handle("/metrics", promhttp.Handler())
+	} else {
+		//The admin APIs are available only on a separate address
+		srv.admin.Handle("/metrics", promhttp.Handler())
+		srv.handleAdminRoute("/api/admin/export", handleAPIExport)
+		srv.handleAdminRoute("/api/admin/import", handleAPIImport)
+		servers = append(servers, &http.Server{Addr: cfg.AdminAddr, Handler: srv.AdminHandler()})
+	}
+	if srv.replica != nil {
+		//The streams to the followers never end by themselves
+		servers[0].RegisterOnShutdown(srv.replica.stopStreams)
+	}
+
+	for _, s := range servers {
+		//Listen before serving so the nodes of the cluster can reach this one after joining
+		ln, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			logger.Error("Cannot listen", "addr", s.Addr, "error", err)
+			srv.Close()
+			return 1
+		}
+		go func(s *http.Server, ln net.Listener) {
+			logger.Info("Listening", "addr", s.Addr)
+			errs <- s.Serve(ln)
+		}(s, ln)
+	}
+
+	if srv.cluster != nil && cfg.Cluster.Join != "" {
+		go func() {
+			if err := srv.cluster.join(context.Background(), cfg.Cluster.Join); err != nil {
+				logger.Error("Cannot join the cluster", "node", cfg.Cluster.Join, "error", err)
+				return
+			}
+			logger.Info("Joined the cluster", "node", cfg.Cluster.Join)
+		}()
+	}
+
+	if srv.replica != nil {
+		srv.replica.startFollowing()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	exitCode := 0
+	select {
+	case sig := <-stop:
+		logger.Info("Shutting down", "signal", sig.String())
+	case err := <-errs:
+		logger.Error("Server stopped", "error", err)
+		exitCode = 1
+	}
+
+	if err := shutdown(servers, srv, cfg.ShutdownTimeout.Duration); err != nil {
+		logger.Error("Cannot shutdown cleanly", "error", err)
+		exitCode = 1
+	}
+	return exitCode
+}
+
+//shutdown stops accepting new connections, waits for the requests in flight and closes the server
+//If timeout is not zero the requests still running after it are cancelled
+func shutdown(servers []*http.Server, srv Server, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var shutdownErr error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			s.Close()
+			shutdownErr = err
+		}
+	}
+
+	if err := srv.Close(); err != nil {
+		return err
+	}
+	return shutdownErr
 }
@@ -1,17 +1,42 @@
 package main
 
 import (
-	"log"
-	"math/rand"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
 )
 
 //MemoryDB is a memory stored Database
-//It has no persistence
-type MemoryDB map[string]Paste
+//It has no persistence unless snapshots are enabled
+type MemoryDB struct {
+	mu     sync.RWMutex
+	pastes map[string]Paste
+	//reserved are the paths reserved by ReservePath with the time the reservation ends
+	reserved map[string]time.Time
+	//sorted are the paths of all the pastes in the order of List
+	sorted sortedPastes
+	//indexes are the paths of the pastes in every secondary index, in the order of List
+	indexes map[string]sortedPastes
+
+	snapshots *snapshotter
+}
+
+//NewMemoryDB creates an empty MemoryDB
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		pastes:   make(map[string]Paste),
+		reserved: make(map[string]time.Time),
+		indexes:  make(map[string]sortedPastes),
+	}
+}
 
 //Get implements Database
-func (db MemoryDB) Get(name string) (Paste, error) {
-	v, ok := db[name]
+func (db *MemoryDB) Get(name string) (Paste, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.pastes[name]
 	if !ok {
 		return Paste{}, ErrDatabaseNotFound
 	}
@@ -19,34 +44,167 @@ func (db MemoryDB) Get(name string) (Paste, error) {
 }
 
 //Store implements Database
-func (db MemoryDB) Store(name string, value Paste) error {
-	db[name] = value
+func (db *MemoryDB) Store(name string, value Paste) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.unindex(name)
+	db.pastes[name] = value
+	delete(db.reserved, name)
+	key := sortKey(name, value)
+	db.sorted = db.sorted.insert(key)
+	for _, index := range pasteIndexes(value) {
+		db.indexes[index] = db.indexes[index].insert(key)
+	}
 	return nil
 }
 
+//unindex removes the paste from the sorted paths and the secondary indexes, the lock must be held
+func (db *MemoryDB) unindex(name string) {
+	old, ok := db.pastes[name]
+	if !ok {
+		return
+	}
+	key := sortKey(name, old)
+	db.sorted = db.sorted.remove(key)
+	for _, index := range pasteIndexes(old) {
+		db.indexes[index] = db.indexes[index].remove(key)
+		if len(db.indexes[index]) == 0 {
+			delete(db.indexes, index)
+		}
+	}
+}
+
+//sortedPastes are pastes sorted by creation time and path, only Path and Created are set
+type sortedPastes []Paste
+
+//sortKey returns the paste as kept in sortedPastes
+//The monotonic clock is removed so the pastes are compared like the cursors
+func sortKey(name string, p Paste) Paste {
+	return Paste{Path: name, Created: p.Created.Round(0)}
+}
+
+//search returns the position of the first paste not before p
+func (s sortedPastes) search(p Paste) int {
+	return sort.Search(len(s), func(i int) bool { return !pasteBefore(s[i], p) })
+}
+
+func (s sortedPastes) insert(p Paste) sortedPastes {
+	i := s.search(p)
+	s = append(s, Paste{})
+	copy(s[i+1:], s[i:])
+	s[i] = p
+	return s
+}
+
+func (s sortedPastes) remove(p Paste) sortedPastes {
+	i := s.search(p)
+	if i < len(s) && s[i].Path == p.Path {
+		s = append(s[:i], s[i+1:]...)
+	}
+	return s
+}
+
 //Delete implements Database
-func (db MemoryDB) Delete(name string) {
-	delete(db, name)
+func (db *MemoryDB) Delete(name string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.unindex(name)
+	delete(db.pastes, name)
 }
 
-const alphabeth = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+//ReservePath reserves the path if it is not used by a paste or by another reservation
+func (db *MemoryDB) ReservePath(path string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-//CreatePastePath implements Database
-func (db MemoryDB) CreatePastePath(length int) string {
-	var sPath string
+	now := time.Now()
+	if p, ok := db.pastes[path]; ok && !(p.Expires() && !p.Expire.After(now)) {
+		return false
+	}
+	if end, ok := db.reserved[path]; ok && end.After(now) {
+		return false
+	}
+	db.reserved[path] = now.Add(pathReserveTime)
+	return true
+}
 
-	for {
-		path := make([]rune, length)
-		for i := range path {
-			n := rand.Intn(len(alphabeth))
-			path[i] = rune(alphabeth[n])
+//List implements Database
+//The pastes are read from the sorted paths starting at the cursor
+func (db *MemoryDB) List(opts ListOptions) ([]Paste, string, error) {
+	var after Paste
+	if opts.Cursor != "" {
+		created, path, err := parseListCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
 		}
-		sPath = string(path)
-		if _, ok := db[sPath]; !ok {
-			break
+		after = Paste{Path: path, Created: created}
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	sorted := db.sorted
+	if index := opts.index(); index != "" {
+		sorted = db.indexes[index]
+	}
+
+	var page []Paste
+	//One more paste tells if there is a next page
+	add := func(i int) bool {
+		if p := db.pastes[sorted[i].Path]; opts.match(p) {
+			page = append(page, p)
 		}
-		log.Println("Found collision:", sPath)
+		return opts.Limit == 0 || len(page) <= opts.Limit
 	}
+	if opts.Reverse {
+		i := len(sorted) - 1
+		if opts.Cursor != "" {
+			i = sorted.search(after) - 1
+		}
+		for ; i >= 0 && add(i); i-- {
+		}
+	} else {
+		i := 0
+		if opts.Cursor != "" {
+			i = sorted.search(after)
+			if i < len(sorted) && !pasteBefore(after, sorted[i]) {
+				i++
+			}
+		}
+		for ; i < len(sorted) && add(i); i++ {
+		}
+	}
+
+	if opts.Limit == 0 || len(page) <= opts.Limit {
+		return page, "", nil
+	}
+	page = page[:opts.Limit]
+	return page, listCursor(page[len(page)-1]), nil
+}
+
+//Stats implements Database
+func (db *MemoryDB) Stats() (DatabaseStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	return sPath
+	stats := DatabaseStats{Count: len(db.pastes)}
+	for _, p := range db.pastes {
+		stats.Size += int64(pasteSize(p))
+	}
+	return stats, nil
+}
+
+//EnableSnapshots saves a snapshot of the database to path every interval and when the database is closed
+//If interval is zero the snapshot is saved only when the database is closed
+func (db *MemoryDB) EnableSnapshots(path string, interval time.Duration, logger *slog.Logger) {
+	db.snapshots = newSnapshotter(db, path, interval, logger)
+}
+
+//Close implements Database
+func (db *MemoryDB) Close() error {
+	if db.snapshots == nil {
+		return nil
+	}
+	return db.snapshots.close()
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryDBList(t *testing.T) {
+	db := NewMemoryDB()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		lang := "Go"
+		if i%2 == 1 {
+			lang = "Python"
+		}
+		path := "paste" + strconv.Itoa(i)
+		p := Paste{Path: path, User: "user", Lang: lang, Source: "code", Created: start.Add(time.Duration(i) * time.Minute)}
+		if i%3 == 0 {
+			p.Owner = "owner"
+		}
+		if i == 4 {
+			p.UserID = "id"
+		}
+		if i%4 == 0 {
+			p.Visibility = VisibilityPublic
+		}
+		db.Store(path, p)
+	}
+	//Storing again updates the indexes
+	db.Store("paste9", Paste{Path: "paste9", User: "user", Lang: "Python", Source: "code", Created: start.Add(9 * time.Minute)})
+
+	tm := []struct {
+		name  string
+		opts  ListOptions
+		paths []string
+	}{
+		{"All", ListOptions{Limit: 3}, []string{"paste0", "paste1", "paste2", "paste3", "paste4", "paste5", "paste6", "paste7", "paste8", "paste9"}},
+		{"Lang", ListOptions{Limit: 2, Lang: "Python"}, []string{"paste1", "paste3", "paste5", "paste7", "paste9"}},
+		{"Created", ListOptions{Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute)}, []string{"paste2", "paste3", "paste4"}},
+		{"User", ListOptions{User: "other"}, nil},
+		{"Owner", ListOptions{Limit: 2, Owner: "owner"}, []string{"paste0", "paste3", "paste6"}},
+		{"UserID", ListOptions{UserID: "id"}, []string{"paste4"}},
+		{"Owner and lang", ListOptions{Owner: "owner", Lang: "Python"}, []string{"paste3"}},
+		{"Public", ListOptions{Visibility: VisibilityPublic}, []string{"paste0", "paste4", "paste8"}},
+		{"Unlisted", ListOptions{Visibility: VisibilityUnlisted, Lang: "Go"}, []string{"paste2", "paste6"}},
+		{"Reverse", ListOptions{Limit: 2, Lang: "Go", Reverse: true}, []string{"paste8", "paste6", "paste4", "paste2", "paste0"}},
+		{"Reverse created", ListOptions{Limit: 2, Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute), Reverse: true}, []string{"paste4", "paste3", "paste2"}},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			opts := tt.opts
+			for {
+				pastes, cursor, err := db.List(opts)
+				if err != nil {
+					t.Fatalf("Could not list: %v", err)
+				}
+				if opts.Limit != 0 && len(pastes) > opts.Limit {
+					t.Fatalf("Limit not respected: %d", len(pastes))
+				}
+				for _, p := range pastes {
+					paths = append(paths, p.Path)
+				}
+				if cursor == "" {
+					break
+				}
+				opts.Cursor = cursor
+			}
+
+			if len(paths) != len(tt.paths) {
+				t.Fatalf("Wrong pastes: expected: %v; got: %v", tt.paths, paths)
+			}
+			for i := range paths {
+				if paths[i] != tt.paths[i] {
+					t.Fatalf("Wrong pastes: expected: %v; got: %v", tt.paths, paths)
+				}
+			}
+		})
+	}
+
+	t.Run("Cursor not valid", func(t *testing.T) {
+		if _, _, err := db.List(ListOptions{Cursor: "!"}); err != ErrCursorNotValid {
+			t.Errorf("Expected: %v; got: %v", ErrCursorNotValid, err)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatalf("Could not get stats: %v", err)
+		}
+		if stats.Count != 10 || stats.Size != 40 {
+			t.Errorf("Wrong stats: %+v", stats)
+		}
+	})
+}
+
+func TestMemoryDBListUpdates(t *testing.T) {
+	db := NewMemoryDB()
+	start := time.Now()
+	for i, path := range []string{"a", "b", "c"} {
+		db.Store(path, Paste{Path: path, Created: start.Add(time.Duration(i) * time.Minute)})
+	}
+	//The pastes stored again and the deleted ones move in the order
+	db.Store("a", Paste{Path: "a", Created: start.Add(time.Hour)})
+	db.Delete("b")
+	db.Store("d", Paste{Path: "d", Created: start.Add(2 * time.Minute)})
+
+	tt := []struct {
+		reverse bool
+		paths   []string
+	}{
+		{false, []string{"c", "d", "a"}},
+		{true, []string{"a", "d", "c"}},
+	}
+	for _, tc := range tt {
+		opts := ListOptions{Limit: 1, Reverse: tc.reverse}
+		var paths []string
+		for {
+			pastes, cursor, err := db.List(opts)
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			for _, p := range pastes {
+				paths = append(paths, p.Path)
+			}
+			if cursor == "" {
+				break
+			}
+			opts.Cursor = cursor
+		}
+		if !reflect.DeepEqual(paths, tc.paths) {
+			t.Errorf("Reverse %v, expected: %v; got: %v", tc.reverse, tc.paths, paths)
+		}
+	}
+}
+
+func TestMemoryDBReservePath(t *testing.T) {
+	db := NewMemoryDB()
+	db.Store("used", Paste{Path: "used"})
+	db.Store("expired", Paste{Path: "expired", Expire: time.Now().Add(-time.Minute)})
+	db.reserved["stale"] = time.Now().Add(-time.Minute)
+
+	tt := []struct {
+		path     string
+		reserved bool
+	}{
+		{"free", true},
+		{"free", false},
+		{"used", false},
+		{"expired", true},
+		{"stale", true},
+	}
+	for _, tc := range tt {
+		if reserved := db.ReservePath(tc.path); reserved != tc.reserved {
+			t.Errorf("Reserve %s: expected: %v; got: %v", tc.path, tc.reserved, reserved)
+		}
+	}
+
+	db.Store("free", Paste{Path: "free"})
+	if _, ok := db.reserved["free"]; ok {
+		t.Errorf("Reservation not removed by Store")
+	}
+}
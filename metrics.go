@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//Prometheus metrics
+var (
+	metricPastesCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "yep",
+		Name:      "pastes_created_total",
+		Help:      "Number of pastes created, by language.",
+	}, []string{"lang"})
+	metricPastesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "yep",
+		Name:      "pastes_read_total",
+		Help:      "Number of pastes read.",
+	})
+	metricPastesExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "yep",
+		Name:      "pastes_expired_total",
+		Help:      "Number of pastes deleted because expired.",
+	})
+	metricPastesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "yep",
+		Name:      "pastes_rejected_total",
+		Help:      "Number of pastes rejected, by reason.",
+	}, []string{"reason"})
+
+	metricPathCollisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "yep",
+		Name:      "path_collisions_total",
+		Help:      "Number of generated paths already used.",
+	})
+
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "yep",
+		Name:      "request_duration_seconds",
+		Help:      "Time spent serving the requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricPastesCreated,
+		metricPastesRead,
+		metricPastesExpired,
+		metricPastesRejected,
+		metricPathCollisions,
+		metricRequestDuration,
+	)
+}
+
+//rejectReason returns the label used for a rejected paste
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrPasteTooBig):
+		return "too_big"
+	case errors.Is(err, ErrEmptyPaste):
+		return "empty"
+	case errors.Is(err, ErrExpireTimeNotValid), errors.Is(err, ErrExpireDateNotValid), errors.Is(err, ErrExpireDateDisabled),
+		errors.Is(err, ErrExpireDateOutOfRange):
+		return "expire_not_valid"
+	case errors.Is(err, ErrPathNotValid), errors.Is(err, ErrPathDisabled):
+		return "path_not_valid"
+	case errors.Is(err, ErrPathReserved):
+		return "path_reserved"
+	case errors.Is(err, ErrPathUsed):
+		return "path_used"
+	case errors.Is(err, ErrVisibilityNotValid), errors.Is(err, ErrPrivateNeedsOwner):
+		return "visibility_not_valid"
+	}
+	return "other"
+}
+
+//observeRoute measures the time spent by the route
+func observeRoute(pattern string, r Route) Route {
+	observer := metricRequestDuration.WithLabelValues(pattern)
+	return func(s Server, w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		r(s, w, req)
+		observer.Observe(time.Since(start).Seconds())
+	}
+}
+
+//Limits of the statistics of the database exported to Prometheus
+const (
+	//databaseStatsTimeout bounds the time spent reading the statistics
+	databaseStatsTimeout = 10 * time.Second
+	//databaseStatsMaxAge is how long the statistics are reused, the scrapes in the meantime do not read the database
+	databaseStatsMaxAge = 30 * time.Second
+)
+
+//databaseCollector is a prometheus.Collector exporting the statistics of a Database
+type databaseCollector struct {
+	db      DatabaseV2
+	timeout time.Duration
+	maxAge  time.Duration
+
+	//mu is held while reading the statistics, so concurrent scrapes read them once
+	mu    sync.Mutex
+	stats DatabaseStats
+	read  time.Time
+}
+
+//newDatabaseCollector creates a databaseCollector exporting the statistics of db
+func newDatabaseCollector(db DatabaseV2) *databaseCollector {
+	return &databaseCollector{db: db, timeout: databaseStatsTimeout, maxAge: databaseStatsMaxAge}
+}
+
+var (
+	descStoredPastes = prometheus.NewDesc("yep_stored_pastes", "Number of pastes in the database.", nil, nil)
+	descStoredBytes  = prometheus.NewDesc("yep_stored_bytes", "Size in bytes of the pastes in the database.", nil, nil)
+)
+
+//Describe implements prometheus.Collector
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descStoredPastes
+	ch <- descStoredBytes
+}
+
+//Collect implements prometheus.Collector
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.databaseStats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(descStoredPastes, err)
+		ch <- prometheus.NewInvalidMetric(descStoredBytes, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(descStoredPastes, prometheus.GaugeValue, float64(stats.Count))
+	ch <- prometheus.MustNewConstMetric(descStoredBytes, prometheus.GaugeValue, float64(stats.Size))
+}
+
+//databaseStats returns the statistics of the database, they are read again when older than maxAge
+func (c *databaseCollector) databaseStats() (DatabaseStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.read.IsZero() && time.Since(c.read) < c.maxAge {
+		return c.stats, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	stats, err := c.db.Stats(ctx)
+	if err != nil {
+		return DatabaseStats{}, err
+	}
+	c.stats, c.read = stats, time.Now()
+	return stats, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+//requestCount returns the number of requests observed for the route
+func requestCount(t *testing.T, route string) uint64 {
+	var m dto.Metric
+	if err := metricRequestDuration.WithLabelValues(route).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Could not read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.MaxPasteSize = 100
+	cfg.CustomPaths.Reserved = []string{"reserved"}
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/api/new", handleAPINewPaste)
+	s.handleRoute("/api/get", handleAPIGetPaste)
+
+	do := func(method, target string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, httptest.NewRequest(method, target, bytes.NewReader(data)))
+		return res
+	}
+	newPaste := func(req newPasteRequest) *httptest.ResponseRecorder {
+		if req.ExpireTime == "" {
+			req.ExpireTime = getExpireTime(t)
+		}
+		return do(http.MethodPost, "/api/new", req)
+	}
+	newRequests, getRequests := requestCount(t, "/api/new"), requestCount(t, "/api/get")
+
+	t.Run("Created", func(t *testing.T) {
+		before := testutil.ToFloat64(metricPastesCreated.WithLabelValues("Go"))
+		if res := newPaste(newPasteRequest{Code: "package main", Lang: "Go", Path: "created"}); res.Code != http.StatusOK {
+			t.Fatalf("Could not create paste: %d", res.Code)
+		}
+		if created := testutil.ToFloat64(metricPastesCreated.WithLabelValues("Go")) - before; created != 1 {
+			t.Errorf("Expected: 1; got: %v", created)
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		before := testutil.ToFloat64(metricPastesRead)
+		if res := do(http.MethodGet, "/api/get", getPasteRequest{Name: "created"}); res.Code != http.StatusOK {
+			t.Fatalf("Could not read paste: %d", res.Code)
+		}
+		if read := testutil.ToFloat64(metricPastesRead) - before; read != 1 {
+			t.Errorf("Expected: 1; got: %v", read)
+		}
+	})
+
+	tt := []struct {
+		reason string
+		req    newPasteRequest
+	}{
+		{"empty", newPasteRequest{Code: ""}},
+		{"too_big", newPasteRequest{Code: strings.Repeat("a", cfg.MaxPasteSize+1)}},
+		{"expire_not_valid", newPasteRequest{Code: "code", ExpireTime: "1"}},
+		{"path_not_valid", newPasteRequest{Code: "code", Path: "../etc"}},
+		{"path_reserved", newPasteRequest{Code: "code", Path: "reserved"}},
+		{"path_used", newPasteRequest{Code: "code", Path: "created"}},
+		{"visibility_not_valid", newPasteRequest{Code: "code", Visibility: "secret"}},
+	}
+	for _, tc := range tt {
+		t.Run("Rejected "+tc.reason, func(t *testing.T) {
+			before := testutil.ToFloat64(metricPastesRejected.WithLabelValues(tc.reason))
+			if res := newPaste(tc.req); res.Code == http.StatusOK {
+				t.Fatalf("Paste not rejected")
+			}
+			if rejected := testutil.ToFloat64(metricPastesRejected.WithLabelValues(tc.reason)) - before; rejected != 1 {
+				t.Errorf("Expected: 1; got: %v", rejected)
+			}
+		})
+	}
+
+	t.Run("Request duration", func(t *testing.T) {
+		if count := requestCount(t, "/api/new") - newRequests; count != uint64(len(tt)+1) {
+			t.Errorf("Expected: %d; got: %d", len(tt)+1, count)
+		}
+		if count := requestCount(t, "/api/get") - getRequests; count != 1 {
+			t.Errorf("Expected: 1; got: %d", count)
+		}
+	})
+}
+
+func TestRejectReason(t *testing.T) {
+	tt := []struct {
+		err    error
+		reason string
+	}{
+		{ErrPasteTooBig, "too_big"},
+		{ErrEmptyPaste, "empty"},
+		{ErrExpireTimeNotValid, "expire_not_valid"},
+		{ErrExpireDateNotValid, "expire_not_valid"},
+		{ErrExpireDateDisabled, "expire_not_valid"},
+		{ErrExpireDateOutOfRange, "expire_not_valid"},
+		{ErrPathNotValid, "path_not_valid"},
+		{ErrPathDisabled, "path_not_valid"},
+		{fmt.Errorf("%w: raw", ErrPathReserved), "path_reserved"},
+		{fmt.Errorf("%w: used", ErrPathUsed), "path_used"},
+		{ErrVisibilityNotValid, "visibility_not_valid"},
+		{ErrPrivateNeedsOwner, "visibility_not_valid"},
+		{errors.New("Name not valid"), "other"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			if reason := rejectReason(tc.err); reason != tc.reason {
+				t.Errorf("Expected: %s; got: %s", tc.reason, reason)
+			}
+		})
+	}
+}
+
+//slowStatsDB is a database taking until the context is done for the statistics
+type slowStatsDB struct{ DatabaseV2 }
+
+func (slowStatsDB) Stats(ctx context.Context) (DatabaseStats, error) {
+	<-ctx.Done()
+	return DatabaseStats{}, ctx.Err()
+}
+
+func TestDatabaseCollector(t *testing.T) {
+	ctx := context.Background()
+	db := AdaptDatabase(NewMemoryDB())
+	db.Store(ctx, "first", Paste{Path: "first", Source: "first paste"})
+	db.Store(ctx, "second", Paste{Path: "second", Source: "second"})
+	c := newDatabaseCollector(db)
+
+	expected := func(count, size int) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`
+# HELP yep_stored_bytes Size in bytes of the pastes in the database.
+# TYPE yep_stored_bytes gauge
+yep_stored_bytes %d
+# HELP yep_stored_pastes Number of pastes in the database.
+# TYPE yep_stored_pastes gauge
+yep_stored_pastes %d
+`, size, count))
+	}
+	if err := testutil.CollectAndCompare(c, expected(2, 17)); err != nil {
+		t.Errorf("Wrong metrics: %v", err)
+	}
+
+	//The statistics are reused until they are older than maxAge
+	db.Store(ctx, "third", Paste{Path: "third", Source: "third"})
+	if err := testutil.CollectAndCompare(c, expected(2, 17)); err != nil {
+		t.Errorf("Statistics not reused: %v", err)
+	}
+	c.read = time.Now().Add(-c.maxAge)
+	if err := testutil.CollectAndCompare(c, expected(3, 22)); err != nil {
+		t.Errorf("Statistics not read again: %v", err)
+	}
+
+	slow := newDatabaseCollector(slowStatsDB{db})
+	slow.timeout = time.Millisecond
+	if err := testutil.CollectAndCompare(slow, expected(3, 22)); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Expected: %v; got: %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+)
+
+//ErrMigrationMismatch is used when the verification of a migration fails
+var ErrMigrationMismatch = fmt.Errorf("Migrated pastes do not match")
+
+//dualDB is a Database used while migrating from a Database to another
+//Writes go to both, reads go to the new one falling back to the old one
+type dualDB struct {
+	old     DatabaseV2
+	current DatabaseV2
+}
+
+func newDualDB(old, current DatabaseV2) *dualDB {
+	return &dualDB{old: old, current: current}
+}
+
+//Get implements DatabaseV2
+func (db *dualDB) Get(ctx context.Context, name string) (Paste, error) {
+	p, err := db.current.Get(ctx, name)
+	if errors.Is(err, ErrDatabaseNotFound) {
+		return db.old.Get(ctx, name)
+	}
+	return p, err
+}
+
+//Store implements DatabaseV2
+func (db *dualDB) Store(ctx context.Context, name string, value Paste) error {
+	if err := db.current.Store(ctx, name, value); err != nil {
+		return err
+	}
+	return db.old.Store(ctx, name, value)
+}
+
+//Delete implements DatabaseV2
+func (db *dualDB) Delete(ctx context.Context, name string) error {
+	if err := db.current.Delete(ctx, name); err != nil {
+		return err
+	}
+	return db.old.Delete(ctx, name)
+}
+
+//ReservePath implements DatabaseV2
+//The path must be free in both the databases
+func (db *dualDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	ok, err := db.current.ReservePath(ctx, path)
+	if !ok || err != nil {
+		return false, err
+	}
+	_, err = db.old.Get(ctx, path)
+	if errors.Is(err, ErrDatabaseNotFound) {
+		return true, nil
+	}
+	return false, err
+}
+
+//Close implements DatabaseV2
+func (db *dualDB) Close() error {
+	currentErr := db.current.Close()
+	if err := db.old.Close(); err != nil {
+		return err
+	}
+	return currentErr
+}
+
+//listStream reads the pastes of a database one page at a time, in the order of the options
+type listStream struct {
+	ctx  context.Context
+	db   DatabaseV2
+	opts ListOptions
+	page []Paste
+	done bool
+}
+
+func newListStream(ctx context.Context, db DatabaseV2, opts ListOptions) *listStream {
+	if opts.Limit == 0 {
+		opts.Limit = listPageSize
+	}
+	return &listStream{ctx: ctx, db: db, opts: opts}
+}
+
+//peek returns the next paste without consuming it, false if there are no more pastes
+func (s *listStream) peek() (Paste, bool, error) {
+	for len(s.page) == 0 && !s.done {
+		page, cursor, err := s.db.List(s.ctx, s.opts)
+		if err != nil {
+			return Paste{}, false, err
+		}
+		s.page, s.opts.Cursor, s.done = page, cursor, cursor == ""
+	}
+	if len(s.page) == 0 {
+		return Paste{}, false, nil
+	}
+	return s.page[0], true, nil
+}
+
+//next consumes the paste returned by peek
+func (s *listStream) next() { s.page = s.page[1:] }
+
+//List implements DatabaseV2
+//The pages of both the databases are merged, the pastes of the old one are skipped if they are in the new one
+func (db *dualDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	current := newListStream(ctx, db.current, opts)
+	old := newListStream(ctx, db.old, opts)
+
+	var page []Paste
+	//One more paste tells if there is a next page
+	for opts.Limit == 0 || len(page) <= opts.Limit {
+		c, cok, err := current.peek()
+		if err != nil {
+			return nil, "", err
+		}
+		o, ook, err := old.peek()
+		if err != nil {
+			return nil, "", err
+		}
+		if !cok && !ook {
+			break
+		}
+		if cok && (!ook || !opts.before(o, c)) {
+			page = append(page, c)
+			current.next()
+			continue
+		}
+
+		old.next()
+		_, err = db.current.Get(ctx, o.Path)
+		if errors.Is(err, ErrDatabaseNotFound) {
+			page = append(page, o)
+		} else if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if opts.Limit == 0 || len(page) <= opts.Limit {
+		return page, "", nil
+	}
+	page = page[:opts.Limit]
+	return page, listCursor(page[len(page)-1]), nil
+}
+
+//Stats implements DatabaseV2
+func (db *dualDB) Stats(ctx context.Context) (DatabaseStats, error) {
+	var stats DatabaseStats
+	err := eachPaste(ctx, db, ListOptions{}, func(p Paste) error {
+		stats.Count++
+		stats.Size += int64(pasteSize(p))
+		return nil
+	})
+	return stats, err
+}
+
+//ExpiresPastes implements expiringDatabase, the pastes are written to both databases so both must expire them
+func (db *dualDB) ExpiresPastes() bool { return expiresPastes(db.old) && expiresPastes(db.current) }
+
+//pasteHash returns an hash of every field of the paste
+func pasteHash(p Paste) string {
+	h := sha256.New()
+	for _, field := range []string{
+		p.Path,
+		p.User,
+		p.UserID,
+		p.Owner,
+		p.Visibility,
+		p.Lang,
+		p.Source,
+		string(p.Style),
+		string(p.Content),
+		p.Encoding,
+		strconv.FormatInt(p.Created.UnixNano(), 10),
+		strconv.FormatInt(p.Expire.UnixNano(), 10),
+		strconv.Itoa(p.Revision),
+	} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//migrateResult is the outcome of a migration
+type migrateResult struct {
+	Copied     int
+	Skipped    int
+	Verified   int
+	Mismatched []string
+	//Source and Destination are the number of pastes in the databases, the destination must have every paste of the source
+	Source      int
+	Destination int
+}
+
+//migratePastes copies all the pastes from src to dst and verifies them
+//Pastes already in dst are overwritten only if overwrite is set
+func migratePastes(ctx context.Context, src, dst DatabaseV2, overwrite bool) (migrateResult, error) {
+	var res migrateResult
+	srcStats, err := src.Stats(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.Source = srcStats.Count
+
+	hashes := make(map[string]string)
+	err = eachPaste(ctx, src, ListOptions{}, func(p Paste) error {
+		if !overwrite {
+			_, err := dst.Get(ctx, p.Path)
+			if err == nil {
+				res.Skipped++
+				return nil
+			}
+			if !errors.Is(err, ErrDatabaseNotFound) {
+				return err
+			}
+		}
+		if err := dst.Store(ctx, p.Path, p); err != nil {
+			return err
+		}
+		hashes[p.Path] = pasteHash(p)
+		res.Copied++
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	for path, hash := range hashes {
+		p, err := dst.Get(ctx, path)
+		if err != nil || pasteHash(p) != hash {
+			res.Mismatched = append(res.Mismatched, path)
+			continue
+		}
+		res.Verified++
+	}
+	dstStats, err := dst.Stats(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.Destination = dstStats.Count
+
+	//The pastes not listed by the source are found by their number
+	if res.Verified != res.Copied || res.Copied+res.Skipped != res.Source || res.Destination < res.Source {
+		return res, ErrMigrationMismatch
+	}
+	return res, nil
+}
+
+//readDatabaseConfig reads a databaseConfig from a JSON file
+func readDatabaseConfig(path string) (databaseConfig, error) {
+	var dbCfg databaseConfig
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return dbCfg, err
+	}
+	err = json.Unmarshal(content, &dbCfg)
+	return dbCfg, err
+}
+
+//yep migrate -from file -to file [-overwrite]
+func commandMigrate(args []string, cfg config, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", "", "JSON file with the config of the source database")
+	to := flags.String("to", "", "JSON file with the config of the destination database")
+	overwrite := flags.Bool("overwrite", false, "Overwrite the pastes already in the destination database")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	fromCfg, err := readDatabaseConfig(*from)
+	if err != nil {
+		return fmt.Errorf("Cannot read source config: %v", err)
+	}
+	toCfg, err := readDatabaseConfig(*to)
+	if err != nil {
+		return fmt.Errorf("Cannot read destination config: %v", err)
+	}
+
+	src, _, err := openDatabase(cfg, fromCfg, logger, false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, _, err := openDatabase(cfg, toCfg, logger, true)
+	if err != nil {
+		return err
+	}
+
+	res, migrateErr := migratePastes(context.Background(), src, dst, *overwrite)
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if migrateErr != nil {
+		logger.Error("Migration not verified", "mismatched", res.Mismatched, "source", res.Source, "destination", res.Destination,
+			"copied", res.Copied, "skipped", res.Skipped)
+		return migrateErr
+	}
+	logger.Info("Migrated pastes", "copied", res.Copied, "skipped", res.Skipped, "verified", res.Verified, "destination", res.Destination)
+	return nil
+}
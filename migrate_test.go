@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMigratePastes(t *testing.T) {
+	src := NewMemoryDB()
+	dst := NewMemoryDB()
+	now := time.Now()
+	src.Store("first", Paste{Path: "first", Source: "first", Created: now})
+	src.Store("second", Paste{Path: "second", Source: "second", Created: now, Expire: now.Add(time.Hour)})
+	dst.Store("second", Paste{Path: "second", Source: "newer"})
+
+	ctx := context.Background()
+	res, err := migratePastes(ctx, AdaptDatabase(src), AdaptDatabase(dst), false)
+	if err != nil {
+		t.Fatalf("Could not migrate: %v", err)
+	}
+	if res.Copied != 1 || res.Skipped != 1 || res.Verified != 1 {
+		t.Errorf("Wrong result: %+v", res)
+	}
+	if p, _ := dst.Get("second"); p.Source != "newer" {
+		t.Errorf("Existing paste overwritten")
+	}
+
+	res, err = migratePastes(ctx, AdaptDatabase(src), AdaptDatabase(dst), true)
+	if err != nil {
+		t.Fatalf("Could not migrate: %v", err)
+	}
+	if res.Copied != 2 || res.Verified != 2 {
+		t.Errorf("Wrong result: %+v", res)
+	}
+	if p, _ := dst.Get("second"); p.Source != "second" {
+		t.Errorf("Existing paste not overwritten")
+	}
+}
+
+func TestDualDB(t *testing.T) {
+	old := NewMemoryDB()
+	current := NewMemoryDB()
+	old.Store("old", Paste{Path: "old", Source: "old"})
+	ctx := context.Background()
+	db := newDualDB(AdaptDatabase(old), AdaptDatabase(current))
+
+	if p, err := db.Get(ctx, "old"); err != nil || p.Source != "old" {
+		t.Errorf("Fallback read failed: %+v, %v", p, err)
+	}
+
+	db.Store(ctx, "new", Paste{Path: "new", Source: "new"})
+	for _, d := range []*MemoryDB{old, current} {
+		if _, err := d.Get("new"); err != nil {
+			t.Errorf("Paste not written to both databases")
+		}
+	}
+
+	pastes, _, err := db.List(ctx, ListOptions{})
+	if err != nil || len(pastes) != 2 {
+		t.Errorf("Wrong number of pastes: expected: 2; got: %d, %v", len(pastes), err)
+	}
+
+	db.Delete(ctx, "old")
+	if _, err := db.Get(ctx, "old"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Paste not deleted")
+	}
+}
+
+func TestDualDBList(t *testing.T) {
+	ctx := context.Background()
+	old := AdaptDatabase(NewMemoryDB())
+	current := AdaptDatabase(NewMemoryDB())
+	start := time.Now()
+	for i, path := range []string{"a", "b", "c", "d", "e"} {
+		p := Paste{Path: path, Source: "old", Created: start.Add(time.Duration(i) * time.Minute)}
+		if path != "b" && path != "d" {
+			old.Store(ctx, path, p)
+		}
+		if path != "a" && path != "e" {
+			p.Source = "current"
+			current.Store(ctx, path, p)
+		}
+	}
+	db := newDualDB(old, current)
+
+	tt := []struct {
+		name  string
+		opts  ListOptions
+		paths []string
+	}{
+		{"All", ListOptions{}, []string{"a", "b", "c", "d", "e"}},
+		{"Pages", ListOptions{Limit: 2}, []string{"a", "b", "c", "d", "e"}},
+		{"Reverse", ListOptions{Limit: 2, Reverse: true}, []string{"e", "d", "c", "b", "a"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var paths []string
+			err := eachPaste(ctx, db, tc.opts, func(p Paste) error {
+				if p.Path == "c" && p.Source != "current" {
+					t.Errorf("Expected: paste from the new database; got: %q", p.Source)
+				}
+				paths = append(paths, p.Path)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			if !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("Expected: %v; got: %v", tc.paths, paths)
+			}
+		})
+	}
+
+	if stats, err := db.Stats(ctx); err != nil || stats.Count != 5 {
+		t.Errorf("Expected: 5 pastes; got: %+v, %v", stats, err)
+	}
+}
+
+//lossyDB is a database not listing a paste
+type lossyDB struct {
+	DatabaseV2
+	missing string
+}
+
+func (db lossyDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	pastes, cursor, err := db.DatabaseV2.List(ctx, opts)
+	listed := pastes[:0]
+	for _, p := range pastes {
+		if p.Path != db.missing {
+			listed = append(listed, p)
+		}
+	}
+	return listed, cursor, err
+}
+
+func TestMigratePastesVerify(t *testing.T) {
+	ctx := context.Background()
+	src := AdaptDatabase(NewMemoryDB())
+	for _, path := range []string{"first", "second"} {
+		src.Store(ctx, path, Paste{Path: path, Source: path})
+	}
+
+	res, err := migratePastes(ctx, lossyDB{src, "second"}, AdaptDatabase(NewMemoryDB()), false)
+	if !errors.Is(err, ErrMigrationMismatch) || res.Source != 2 || res.Destination != 1 {
+		t.Errorf("Expected: %v with 2 source and 1 destination pastes; got: %v, %+v", ErrMigrationMismatch, err, res)
+	}
+}
+
+func TestPasteHash(t *testing.T) {
+	now := time.Now()
+	p := Paste{Path: "path", User: "user", UserID: "id", Owner: "owner", Visibility: VisibilityPublic, Lang: "Go", Source: "source",
+		Style: "body{}", Content: "<b>source</b>", Encoding: CompressionGzip, Created: now, Expire: now.Add(time.Hour), Revision: 2}
+	hash := pasteHash(p)
+
+	changes := map[string]func(p *Paste){
+		"Path":       func(p *Paste) { p.Path = "other" },
+		"User":       func(p *Paste) { p.User = "other" },
+		"UserID":     func(p *Paste) { p.UserID = "other" },
+		"Owner":      func(p *Paste) { p.Owner = "other" },
+		"Visibility": func(p *Paste) { p.Visibility = VisibilityPrivate },
+		"Lang":       func(p *Paste) { p.Lang = "Python" },
+		"Source":     func(p *Paste) { p.Source = "other" },
+		"Style":      func(p *Paste) { p.Style = "" },
+		"Content":    func(p *Paste) { p.Content = "" },
+		"Encoding":   func(p *Paste) { p.Encoding = "" },
+		"Created":    func(p *Paste) { p.Created = now.Add(time.Second) },
+		"Expire":     func(p *Paste) { p.Expire = time.Time{} },
+		"Revision":   func(p *Paste) { p.Revision = 1 },
+	}
+	for field, change := range changes {
+		t.Run(field, func(t *testing.T) {
+			changed := p
+			change(&changed)
+			if pasteHash(changed) == hash {
+				t.Errorf("Expected: different hash")
+			}
+		})
+	}
+}
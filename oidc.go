@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+//Errors declaration for the login with OpenID Connect
+var (
+	ErrOIDCState         = fmt.Errorf("Login expired or not valid, try again")
+	ErrOIDCEmailRequired = fmt.Errorf("A verified email is required")
+	ErrOIDCDomain        = fmt.Errorf("Email domain not allowed")
+	ErrOIDCGroup         = fmt.Errorf("Not a member of an allowed group")
+	ErrLoginRequired     = fmt.Errorf("Login required")
+)
+
+//oidcCookie keeps the state of a login between the redirect to the provider and the callback
+const oidcCookie = "yep_oidc"
+
+//oidcLoginTime is how long the provider can take for sending back the user
+const oidcLoginTime = 10 * time.Minute
+
+//oidcLogin is the login with an OpenID Connect provider
+type oidcLogin struct {
+	cfg      oidcConfig
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+//newOIDCLogin discovers the endpoints of the provider
+func newOIDCLogin(ctx context.Context, cfg oidcConfig) (*oidcLogin, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcLogin{
+		cfg: cfg,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       cfg.Scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+//oidcState is the value of oidcCookie
+type oidcState struct {
+	State    string
+	Nonce    string
+	Verifier string
+	//Next is where the user is sent after the login
+	Next string
+}
+
+//account returns the account described by the claims of the ID token, if it is allowed to log in
+func (l *oidcLogin) account(token *oidc.IDToken) (Account, error) {
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return Account{}, err
+	}
+	claim := func(name string) string {
+		s, _ := claims[name].(string)
+		return s
+	}
+
+	if len(l.cfg.AllowedDomains) > 0 {
+		email := claim("email")
+		//Providers omitting email_verified verify the emails
+		if verified, ok := claims["email_verified"].(bool); email == "" || (ok && !verified) {
+			return Account{}, ErrOIDCEmailRequired
+		}
+		domain := email[strings.LastIndexByte(email, '@')+1:]
+		if !containsFold(l.cfg.AllowedDomains, domain) {
+			return Account{}, fmt.Errorf("%w: %s", ErrOIDCDomain, domain)
+		}
+	}
+
+	if len(l.cfg.AllowedGroups) > 0 {
+		var groups []string
+		switch g := claims[l.cfg.GroupsClaim].(type) {
+		case string:
+			groups = []string{g}
+		case []interface{}:
+			for _, group := range g {
+				if s, ok := group.(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		}
+		allowed := false
+		for _, group := range groups {
+			if containsFold(l.cfg.AllowedGroups, group) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return Account{}, ErrOIDCGroup
+		}
+	}
+
+	name := claim(l.cfg.NameClaim)
+	for _, fallback := range []string{"preferred_username", "email", "sub"} {
+		if name != "" {
+			break
+		}
+		name = claim(fallback)
+	}
+	return Account{
+		ID:      "oidc:" + token.Subject,
+		Name:    name,
+		Created: time.Now(),
+		Issuer:  token.Issuer,
+	}, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//safeRedirect returns next if it is a path of this server, otherwise /
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+//requireLogin wraps a route so it needs a login when OIDC.Required is set
+//The API routes accept the API keys too
+func requireLogin(r Route) Route {
+	return func(s Server, w http.ResponseWriter, req *http.Request) {
+		if s.oidc == nil || !s.cfg.OIDC.Required || s.sessionAccount(req) != nil {
+			r(s, w, req)
+			return
+		}
+		if account, err := s.apiAccount(req); err == nil && account != nil {
+			r(s, w, req)
+			return
+		}
+
+		if strings.HasPrefix(req.URL.Path, "/api/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			res, _ := json.Marshal(struct {
+				OK    bool
+				Error string
+			}{false, ErrLoginRequired.Error()})
+			w.Write(res)
+			return
+		}
+		http.Redirect(w, req, "/oidc/login?next="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+	}
+}
+
+//handleOIDCRoutes registers the routes of the login with OpenID Connect
+func (s *Server) handleOIDCRoutes() {
+	s.handleRoute("/oidc/login", handleOIDCLogin)
+	s.handleRoute("/oidc/callback", handleOIDCCallback)
+	if s.accounts == nil {
+		s.handleRoute("/login", func(s Server, w http.ResponseWriter, req *http.Request) {
+			http.Redirect(w, req, "/oidc/login", http.StatusFound)
+		})
+	}
+}
+
+//Handle: /oidc/login
+//Redirects to the provider, the query parameter next is where the user is sent after the login
+func handleOIDCLogin(s Server, w http.ResponseWriter, req *http.Request) {
+	state := oidcState{Next: safeRedirect(req.URL.Query().Get("next"))}
+	var err error
+	if state.State, err = randomToken(16); err == nil {
+		state.Nonce, err = randomToken(16)
+	}
+	if err != nil {
+		s.logger(req).Error("Cannot start login", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	state.Verifier = oauth2.GenerateVerifier()
+
+	value, _ := json.Marshal(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    url.QueryEscape(string(value)),
+		Path:     "/oidc/",
+		MaxAge:   int(oidcLoginTime.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, s.oidc.oauth.AuthCodeURL(state.State, oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier)), http.StatusFound)
+}
+
+//Handle: /oidc/callback
+//The provider sends back the user with the authorization code
+func handleOIDCCallback(s Server, w http.ResponseWriter, req *http.Request) {
+	fail := func(status int, err error) {
+		s.logger(req).Info("Login with OpenID Connect failed", "error", err)
+		w.WriteHeader(status)
+		renderAccountPage(s, w, req, "login", accountPage{Error: err.Error()})
+	}
+
+	var state oidcState
+	cookie, err := req.Cookie(oidcCookie)
+	if err == nil {
+		var value string
+		if value, err = url.QueryUnescape(cookie.Value); err == nil {
+			err = json.Unmarshal([]byte(value), &state)
+		}
+	}
+	query := req.URL.Query()
+	if err != nil || state.State == "" || query.Get("state") != state.State {
+		fail(http.StatusBadRequest, ErrOIDCState)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/oidc/", MaxAge: -1, HttpOnly: true})
+	if e := query.Get("error"); e != "" {
+		fail(http.StatusUnauthorized, fmt.Errorf("Login refused: %s", e))
+		return
+	}
+
+	token, err := s.oidc.oauth.Exchange(req.Context(), query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		fail(http.StatusUnauthorized, fmt.Errorf("Cannot get the token: %v", err))
+		return
+	}
+	rawID, ok := token.Extra("id_token").(string)
+	if !ok {
+		fail(http.StatusUnauthorized, fmt.Errorf("No ID token"))
+		return
+	}
+	idToken, err := s.oidc.verifier.Verify(req.Context(), rawID)
+	if err != nil {
+		fail(http.StatusUnauthorized, fmt.Errorf("ID token not valid: %v", err))
+		return
+	}
+	if idToken.Nonce != state.Nonce {
+		fail(http.StatusUnauthorized, ErrOIDCState)
+		return
+	}
+
+	account, err := s.oidc.account(idToken)
+	if err != nil {
+		fail(http.StatusForbidden, err)
+		return
+	}
+	sessionToken, err := s.sessions.createExternal(account)
+	if err != nil {
+		s.logger(req).Error("Cannot create session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	s.logger(req).Info("Logged in with OpenID Connect", "account", account.ID, "name", account.Name)
+	setSessionCookie(s, w, req, sessionToken)
+	http.Redirect(w, req, state.Next, http.StatusFound)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//mockIssuer is a local OpenID Connect provider, it logs in every user with claims
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	//codes are the nonces and the PKCE challenges of the authorization codes
+	codes map[string][2]string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string][2]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.server.URL,
+			"authorization_endpoint":                m.server.URL + "/authorize",
+			"token_endpoint":                        m.server.URL + "/token",
+			"jwks_uri":                              m.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		code, _ := randomToken(8)
+		m.mu.Lock()
+		m.codes[code] = [2]string{q.Get("nonce"), q.Get("code_challenge")}
+		m.mu.Unlock()
+		http.Redirect(w, req, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		m.mu.Lock()
+		code, ok := m.codes[req.PostFormValue("code")]
+		delete(m.codes, req.PostFormValue("code"))
+		claims := map[string]interface{}{}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		m.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != code[1] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims["iss"] = m.server.URL
+		claims["aud"] = "yep"
+		claims["nonce"] = code[0]
+		claims["iat"] = time.Now().Unix()
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.sign(t, claims),
+		})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+//sign returns a JWT with the claims signed with RS256
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("Could not sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (m *mockIssuer) setClaims(claims map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.OIDC.Issuer = issuer.server.URL
+	cfg.OIDC.ClientID = "yep"
+	cfg.OIDC.RedirectURL = "http://yep.test/oidc/callback"
+	cfg.OIDC.Required = true
+	cfg.OIDC.AllowedDomains = []string{"example.com"}
+	cfg.OIDC.AllowedGroups = []string{"dev", "ops"}
+
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	var err error
+	if s.oidc, err = newOIDCLogin(context.Background(), cfg.OIDC); err != nil {
+		t.Fatalf("Could not set up OpenID Connect: %v", err)
+	}
+	s.sessions = newSessionStore(time.Hour)
+	s.handleRoute("/", requireLogin(handleHome))
+	s.handleRoute("/api/get", requireLogin(handleAPIGetPaste))
+	s.handleOIDCRoutes()
+
+	do := func(method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	//login follows the redirects of a login, it returns the response of the callback
+	login := func(t *testing.T, state string) *httptest.ResponseRecorder {
+		res := do(http.MethodGet, "/oidc/login?next=/", nil)
+		cookies := res.Result().Cookies()
+		if res.Code != http.StatusFound || len(cookies) != 1 {
+			t.Fatalf("Expected: redirect to the issuer; got: %d", res.Code)
+		}
+		auth, err := noRedirect.Get(res.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Could not authorize: %v", err)
+		}
+		auth.Body.Close()
+		callback, _ := url.Parse(auth.Header.Get("Location"))
+		if state != "" {
+			q := callback.Query()
+			q.Set("state", state)
+			callback.RawQuery = q.Encode()
+		}
+		return do(http.MethodGet, callback.RequestURI(), nil, cookies[0])
+	}
+
+	if res := do(http.MethodGet, "/", nil); res.Code != http.StatusFound || !strings.HasPrefix(res.Header().Get("Location"), "/oidc/login") {
+		t.Errorf("Expected: redirect to login; got: %d %s", res.Code, res.Header().Get("Location"))
+	}
+	if res := do(http.MethodPost, "/api/get", nil); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected: %d; got: %d", http.StatusUnauthorized, res.Code)
+	}
+
+	tt := []struct {
+		name   string
+		claims map[string]interface{}
+		state  string
+		code   int
+	}{
+		{"Allowed", map[string]interface{}{"sub": "1", "name": "Alice", "email": "alice@example.com", "email_verified": true, "groups": []string{"dev"}}, "", http.StatusFound},
+		{"Domain", map[string]interface{}{"sub": "2", "email": "bob@other.com", "groups": []string{"dev"}}, "", http.StatusForbidden},
+		{"Email not verified", map[string]interface{}{"sub": "3", "email": "carl@example.com", "email_verified": false, "groups": []string{"dev"}}, "", http.StatusForbidden},
+		{"Group", map[string]interface{}{"sub": "4", "email": "dan@example.com", "groups": []string{"sales"}}, "", http.StatusForbidden},
+		{"State", map[string]interface{}{"sub": "5", "email": "eve@example.com", "groups": "ops"}, "forged", http.StatusBadRequest},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			issuer.setClaims(tc.claims)
+			res := login(t, tc.state)
+			if res.Code != tc.code {
+				t.Fatalf("Expected: %d; got: %d\n%s", tc.code, res.Code, res.Body)
+			}
+			if tc.code != http.StatusFound {
+				return
+			}
+
+			var session *http.Cookie
+			for _, c := range res.Result().Cookies() {
+				if c.Name == sessionCookie {
+					session = c
+				}
+			}
+			if session == nil {
+				t.Fatal("Expected: session cookie")
+			}
+			res = do(http.MethodPost, "/", url.Values{"name": {"mallory"}, "code": {"example paste"}, "expire": {getExpireTime(t)}}, session)
+			if res.Code != http.StatusFound {
+				t.Fatalf("Expected: %d; got: %d", http.StatusFound, res.Code)
+			}
+			p, err := s.db.Get(context.Background(), strings.TrimPrefix(res.Header().Get("Location"), "/"))
+			if err != nil || p.User != "Alice" || p.UserID != "oidc:1" {
+				t.Errorf("Expected: paste by Alice; got: %q %q, %v", p.User, p.UserID, err)
+			}
+		})
+	}
+}
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"context"
 	"html/template"
-	"log"
 	"time"
 )
 
+//pasteDuration is a time.Duration read as a string, "Never" is zero
+//It is used for the expiration times and for the durations of the config
 type pasteDuration struct{ time.Duration }
 
 //Paste is a paste
 type Paste struct {
-	Path    string
-	User    string
-	Lang    string
-	Source  string
-	Expire  time.Time
-	Style   template.CSS
-	Content template.HTML
-	Created time.Time
+	Path string
+	User string
+	//UserID is the ID of the account that created the paste, empty if the paste is anonymous
+	UserID string
+	//Owner is the hash of the owner token of the anonymous uploader, empty if unknown
+	Owner string
+	//Visibility is who can see the paste, empty is unlisted
+	Visibility string
+	Lang       string
+	Source     string
+	Expire     time.Time
+	Style      template.CSS
+	Content    template.HTML
+	Created    time.Time
+	//Encoding is the compression used for Source and Content, empty if not compressed
+	Encoding string
+	//Revision is the number of the revision, 0 for the pastes never edited
+	Revision int
+}
+
+//Expires reports if the paste has an expire time
+func (p Paste) Expires() bool {
+	return !p.Expire.IsZero()
 }
 
 //String implements fmt.Stringer
@@ -26,6 +43,14 @@ func (d *pasteDuration) String() string {
 	return string(m)
 }
 
+//after returns when a paste expires if its expiration is set to d at t, the zero time if it never expires
+func (d pasteDuration) after(t time.Time) time.Time {
+	if d.Duration == 0 {
+		return time.Time{}
+	}
+	return t.Add(d.Duration)
+}
+
 //MarshalText implements encoding.TextMarshaler
 func (d *pasteDuration) MarshalText() ([]byte, error) {
 	if d.Duration == 0 {
@@ -50,44 +75,70 @@ func (d *pasteDuration) UnmarshalText(text []byte) error {
 }
 
 //NewPaste creates a new paste
-func NewPaste(s *Server, name, source, lang string, expireTime *pasteDuration) (string, error) {
+//If path is empty a path is generated, otherwise it is validated and reserved
+//account is the verified creator of the paste, its name replaces name, nil if the paste is anonymous
+//owner is the hash of the owner token of an anonymous creator, empty if unknown
+//expire is when the paste expires, the zero time if it never expires
+func NewPaste(ctx context.Context, s *Server, account *Account, owner, name, path, source, lang, visibility string, expire time.Time) (Paste, error) {
+	if account != nil {
+		name = account.Name
+	}
 
 	name, err := validateName(name, s.cfg.DefaultName)
 	if err != nil {
-		return "", err
+		metricPastesRejected.WithLabelValues(rejectReason(err)).Inc()
+		return Paste{}, err
 	}
 	source, err = validateCode(source, s.cfg.MaxPasteSize)
 	if err != nil {
-		return "", err
+		metricPastesRejected.WithLabelValues(rejectReason(err)).Inc()
+		return Paste{}, err
+	}
+	visibility, err = validateVisibility(visibility)
+	if err == nil && visibility == VisibilityPrivate && account == nil && owner == "" {
+		err = ErrPrivateNeedsOwner
+	}
+	if err != nil {
+		metricPastesRejected.WithLabelValues(rejectReason(err)).Inc()
+		return Paste{}, err
 	}
 
 	css, code, lang := highlightCode(source, lang, s.cfg.UndefinedLang, s.cfg.HighlightStyle)
 
-	path := s.db.CreatePastePath(s.cfg.PathLen)
+	if path != "" {
+		if err := s.reserveCustomPath(ctx, path); err != nil {
+			metricPastesRejected.WithLabelValues(rejectReason(err)).Inc()
+			return Paste{}, err
+		}
+	} else if path, err = s.createPastePath(ctx); err != nil {
+		s.log.Error("Could not create paste path", "error", err)
+		return Paste{}, err
+	}
 	paste := Paste{
-		Path:    path,
-		User:    name,
-		Lang:    lang,
-		Source:  source,
-		Style:   template.CSS(css),
-		Content: template.HTML(code),
-		Created: time.Now(),
-		Expire:  time.Now().Add(expireTime.Duration),
+		Path:       path,
+		User:       name,
+		Visibility: visibility,
+		Lang:       lang,
+		Source:     source,
+		Style:      template.CSS(css),
+		Content:    template.HTML(code),
+		Created:    time.Now(),
+		Expire:     expire,
+	}
+	if account != nil {
+		paste.UserID = account.ID
+	} else {
+		paste.Owner = owner
 	}
 	if name == "" {
 		name = s.cfg.DefaultName
 	}
-	if err := s.db.Store(path, paste); err != nil {
-		log.Println("Could not paste paste", err)
-		return "", err
-	}
-
-	//If ExpireTime is 0 do not delete pastes
-	if expireTime.Duration != 0 {
-		time.AfterFunc(expireTime.Duration, func() {
-			s.db.Delete(paste.Path)
-		})
+	if err := s.db.Store(ctx, path, paste); err != nil {
+		s.log.Error("Could not store paste", "path", path, "error", err)
+		return Paste{}, err
 	}
+	metricPastesCreated.WithLabelValues(lang).Inc()
+	s.scheduleExpire(paste)
 
-	return paste.Path, nil
+	return paste, nil
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Path generators
+const (
+	PathsRandom     = "random"
+	PathsWords      = "words"
+	PathsSequential = "sequential"
+)
+
+//ErrPathGeneratorNotValid is returned when the path generator in the config is unknown
+var ErrPathGeneratorNotValid = fmt.Errorf("Path generator not valid")
+
+//Errors of the paths chosen by the users
+var (
+	ErrPathNotValid = fmt.Errorf("Path not valid")
+	ErrPathReserved = fmt.Errorf("Path reserved")
+	ErrPathUsed     = fmt.Errorf("Path already used")
+	ErrPathDisabled = fmt.Errorf("Custom paths are disabled")
+)
+
+//pathReserveTime is how long a path reserved by ReservePath is kept before the paste is stored
+const pathReserveTime = time.Minute
+
+//errPathSkipped is returned by ReservePath for the paths this instance cannot use even if they are free,
+//they are skipped without counting them as collisions
+var errPathSkipped = errors.New("Path skipped")
+
+const alphabeth = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+//base62 are the digits of the sequential paths
+const base62 = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+//PathGenerator generates the candidate paths of the new pastes
+type PathGenerator interface {
+	//Path returns a candidate path, grow is how many times the paths have been lengthened because of the collisions
+	Path(ctx context.Context, grow int) (string, error)
+}
+
+//newPathGenerator creates the generator described by the config, length is the length of the paths before growing
+//db keeps the counter of the sequential paths, nil for a counter kept in memory
+func newPathGenerator(cfg pathsConfig, length int, db DatabaseV2) (PathGenerator, error) {
+	switch cfg.Generator {
+	case PathsRandom, "":
+		return randomPaths{length}, nil
+	case PathsWords:
+		if cfg.WordList == "" {
+			return wordPaths{first: pathAdjectives, second: pathAnimals, digits: 2}, nil
+		}
+		words, err := readWordList(cfg.WordList)
+		if err != nil {
+			return nil, err
+		}
+		return wordPaths{first: words, second: words, digits: 2}, nil
+	case PathsSequential:
+		return &sequentialPaths{length: length, db: db}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPathGeneratorNotValid, cfg.Generator)
+}
+
+//randomPaths generates paths of letters chosen with crypto/rand
+type randomPaths struct{ length int }
+
+//Path implements PathGenerator
+func (g randomPaths) Path(ctx context.Context, grow int) (string, error) {
+	path := make([]byte, g.length+grow)
+	max := big.NewInt(int64(len(alphabeth)))
+	for i := range path {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		path[i] = alphabeth[n.Int64()]
+	}
+	return string(path), nil
+}
+
+//wordPaths generates readable paths made of two words and a number, like brave-otter-42
+//Growing adds a digit to the number
+type wordPaths struct {
+	first  []string
+	second []string
+	digits int
+}
+
+//Path implements PathGenerator
+func (g wordPaths) Path(ctx context.Context, grow int) (string, error) {
+	first, err := randomIndex(len(g.first))
+	if err != nil {
+		return "", err
+	}
+	second, err := randomIndex(len(g.second))
+	if err != nil {
+		return "", err
+	}
+	max := 1
+	for i := 0; i < g.digits+grow; i++ {
+		max *= 10
+	}
+	n, err := randomIndex(max)
+	if err != nil {
+		return "", err
+	}
+	return g.first[first] + "-" + g.second[second] + "-" + strconv.Itoa(n), nil
+}
+
+func randomIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+//readWordList reads a file with a word for every line, the empty lines are ignored
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" {
+			continue
+		}
+		if strings.IndexFunc(word, func(r rune) bool { return !strings.ContainsRune(base62, r) }) != -1 {
+			return nil, fmt.Errorf("Word not valid in %s: %q, only letters and digits are allowed", path, word)
+		}
+		words = append(words, word)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("Word list is empty: %s", path)
+	}
+	return words, nil
+}
+
+//sequentialPaths generates the numbers in base 62 starting from zero, padded to length
+//The counter is kept by the database when it is a sequenceDatabase, so it survives the restarts and it is shared
+//by the instances using the database, otherwise it is kept in memory and it starts after the highest path stored
+type sequentialPaths struct {
+	length int
+	db     DatabaseV2
+
+	mu     sync.Mutex
+	loaded bool
+	next   uint64
+}
+
+//Path implements PathGenerator
+//The sequence never repeats a path so growing is not needed
+func (g *sequentialPaths) Path(ctx context.Context, grow int) (string, error) {
+	n, err := g.number(ctx)
+	if err != nil {
+		return "", err
+	}
+	return formatBase62(n, g.length), nil
+}
+
+//number returns the next number of the sequence
+func (g *sequentialPaths) number(ctx context.Context) (uint64, error) {
+	if seq := findSequenceDB(g.db); seq != nil {
+		return seq.NextSequence(ctx, g.start)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.loaded {
+		start, err := g.start(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if start > g.next {
+			g.next = start
+		}
+		g.loaded = true
+	}
+	g.next++
+	return g.next - 1, nil
+}
+
+//start returns the number following the highest path stored, it is the first number of a new counter
+func (g *sequentialPaths) start(ctx context.Context) (uint64, error) {
+	if g.db == nil {
+		return 0, nil
+	}
+	var start uint64
+	err := eachPaste(ctx, g.db, ListOptions{Latest: true}, func(p Paste) error {
+		if n, ok := parseBase62(p.Path); ok && n >= start {
+			start = n + 1
+		}
+		return nil
+	})
+	return start, err
+}
+
+//formatBase62 returns n in base 62 padded with zeros to length
+func formatBase62(n uint64, length int) string {
+	var path []byte
+	for ; n > 0; n /= uint64(len(base62)) {
+		path = append(path, base62[n%uint64(len(base62))])
+	}
+	for len(path) < length || len(path) == 0 {
+		path = append(path, base62[0])
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return string(path)
+}
+
+//parseBase62 returns the number written in base 62 by formatBase62, ok is false if s is not a number
+func parseBase62(s string) (n uint64, ok bool) {
+	//The longer numbers overflow
+	if s == "" || len(s) > 10 {
+		return 0, false
+	}
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base62, s[i])
+		if digit < 0 {
+			return 0, false
+		}
+		n = n*uint64(len(base62)) + uint64(digit)
+	}
+	return n, true
+}
+
+//pathCreator creates the paths of the new pastes with a PathGenerator
+//The paths grow when creating one needs too many attempts
+type pathCreator struct {
+	gen PathGenerator
+	//growAfter is the number of collisions in a row after which the paths grow, 0 never grows
+	growAfter int
+	grow      int32
+}
+
+func newPathCreator(gen PathGenerator, growAfter int) *pathCreator {
+	return &pathCreator{gen: gen, growAfter: growAfter}
+}
+
+//create returns the first path generated that is reserved successfully
+func (c *pathCreator) create(ctx context.Context, reserve func(ctx context.Context, path string) (bool, error)) (string, error) {
+	collisions := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		grow := atomic.LoadInt32(&c.grow)
+		path, err := c.gen.Path(ctx, int(grow))
+		if err != nil {
+			return "", err
+		}
+
+		ok, err := reserve(ctx, path)
+		if errors.Is(err, errPathSkipped) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return path, nil
+		}
+
+		metricPathCollisions.Inc()
+		collisions++
+		if c.growAfter > 0 && collisions%c.growAfter == 0 {
+			atomic.CompareAndSwapInt32(&c.grow, grow, grow+1)
+		}
+	}
+}
+
+//createPastePath creates a free path for a new paste
+func (s Server) createPastePath(ctx context.Context) (string, error) {
+	return s.paths.create(ctx, s.db.ReservePath)
+}
+
+//reserveCustomPath validates and reserves a path chosen by the user
+func (s Server) reserveCustomPath(ctx context.Context, path string) error {
+	if err := s.validateCustomPath(path); err != nil {
+		return err
+	}
+
+	ok, err := s.reservePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPathUsed, path)
+	}
+	return nil
+}
+
+//reservePath reserves the path on the node of the cluster owning it, it returns false if the path is used or already reserved
+func (s Server) reservePath(ctx context.Context, path string) (bool, error) {
+	ok, err := s.db.ReservePath(ctx, path)
+	if errors.Is(err, errPathSkipped) && s.cluster != nil {
+		//The path is owned by another node of the cluster
+		ok, err = s.cluster.reserveOnOwner(ctx, path)
+	}
+	return ok, err
+}
+
+//validateCustomPath checks a path chosen by the user against the pattern and the reserved paths
+func (s Server) validateCustomPath(path string) error {
+	if s.customPath == nil {
+		return ErrPathDisabled
+	}
+	//The slash separates the path of a paste from its revision
+	if !s.customPath.MatchString(path) || strings.Contains(path, "/") {
+		return fmt.Errorf("%w: it must match %s", ErrPathNotValid, s.customPath)
+	}
+	for _, reserved := range s.cfg.CustomPaths.Reserved {
+		if strings.EqualFold(path, reserved) {
+			return fmt.Errorf("%w: %s", ErrPathReserved, path)
+		}
+	}
+	if s.routes.reserved(path) {
+		return fmt.Errorf("%w: %s", ErrPathReserved, path)
+	}
+	return nil
+}
+
+//routePrefixes are the first segments of the registered routes, the pastes cannot use them as path
+type routePrefixes struct {
+	mu       sync.RWMutex
+	prefixes map[string]bool
+}
+
+func newRoutePrefixes() *routePrefixes {
+	return &routePrefixes{prefixes: make(map[string]bool)}
+}
+
+//add adds the first segment of the pattern, the root pattern has none
+func (r *routePrefixes) add(pattern string) {
+	prefix := strings.SplitN(strings.TrimPrefix(pattern, "/"), "/", 2)[0]
+	if prefix == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prefixes[strings.ToLower(prefix)] = true
+}
+
+//reserved reports if the path is the prefix of a route
+func (r *routePrefixes) reserved(path string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.prefixes[strings.ToLower(path)]
+}
+
+//Words used by the default word list
+var (
+	pathAdjectives = []string{
+		"able", "bold", "brave", "bright", "calm", "clever", "cool", "cozy",
+		"curious", "daring", "eager", "fair", "fancy", "fast", "fierce", "fluffy",
+		"fresh", "friendly", "gentle", "giant", "glad", "golden", "grand", "happy",
+		"honest", "humble", "jolly", "kind", "lively", "lucky", "merry", "mighty",
+		"neat", "nice", "noble", "polite", "proud", "quick", "quiet", "rapid",
+		"rare", "shiny", "silent", "silly", "sleepy", "smart", "snappy", "solid",
+		"swift", "tidy", "tiny", "tough", "vivid", "warm", "wild", "wise",
+		"witty", "young", "zany", "zealous", "agile", "sunny", "misty", "steady",
+	}
+	pathAnimals = []string{
+		"badger", "bat", "bear", "beaver", "bee", "bison", "camel", "cat",
+		"cheetah", "cobra", "crab", "crane", "crow", "deer", "dingo", "dog",
+		"dolphin", "donkey", "dove", "duck", "eagle", "eel", "elk", "falcon",
+		"ferret", "finch", "fox", "frog", "gecko", "goat", "goose", "hare",
+		"hawk", "hedgehog", "heron", "horse", "ibis", "jackal", "koala", "lemur",
+		"lion", "llama", "lynx", "mole", "moose", "mouse", "newt", "otter",
+		"owl", "panda", "parrot", "puffin", "rabbit", "raven", "seal", "shark",
+		"sloth", "swan", "tiger", "toad", "turtle", "walrus", "whale", "wolf",
+	}
+)
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathGenerator(t *testing.T) {
+	dir := t.TempDir()
+	words := filepath.Join(dir, "words.txt")
+	if err := ioutil.WriteFile(words, []byte("red\n\nblue\n"), 0644); err != nil {
+		t.Fatalf("Could not write word list: %v", err)
+	}
+	badWords := filepath.Join(dir, "bad.txt")
+	if err := ioutil.WriteFile(badWords, []byte("red\n../etc\n"), 0644); err != nil {
+		t.Fatalf("Could not write word list: %v", err)
+	}
+
+	tt := []struct {
+		name    string
+		cfg     pathsConfig
+		grow    int
+		pattern string
+		err     bool
+	}{
+		{"Random", pathsConfig{Generator: PathsRandom}, 0, "^[a-zA-Z]{5}$", false},
+		{"Random grown", pathsConfig{Generator: PathsRandom}, 2, "^[a-zA-Z]{7}$", false},
+		{"Default", pathsConfig{}, 0, "^[a-zA-Z]{5}$", false},
+		{"Words", pathsConfig{Generator: PathsWords}, 0, "^[a-z]+-[a-z]+-[0-9]{1,2}$", false},
+		{"Words grown", pathsConfig{Generator: PathsWords}, 1, "^[a-z]+-[a-z]+-[0-9]{1,3}$", false},
+		{"Word list", pathsConfig{Generator: PathsWords, WordList: words}, 0, "^(red|blue)-(red|blue)-[0-9]{1,2}$", false},
+		{"Missing word list", pathsConfig{Generator: PathsWords, WordList: filepath.Join(dir, "missing")}, 0, "", true},
+		{"Bad word list", pathsConfig{Generator: PathsWords, WordList: badWords}, 0, "", true},
+		{"Sequential", pathsConfig{Generator: PathsSequential}, 0, "^00000$", false},
+		{"Unknown", pathsConfig{Generator: "unknown"}, 0, "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gen, err := newPathGenerator(tc.cfg, 5, nil)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expected error: %v; got: %v", tc.err, err)
+			}
+			if tc.err {
+				return
+			}
+			path, err := gen.Path(context.Background(), tc.grow)
+			if err != nil {
+				t.Fatalf("Could not generate path: %v", err)
+			}
+			if !regexp.MustCompile(tc.pattern).MatchString(path) {
+				t.Errorf("Expected: %s; got: %s", tc.pattern, path)
+			}
+		})
+	}
+}
+
+func TestSequentialPaths(t *testing.T) {
+	ctx := context.Background()
+	gen := &sequentialPaths{length: 2, next: 60}
+	expected := []string{"0Y", "0Z", "10", "11"}
+	for _, e := range expected {
+		path, _ := gen.Path(ctx, 0)
+		if path != e {
+			t.Errorf("Expected: %s; got: %s", e, path)
+		}
+	}
+
+	gen = &sequentialPaths{length: 0}
+	if path, _ := gen.Path(ctx, 0); path != "0" {
+		t.Errorf("Expected: 0; got: %s", path)
+	}
+}
+
+func TestSequentialPathsRestart(t *testing.T) {
+	ctx := context.Background()
+	tt := []struct {
+		name string
+		open func(t *testing.T) DatabaseV2
+		//shared is set for the databases keeping the counter
+		shared bool
+	}{
+		{"Memory", func(t *testing.T) DatabaseV2 { return AdaptDatabase(NewMemoryDB()) }, false},
+		{"SQLite", func(t *testing.T) DatabaseV2 {
+			db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "yep.db"))
+			if err != nil {
+				t.Fatalf("Could not open database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		}, true},
+		{"Redis", func(t *testing.T) DatabaseV2 { db, _ := newTestRedisDB(t); return db }, true},
+		{"S3", func(t *testing.T) DatabaseV2 { db, _ := newTestS3DB(t, false); return db }, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			db := tc.open(t)
+			//The pastes created before the restart, or loaded from a snapshot
+			for _, path := range []string{"00000", "00001", "00005", "brave-otter-42"} {
+				db.Store(ctx, path, Paste{Path: path, Source: "example paste", Created: time.Now()})
+			}
+
+			next := func() string {
+				gen, err := newPathGenerator(pathsConfig{Generator: PathsSequential}, 5, db)
+				if err != nil {
+					t.Fatalf("Could not create generator: %v", err)
+				}
+				path, err := gen.Path(ctx, 0)
+				if err != nil {
+					t.Fatalf("Could not generate path: %v", err)
+				}
+				return path
+			}
+			if path := next(); path != "00006" {
+				t.Errorf("Expected: 00006; got: %s", path)
+			}
+			if !tc.shared {
+				return
+			}
+			//The counter is kept by the database even if the path has not been used
+			if path := next(); path != "00007" {
+				t.Errorf("Expected: 00007; got: %s", path)
+			}
+		})
+	}
+}
+
+func TestPathCreator(t *testing.T) {
+	ctx := context.Background()
+	creator := newPathCreator(randomPaths{1}, 2)
+
+	//Only the paths with three letters are free
+	attempts := 0
+	path, err := creator.create(ctx, func(ctx context.Context, path string) (bool, error) {
+		attempts++
+		return len(path) == 3, nil
+	})
+	if err != nil || len(path) != 3 {
+		t.Fatalf("Expected: path of 3 letters; got: %q, %v", path, err)
+	}
+	if attempts != 5 {
+		t.Errorf("Expected: 5 attempts; got: %d", attempts)
+	}
+	if creator.grow != 2 {
+		t.Errorf("Expected: grown 2 times; got: %d", creator.grow)
+	}
+
+	//Skipped paths are not collisions
+	skipped := 0
+	path, err = creator.create(ctx, func(ctx context.Context, path string) (bool, error) {
+		if skipped < 10 {
+			skipped++
+			return false, errPathSkipped
+		}
+		return true, nil
+	})
+	if err != nil || len(path) != 3 {
+		t.Errorf("Expected: path of 3 letters; got: %q, %v", path, err)
+	}
+
+	failure := errors.New("failure")
+	if _, err := creator.create(ctx, func(ctx context.Context, path string) (bool, error) { return false, failure }); err != failure {
+		t.Errorf("Expected: %v; got: %v", failure, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := creator.create(cancelled, func(ctx context.Context, path string) (bool, error) { return false, nil }); err != context.Canceled {
+		t.Errorf("Expected: %v; got: %v", context.Canceled, err)
+	}
+}
+
+func TestValidateCustomPath(t *testing.T) {
+	cfg := defaultCfg
+	cfg.CustomPaths = customPathsConfig{Pattern: "[a-z-]{3,10}", Reserved: []string{"admin"}}
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/api/new", handleAPINewPaste)
+	s.handleRoute("/", handleHome)
+
+	tt := []struct {
+		path string
+		err  error
+	}{
+		{"deploy", nil},
+		{"de", ErrPathNotValid},
+		{"deploy-runbook", ErrPathNotValid},
+		{"x/deploy", ErrPathNotValid},
+		{"admin", ErrPathReserved},
+		{"ADMIN", ErrPathNotValid},
+		{"api", ErrPathReserved},
+	}
+	for _, tc := range tt {
+		if err := s.validateCustomPath(tc.path); !errors.Is(err, tc.err) {
+			t.Errorf("Validate %s: expected: %v; got: %v", tc.path, tc.err, err)
+		}
+	}
+
+	cfg.CustomPaths.Pattern = ""
+	s = NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	if err := s.validateCustomPath("deploy"); err != ErrPathDisabled {
+		t.Errorf("Expected: %v; got: %v", ErrPathDisabled, err)
+	}
+}
+
+//unavailableDB is a database failing the reservations like an unreachable server
+type unavailableDB struct{ DatabaseV2 }
+
+func (unavailableDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	return false, fmt.Errorf("%w: dial tcp 10.0.0.1:6379: connection refused", ErrDatabaseUnavailable)
+}
+
+func TestPostPastePath(t *testing.T) {
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	db := AdaptDatabase(NewMemoryDB())
+	db.Store(context.Background(), "used", Paste{Path: "used", Source: "used"})
+
+	tt := []struct {
+		name string
+		db   DatabaseV2
+		path string
+		code int
+	}{
+		{"Created", db, "created", http.StatusFound},
+		{"Used", db, "used", http.StatusConflict},
+		{"Not valid", db, "../etc", http.StatusBadRequest},
+		{"Unavailable", unavailableDB{db}, "", http.StatusServiceUnavailable},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer(tc.db, cfg)
+			defer s.Close()
+			s.handleRoute("/", handleHome)
+
+			form := url.Values{"code": {"example paste"}, "expire": {getExpireTime(t)}, "path": {tc.path}}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, req)
+			if res.Code != tc.code {
+				t.Errorf("Expected: %d; got: %d\n%s", tc.code, res.Code, res.Body)
+			}
+			if strings.Contains(res.Body.String(), "10.0.0.1") {
+				t.Errorf("Internal error shown to the user: %s", res.Body)
+			}
+		})
+	}
+}
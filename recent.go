@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//recentSummaryLen is the number of bytes of the source shown in the feeds
+const recentSummaryLen = 280
+
+//recentFeed is a feed format of /recent
+type recentFeed struct {
+	path        string
+	contentType string
+	write       func(w http.ResponseWriter, feed recentPage) error
+}
+
+//recentFeeds are the feeds served under /recent/
+var recentFeeds = []recentFeed{
+	{"/recent/rss", "application/rss+xml; charset=utf-8", writeRSS},
+	{"/recent/atom", "application/atom+xml; charset=utf-8", writeAtom},
+	{"/recent/json", "application/feed+json; charset=utf-8", writeJSONFeed},
+}
+
+//recentPaste is a paste of /recent
+type recentPaste struct {
+	Paste
+	URL              string
+	Summary          string
+	CreatedFormatted string
+}
+
+//recentPage is the data of /recent and of its feeds
+type recentPage struct {
+	Header string
+	Langs  []string
+	//Lang is the language selected, empty for every language
+	Lang string
+	//Query is the query string selecting the language, it is added to the links of the feeds
+	Query   string
+	BaseURL string
+	Pastes  []recentPaste
+}
+
+//recentPastes returns the latest public pastes, the newest first
+//The pastes are listed newest first, so only the first page is read
+func recentPastes(s Server, req *http.Request, lang string) ([]Paste, error) {
+	now := time.Now()
+	opts := ListOptions{Visibility: VisibilityPublic, Lang: lang, Latest: true, Reverse: true, Limit: s.cfg.RecentPastes}
+	var pastes []Paste
+	for {
+		page, cursor, err := s.db.List(req.Context(), opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page {
+			//The expired pastes can be listed until they are deleted
+			if len(pastes) < s.cfg.RecentPastes && (!p.Expires() || p.Expire.After(now)) {
+				pastes = append(pastes, p)
+			}
+		}
+		if len(pastes) == s.cfg.RecentPastes || cursor == "" {
+			return pastes, nil
+		}
+		opts.Cursor = cursor
+	}
+}
+
+//requestBaseURL returns the URL of the server as seen by the client
+func requestBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+//summary returns the beginning of the source of the paste
+func summary(source string) string {
+	if len(source) <= recentSummaryLen {
+		return source
+	}
+	cut := recentSummaryLen
+	//Do not cut a multi-byte character
+	for cut > 0 && source[cut]&0xC0 == 0x80 {
+		cut--
+	}
+	return source[:cut] + "…"
+}
+
+//Handle: /recent, /recent/rss, /recent/atom, /recent/json
+//The query parameter lang selects the pastes of a language
+func handleRecent(s Server, w http.ResponseWriter, req *http.Request) {
+	var feed *recentFeed
+	for i := range recentFeeds {
+		if req.URL.Path == recentFeeds[i].path {
+			feed = &recentFeeds[i]
+		}
+	}
+	if feed == nil && req.URL.Path != "/recent" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Not found")
+		return
+	}
+
+	lang := req.URL.Query().Get("lang")
+	pastes, err := recentPastes(s, req, lang)
+	if err != nil {
+		handleDatabaseError(s, w, req, "/recent", err)
+		return
+	}
+
+	page := recentPage{
+		Header:  s.cfg.Header,
+		Langs:   getLanguages(),
+		Lang:    lang,
+		BaseURL: requestBaseURL(req),
+		Pastes:  make([]recentPaste, len(pastes)),
+	}
+	if lang != "" {
+		page.Query = "?" + url.Values{"lang": {lang}}.Encode()
+	}
+	for i, p := range pastes {
+		page.Pastes[i] = recentPaste{
+			Paste:            p,
+			URL:              page.BaseURL + "/" + url.PathEscape(p.Path),
+			Summary:          summary(p.Source),
+			CreatedFormatted: p.Created.Format(s.cfg.TimeFormat),
+		}
+	}
+
+	if feed != nil {
+		w.Header().Set("Content-Type", feed.contentType)
+		if err := feed.write(w, page); err != nil {
+			s.logger(req).Warn("Cannot write feed", "feed", feed.path, "error", err)
+		}
+		return
+	}
+
+	t, err := getTemplate(s.cfg.AssetsDir, "recent")
+	if err != nil {
+		s.logger(req).Error("Cannot get template", "template", "recent", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+	if err := t.Execute(w, page); err != nil {
+		s.logger(req).Error("Cannot execute template", "template", "recent", "error", err)
+	}
+}
+
+//title returns the title of the paste in the feeds
+func (p recentPaste) title() string {
+	return fmt.Sprintf("%s paste by %s", p.Lang, p.User)
+}
+
+//feedTitle returns the title of the feeds
+func (page recentPage) feedTitle() string {
+	if page.Lang == "" {
+		return page.Header + ": recent pastes"
+	}
+	return page.Header + ": recent " + page.Lang + " pastes"
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	//DC is the namespace of the Dublin Core elements, used for the authors
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	Author      string `xml:"dc:creator"`
+	Category    string `xml:"category"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+//writeRSS writes the pastes as RSS 2.0
+func writeRSS(w http.ResponseWriter, page recentPage) error {
+	feed := rssFeed{
+		Version: "2.0",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       page.feedTitle(),
+			Link:        page.BaseURL + "/recent" + page.Query,
+			Description: "The latest public pastes",
+		},
+	}
+	for _, p := range page.Pastes {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       p.title(),
+			Link:        p.URL,
+			GUID:        p.URL,
+			Author:      p.User,
+			Category:    p.Lang,
+			PubDate:     p.Created.UTC().Format(time.RFC1123Z),
+			Description: p.Summary,
+		})
+	}
+	return writeXML(w, feed)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string       `xml:"title"`
+	ID        string       `xml:"id"`
+	Link      atomLink     `xml:"link"`
+	Updated   string       `xml:"updated"`
+	Published string       `xml:"published"`
+	Author    atomAuthor   `xml:"author"`
+	Category  atomCategory `xml:"category"`
+	Summary   string       `xml:"summary"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+//writeAtom writes the pastes as Atom
+func writeAtom(w http.ResponseWriter, page recentPage) error {
+	self := page.BaseURL + "/recent/atom" + page.Query
+	feed := atomFeed{
+		Title: page.feedTitle(),
+		ID:    self,
+		Links: []atomLink{
+			{Href: self, Rel: "self"},
+			{Href: page.BaseURL + "/recent" + page.Query},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(page.Pastes) > 0 {
+		feed.Updated = page.Pastes[0].Created.UTC().Format(time.RFC3339)
+	}
+	for _, p := range page.Pastes {
+		created := p.Created.UTC().Format(time.RFC3339)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     p.title(),
+			ID:        p.URL,
+			Link:      atomLink{Href: p.URL},
+			Updated:   created,
+			Published: created,
+			Author:    atomAuthor{p.User},
+			Category:  atomCategory{p.Lang},
+			Summary:   p.Summary,
+		})
+	}
+	return writeXML(w, feed)
+}
+
+//writeXML writes v with the XML header
+func writeXML(w http.ResponseWriter, v interface{}) error {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append([]byte(xml.Header), out...))
+	return err
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentText   string           `json:"content_text"`
+	DatePublished string           `json:"date_published"`
+	Authors       []jsonFeedAuthor `json:"authors"`
+	Tags          []string         `json:"tags"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+//writeJSONFeed writes the pastes as JSON Feed 1.1
+func writeJSONFeed(w http.ResponseWriter, page recentPage) error {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       page.feedTitle(),
+		HomePageURL: page.BaseURL + "/recent" + page.Query,
+		FeedURL:     page.BaseURL + "/recent/json" + page.Query,
+		Items:       []jsonFeedItem{},
+	}
+	for _, p := range page.Pastes {
+		feed.Items = append(feed.Items, jsonFeedItem{
+			ID:            p.URL,
+			URL:           p.URL,
+			Title:         p.title(),
+			ContentText:   p.Summary,
+			DatePublished: p.Created.UTC().Format(time.RFC3339),
+			Authors:       []jsonFeedAuthor{{p.User}},
+			Tags:          []string{p.Lang},
+		})
+	}
+	return json.NewEncoder(w).Encode(feed)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecent(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.RecentPastes = 2
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/recent", handleRecent)
+	s.handleRoute("/recent/", handleRecent)
+
+	start := time.Now().Add(-time.Hour)
+	pastes := []Paste{
+		{Path: "old", User: "alice", Lang: "Go", Visibility: VisibilityPublic, Source: "package old"},
+		{Path: "python", User: "bob", Lang: "Python", Visibility: VisibilityPublic, Source: "print('hi')"},
+		{Path: "unlisted", User: "carl", Lang: "Go", Source: "package unlisted"},
+		{Path: "private", User: "dan", Lang: "Go", Visibility: VisibilityPrivate, Owner: "owner", Source: "package private"},
+		{Path: "new", User: "eve", Lang: "Go", Visibility: VisibilityPublic, Source: "package new <b>"},
+		{Path: "expired", User: "frank", Lang: "Go", Visibility: VisibilityPublic, Source: "package expired", Expire: time.Now().Add(-time.Minute)},
+	}
+	for i, p := range pastes {
+		p.Created = start.Add(time.Duration(i) * time.Minute)
+		if err := s.db.Store(ctx, p.Path, p); err != nil {
+			t.Fatalf("Could not store paste: %v", err)
+		}
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, httptest.NewRequest(http.MethodGet, target, nil))
+		if res.Code != http.StatusOK {
+			t.Fatalf("Expected: %d; got: %d", http.StatusOK, res.Code)
+		}
+		return res
+	}
+
+	tt := []struct {
+		name  string
+		query string
+		paths []string
+	}{
+		{"All", "", []string{"new", "python"}},
+		{"Lang", "?lang=Go", []string{"new", "old"}},
+		{"Lang without pastes", "?lang=Rust", nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var rss struct {
+				Items []struct {
+					Link   string `xml:"link"`
+					Author string `xml:"creator"`
+				} `xml:"channel>item"`
+			}
+			res := get("/recent/rss" + tc.query)
+			if err := xml.Unmarshal(res.Body.Bytes(), &rss); err != nil {
+				t.Fatalf("Could not decode RSS: %v", err)
+			}
+			var atom struct {
+				Entries []struct {
+					ID string `xml:"id"`
+				} `xml:"entry"`
+			}
+			if err := xml.Unmarshal(get("/recent/atom"+tc.query).Body.Bytes(), &atom); err != nil {
+				t.Fatalf("Could not decode Atom: %v", err)
+			}
+			var feed jsonFeed
+			if err := json.Unmarshal(get("/recent/json"+tc.query).Body.Bytes(), &feed); err != nil {
+				t.Fatalf("Could not decode JSON Feed: %v", err)
+			}
+			page := get("/recent" + tc.query).Body.String()
+
+			if len(rss.Items) != len(tc.paths) || len(atom.Entries) != len(tc.paths) || len(feed.Items) != len(tc.paths) {
+				t.Fatalf("Expected: %v; got: %d, %d, %d items", tc.paths, len(rss.Items), len(atom.Entries), len(feed.Items))
+			}
+			for i, path := range tc.paths {
+				url := "http://example.com/" + path
+				if rss.Items[i].Link != url || atom.Entries[i].ID != url || feed.Items[i].URL != url {
+					t.Errorf("Expected: %s; got: %s, %s, %s", url, rss.Items[i].Link, atom.Entries[i].ID, feed.Items[i].URL)
+				}
+				if !strings.Contains(page, `href="/`+path+`"`) {
+					t.Errorf("Expected: %s in the page", path)
+				}
+			}
+		})
+	}
+
+	if res := get("/recent/json"); !strings.Contains(res.Body.String(), `"name":"eve"`) {
+		t.Errorf("Expected: author eve; got: %s", res.Body)
+	}
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/recent/xml", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected: %d; got: %d", http.StatusNotFound, res.Code)
+	}
+}
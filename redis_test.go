@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisDB(t *testing.T) (*RedisDB, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	db, err := NewRedisDB("redis://"+mr.Addr(), "yep:")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mr
+}
+
+func TestRedisDB(t *testing.T) {
+	ctx := context.Background()
+	db, mr := newTestRedisDB(t)
+	now := time.Now().Round(0)
+
+	paste := Paste{Path: "test", User: "user", UserID: "id", Owner: "owner", Lang: "Go", Source: "package main\xff", Style: "body{}", Content: "<h1>test</h1>", Encoding: CompressionGzip, Created: now, Expire: now.Add(time.Hour)}
+	if err := db.Store(ctx, paste.Path, paste); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	db.Store(ctx, "never", Paste{Path: "never", Source: "never expires", Created: now})
+
+	got, err := db.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not get paste: %v", err)
+	}
+	if got.Path != paste.Path || got.User != paste.User || got.UserID != paste.UserID || got.Owner != paste.Owner || got.Lang != paste.Lang || got.Source != paste.Source || got.Style != paste.Style ||
+		got.Content != paste.Content || got.Encoding != paste.Encoding || !got.Created.Equal(paste.Created) || !got.Expire.Equal(paste.Expire) {
+		t.Errorf("Wrong paste: expected: %+v; got: %+v", paste, got)
+	}
+	if ttl := mr.TTL("yep:paste:test"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Wrong TTL: %v", ttl)
+	}
+	if ttl := mr.TTL("yep:paste:never"); ttl != 0 {
+		t.Errorf("Paste expires: %v", ttl)
+	}
+
+	t.Run("Expire", func(t *testing.T) {
+		mr.SetTime(now.Add(2 * time.Hour))
+		mr.FastForward(2 * time.Hour)
+		if _, err := db.Get(ctx, "test"); !errors.Is(err, ErrDatabaseNotFound) {
+			t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+		}
+		stats, err := db.Stats(ctx)
+		if err != nil || stats.Count != 1 {
+			t.Errorf("Wrong stats: %+v, %v", stats, err)
+		}
+		if members, _ := mr.ZMembers("yep:created"); len(members) != 1 {
+			t.Errorf("Index not cleaned: %v", members)
+		}
+	})
+
+	t.Run("Reserve", func(t *testing.T) {
+		path := "reserved"
+		if ok, err := db.ReservePath(ctx, path); !ok || err != nil {
+			t.Fatalf("Could not reserve path: %v, %v", ok, err)
+		}
+		if ok, err := db.ReservePath(ctx, path); ok || err != nil {
+			t.Errorf("Path reserved twice: %v, %v", ok, err)
+		}
+		if _, err := db.Get(ctx, path); !errors.Is(err, ErrDatabaseNotFound) {
+			t.Errorf("Reserved path found: %v", err)
+		}
+		if reserved, _ := db.client.SetNX(ctx, db.pasteKey(path), "", time.Minute).Result(); reserved {
+			t.Errorf("Path not reserved")
+		}
+		mr.FastForward(pathReserveTime)
+		if !mr.Exists("yep:paste:never") || mr.Exists(db.pasteKey(path)) {
+			t.Errorf("Reservation not expired")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := db.Delete(ctx, "never"); err != nil {
+			t.Fatalf("Could not delete paste: %v", err)
+		}
+		if _, err := db.Get(ctx, "never"); !errors.Is(err, ErrDatabaseNotFound) {
+			t.Errorf("Paste not deleted")
+		}
+		if members, _ := mr.ZMembers("yep:created"); len(members) != 0 {
+			t.Errorf("Index not cleaned: %v", members)
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		mr.Close()
+		if _, err := db.Get(ctx, "never"); !errors.Is(err, ErrDatabaseUnavailable) {
+			t.Errorf("Expected: %v; got: %v", ErrDatabaseUnavailable, err)
+		}
+	})
+}
+
+func TestRedisDBConcurrentStore(t *testing.T) {
+	ctx := context.Background()
+	db, mr := newTestRedisDB(t)
+	start := time.Now()
+
+	//At least one transaction succeeds every time, so the writers are less than the retries
+	var wg sync.WaitGroup
+	for i := 0; i < redisMaxRetries-2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := Paste{Path: "test", Owner: "owner" + strconv.Itoa(i), Source: strings.Repeat("a", i+1), Created: start.Add(time.Duration(i) * time.Minute)}
+			if err := db.Store(ctx, p.Path, p); err != nil {
+				t.Errorf("Could not store paste: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	p, err := db.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not get paste: %v", err)
+	}
+	expected := []string{indexMember(p.Created, "test")}
+	if members, _ := mr.ZMembers("yep:created"); !reflect.DeepEqual(members, expected) {
+		t.Errorf("Expected: %v; got: %v", expected, members)
+	}
+	if members, _ := mr.ZMembers("yep:owner:" + p.Owner); !reflect.DeepEqual(members, expected) {
+		t.Errorf("Expected: %v; got: %v", expected, members)
+	}
+	if stats, err := db.Stats(ctx); err != nil || stats.Count != 1 || stats.Size != int64(len(p.Source)) {
+		t.Errorf("Expected: 1 paste of %d bytes; got: %+v, %v", len(p.Source), stats, err)
+	}
+}
+
+func TestRedisDBCountPastes(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	//Pastes stored before the counters
+	now := time.Now()
+	for _, name := range []string{"first", "second"} {
+		mr.Set("yep:paste:"+name, `{"Source":"`+base64.StdEncoding.EncodeToString([]byte("code"))+`"}`)
+		mr.ZAdd("yep:created", 0, indexMember(now, name))
+	}
+
+	db, err := NewRedisDB("redis://"+mr.Addr(), "yep:")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer db.Close()
+	if stats, err := db.Stats(ctx); err != nil || stats.Count != 2 || stats.Size != 8 {
+		t.Errorf("Expected: 2 pastes of 8 bytes; got: %+v, %v", stats, err)
+	}
+
+	db.Store(ctx, "first", Paste{Path: "first", Source: "longer code", Created: now})
+	db.Delete(ctx, "second")
+	if stats, err := db.Stats(ctx); err != nil || stats.Count != 1 || stats.Size != 11 {
+		t.Errorf("Expected: 1 paste of 11 bytes; got: %+v, %v", stats, err)
+	}
+}
+
+func TestRedisDBList(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestRedisDB(t)
+	start := time.Now()
+	for i := 0; i < 250; i++ {
+		lang := "Go"
+		if i%2 == 1 {
+			lang = "Python"
+		}
+		path := "paste" + strconv.Itoa(i)
+		p := Paste{Path: path, User: "user", Lang: lang, Source: "code", Created: start.Add(time.Duration(i) * time.Minute)}
+		if i%3 == 0 {
+			p.Owner = "owner"
+		}
+		if i == 4 {
+			p.UserID = "id"
+		}
+		if i%4 == 0 {
+			p.Visibility = VisibilityPublic
+		}
+		db.Store(ctx, path, p)
+	}
+
+	tm := []struct {
+		name  string
+		opts  ListOptions
+		count int
+	}{
+		{"All", ListOptions{}, 250},
+		{"Lang", ListOptions{Lang: "Python"}, 125},
+		{"Created", ListOptions{Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute)}, 3},
+		{"Reverse created", ListOptions{Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute), Reverse: true}, 3},
+		{"User", ListOptions{User: "other"}, 0},
+		{"Owner", ListOptions{Owner: "owner"}, 84},
+		{"UserID", ListOptions{UserID: "id"}, 1},
+		{"Public", ListOptions{Visibility: VisibilityPublic}, 63},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			var pastes []Paste
+			err := eachPaste(ctx, db, tt.opts, func(p Paste) error {
+				pastes = append(pastes, p)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			if len(pastes) != tt.count {
+				t.Fatalf("Wrong number of pastes: expected: %d; got: %d", tt.count, len(pastes))
+			}
+			for i := 1; i < len(pastes); i++ {
+				if !tt.opts.before(pastes[i-1], pastes[i]) {
+					t.Errorf("Pastes not sorted: %s before %s", pastes[i-1].Path, pastes[i].Path)
+				}
+			}
+		})
+	}
+
+	t.Run("Limit", func(t *testing.T) {
+		pastes, cursor, err := db.List(ctx, ListOptions{Limit: 4})
+		if err != nil || len(pastes) != 4 || cursor == "" {
+			t.Errorf("Wrong page: %d pastes, cursor: %q, %v", len(pastes), cursor, err)
+		}
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		var paths []string
+		opts := ListOptions{Limit: 3, Reverse: true, Since: start.Add(time.Minute)}
+		for {
+			pastes, cursor, err := db.List(ctx, opts)
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			for _, p := range pastes {
+				paths = append(paths, p.Path)
+			}
+			if cursor == "" {
+				break
+			}
+			opts.Cursor = cursor
+		}
+		if len(paths) != 249 || paths[0] != "paste249" || paths[len(paths)-1] != "paste1" {
+			t.Errorf("Wrong pastes: %v", paths)
+		}
+		for i := 1; i < len(paths); i++ {
+			if paths[i-1] == paths[i] {
+				t.Errorf("Paste listed twice: %s", paths[i])
+			}
+		}
+	})
+}
+
+func TestRedisServerExpire(t *testing.T) {
+	db, _ := newTestRedisDB(t)
+	server := NewServer(db, defaultCfg)
+	defer server.Close()
+
+	paste := Paste{Path: "test", Source: "test", Created: time.Now(), Expire: time.Now().Add(time.Hour)}
+	server.scheduleExpire(paste)
+	if len(server.timers.timers) != 0 {
+		t.Errorf("Timer scheduled for a Redis paste")
+	}
+}
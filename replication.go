@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Errors declaration for the replication
+var (
+	ErrReplicaReadOnly     = fmt.Errorf("%w: the instance is a read-only replica", ErrDatabaseUnavailable)
+	ErrReplicationOffset   = fmt.Errorf("Replication offset not available")
+	ErrReplicationSecret   = fmt.Errorf("Replication secret not valid")
+	ErrReplicationPrimary  = fmt.Errorf("The instance is already the primary")
+	ErrReplicationStreamed = fmt.Errorf("Replication stream closed")
+	ErrReplicationSnapshot = fmt.Errorf("Replication snapshot not complete")
+)
+
+//Operations of the replication log
+const (
+	replicationStore  = "store"
+	replicationDelete = "delete"
+)
+
+//replicationSecretHeader is the header with the secret shared by the primary and its followers
+const replicationSecretHeader = "X-Replication-Secret"
+
+//replicationPastesTrailer is the trailer of a snapshot with the number of pastes sent, it is not sent if the snapshot failed
+const replicationPastesTrailer = "X-Replication-Pastes"
+
+//replicationHeartbeat is the interval between two empty entries sent to an idle follower
+//A follower receiving nothing for three intervals reconnects
+const replicationHeartbeat = 10 * time.Second
+
+//replicationRetry is the time waited by a follower before reconnecting
+const replicationRetry = time.Second
+
+//replicationEntry is an operation of the replication log, an entry without operation is a heartbeat
+type replicationEntry struct {
+	Offset uint64
+	Op     string `json:",omitempty"`
+	Path   string `json:",omitempty"`
+	Paste  *Paste `json:",omitempty"`
+}
+
+//replicationHeader is the first line of a snapshot sent to a follower
+type replicationHeader struct {
+	ID     string
+	Offset uint64
+}
+
+//replicationLog keeps the last operations for the followers
+//The ID changes when the log is not the continuation of the previous one, the followers must then load a snapshot
+type replicationLog struct {
+	mu      sync.Mutex
+	id      string
+	entries []replicationEntry
+	next    uint64
+	size    int
+	//changed is closed when an entry is appended
+	changed chan struct{}
+}
+
+func newReplicationLog(size int) *replicationLog {
+	return &replicationLog{id: newRequestID(), size: size, changed: make(chan struct{})}
+}
+
+//append adds an operation to the log
+func (l *replicationLog) append(op, path string, paste *Paste) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, replicationEntry{Offset: l.next, Op: op, Path: path, Paste: paste})
+	if len(l.entries) > l.size {
+		l.entries = append(l.entries[:0:0], l.entries[len(l.entries)-l.size:]...)
+	}
+	l.next++
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+//reset empties the log, the next entry has the offset
+func (l *replicationLog) reset(id string, offset uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.id = id
+	l.entries = nil
+	l.next = offset
+}
+
+//position returns the ID of the log and the offset of the next entry
+func (l *replicationLog) position() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id, l.next
+}
+
+//since returns the entries starting from offset and a channel closed when new entries are appended
+func (l *replicationLog) since(id string, offset uint64) ([]replicationEntry, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	first := l.next - uint64(len(l.entries))
+	if id != l.id || offset < first || offset > l.next {
+		return nil, nil, ErrReplicationOffset
+	}
+	entries := append([]replicationEntry(nil), l.entries[offset-first:]...)
+	return entries, l.changed, nil
+}
+
+//replicaDB is a Database wrapper replicating the writes to the followers
+//While following a primary the writes are rejected, the operations of the primary are applied instead
+type replicaDB struct {
+	db     DatabaseV2
+	log    *replicationLog
+	secret string
+	client *http.Client
+	logger *slog.Logger
+
+	//mu serializes the writes so they are applied in the order of the log
+	mu        sync.Mutex
+	primary   string
+	stop      chan struct{}
+	done      chan struct{}
+	streaming chan struct{}
+}
+
+//newReplicaDB wraps db, if primary is not empty the instance follows it
+func newReplicaDB(db DatabaseV2, cfg replicationConfig, logger *slog.Logger) *replicaDB {
+	if cfg.LogSize < 1 {
+		cfg.LogSize = 1
+	}
+	return &replicaDB{
+		db:        db,
+		log:       newReplicationLog(cfg.LogSize),
+		secret:    cfg.Secret,
+		client:    &http.Client{},
+		logger:    logger,
+		primary:   cfg.Primary,
+		streaming: make(chan struct{}),
+	}
+}
+
+//following reports if the instance is following a primary
+func (db *replicaDB) following() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.primary != ""
+}
+
+//Get implements DatabaseV2
+func (db *replicaDB) Get(ctx context.Context, name string) (Paste, error) {
+	return db.db.Get(ctx, name)
+}
+
+//GetEncoded implements encodedDatabase
+func (db *replicaDB) GetEncoded(ctx context.Context, name string) (Paste, error) {
+	if edb, ok := db.db.(encodedDatabase); ok {
+		return edb.GetEncoded(ctx, name)
+	}
+	return db.db.Get(ctx, name)
+}
+
+//Store implements DatabaseV2
+func (db *replicaDB) Store(ctx context.Context, name string, value Paste) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.primary != "" {
+		return ErrReplicaReadOnly
+	}
+	return db.store(ctx, name, value)
+}
+
+func (db *replicaDB) store(ctx context.Context, name string, value Paste) error {
+	if err := db.db.Store(ctx, name, value); err != nil {
+		return err
+	}
+	db.log.append(replicationStore, name, &value)
+	return nil
+}
+
+//Delete implements DatabaseV2
+func (db *replicaDB) Delete(ctx context.Context, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.primary != "" {
+		return ErrReplicaReadOnly
+	}
+	return db.delete(ctx, name)
+}
+
+func (db *replicaDB) delete(ctx context.Context, name string) error {
+	if err := db.db.Delete(ctx, name); err != nil {
+		return err
+	}
+	db.log.append(replicationDelete, name, nil)
+	return nil
+}
+
+//ReservePath implements DatabaseV2
+func (db *replicaDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	if db.following() {
+		return false, ErrReplicaReadOnly
+	}
+	return db.db.ReservePath(ctx, path)
+}
+
+//List implements DatabaseV2
+func (db *replicaDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	return db.db.List(ctx, opts)
+}
+
+//Stats implements DatabaseV2
+func (db *replicaDB) Stats(ctx context.Context) (DatabaseStats, error) { return db.db.Stats(ctx) }
+
+//ExpiresPastes implements expiringDatabase
+//A follower receives the deletions of the expired pastes from the primary
+func (db *replicaDB) ExpiresPastes() bool { return db.following() || expiresPastes(db.db) }
+
+//Close implements DatabaseV2
+func (db *replicaDB) Close() error {
+	db.stopFollowing()
+	db.stopStreams()
+	return db.db.Close()
+}
+
+//stopStreams ends the streams sent to the followers
+func (db *replicaDB) stopStreams() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	select {
+	case <-db.streaming:
+	default:
+		close(db.streaming)
+	}
+}
+
+//startFollowing applies the operations of the primary until the instance is promoted or closed
+func (db *replicaDB) startFollowing() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.primary == "" || db.stop != nil {
+		return
+	}
+
+	db.stop = make(chan struct{})
+	db.done = make(chan struct{})
+	go db.follow(db.primary, db.stop, db.done)
+}
+
+//stopFollowing stops applying the operations of the primary
+func (db *replicaDB) stopFollowing() {
+	db.mu.Lock()
+	stop, done := db.stop, db.done
+	db.stop, db.done = nil, nil
+	db.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (db *replicaDB) follow(primary string, stop, done chan struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		err := db.stream(ctx, primary)
+		if errors.Is(err, ErrReplicationOffset) {
+			err = db.catchUp(ctx, primary)
+			if err == nil {
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		db.logger.Warn("Replication interrupted", "primary", primary, "error", err)
+
+		select {
+		case <-time.After(replicationRetry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+//request sends a request to the primary
+func (db *replicaDB) request(ctx context.Context, primary, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(primary, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(replicationSecretHeader, db.secret)
+	res, err := db.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusGone:
+		res.Body.Close()
+		return nil, ErrReplicationOffset
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	return nil, fmt.Errorf("Primary %s: %s: %s", primary, res.Status, strings.TrimSpace(string(msg)))
+}
+
+//stream applies the operations of the primary starting from the current offset
+func (db *replicaDB) stream(ctx context.Context, primary string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	id, offset := db.log.position()
+	res, err := db.request(ctx, primary, "/api/replication/stream?id="+url.QueryEscape(id)+"&offset="+strconv.FormatUint(offset, 10))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	//Reconnect if the primary stops sending the heartbeats
+	idle := time.AfterFunc(3*replicationHeartbeat, cancel)
+	defer idle.Stop()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var entry replicationEntry
+		if err := dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return ErrReplicationStreamed
+			}
+			return err
+		}
+		idle.Reset(3 * replicationHeartbeat)
+		if entry.Op == "" {
+			continue
+		}
+		if err := db.apply(ctx, entry); err != nil {
+			return err
+		}
+	}
+}
+
+//apply applies an operation of the primary
+func (db *replicaDB) apply(ctx context.Context, entry replicationEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, offset := db.log.position(); entry.Offset != offset {
+		return ErrReplicationOffset
+	}
+	switch entry.Op {
+	case replicationStore:
+		if entry.Paste == nil {
+			return fmt.Errorf("Replication entry without paste: %d", entry.Offset)
+		}
+		return db.store(ctx, entry.Path, *entry.Paste)
+	case replicationDelete:
+		return db.delete(ctx, entry.Path)
+	}
+	return fmt.Errorf("Unknown replication operation: %s", entry.Op)
+}
+
+//catchUp replaces the pastes with a snapshot of the primary
+func (db *replicaDB) catchUp(ctx context.Context, primary string) error {
+	res, err := db.request(ctx, primary, "/api/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(res.Body))
+	var header replicationHeader
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	//The local pastes are replaced one at a time, the ones not in the snapshot are deleted only after reading all of it
+	//so an interrupted snapshot leaves the pastes loaded until then with the old ones
+	loaded := make(map[string]bool)
+	received := 0
+	for {
+		var p Paste
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := db.db.Store(ctx, p.Path, p); err != nil {
+			return err
+		}
+		loaded[p.Path] = true
+		received++
+	}
+	//The trailer is read after the body, it is missing if the primary failed sending the pastes
+	if sent := res.Trailer.Get(replicationPastesTrailer); sent != strconv.Itoa(received) {
+		return fmt.Errorf("%w: %d pastes received, %q sent", ErrReplicationSnapshot, received, sent)
+	}
+
+	var old []string
+	err = eachPaste(ctx, db.db, ListOptions{}, func(p Paste) error {
+		if !loaded[p.Path] {
+			old = append(old, p.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range old {
+		if err := db.db.Delete(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	db.log.reset(header.ID, header.Offset)
+	db.logger.Info("Loaded snapshot of the primary", "primary", primary, "pastes", len(loaded), "deleted", len(old), "offset", header.Offset)
+	return nil
+}
+
+//promote stops following the primary and accepts the writes
+//The log gets a new ID so the followers of this instance load a snapshot
+func (db *replicaDB) promote() error {
+	if !db.following() {
+		return ErrReplicationPrimary
+	}
+	db.stopFollowing()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.primary = ""
+	_, offset := db.log.position()
+	db.log.reset(newRequestID(), offset)
+	return nil
+}
+
+//handleReplicationRoutes registers the routes used by the followers
+func (s *Server) handleReplicationRoutes() {
+	s.handleRoute("/api/replication/stream", handleReplicationStream)
+	s.handleRoute("/api/replication/snapshot", handleReplicationSnapshot)
+	s.handleRoute("/api/replication/promote", handleReplicationPromote)
+}
+
+//checkReplicationSecret writes an error if the request is not sent by a follower
+func checkReplicationSecret(s Server, w http.ResponseWriter, req *http.Request) bool {
+	secret := req.Header.Get(replicationSecretHeader)
+	if s.replica == nil || subtle.ConstantTimeCompare([]byte(secret), []byte(s.replica.secret)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, ErrReplicationSecret)
+		return false
+	}
+	return true
+}
+
+//Handle: /api/replication/stream?id=ID&offset=OFFSET GET
+//Sends the operations starting from the offset as JSON Lines until the follower disconnects
+func handleReplicationStream(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkReplicationSecret(s, w, req) {
+		return
+	}
+	query := req.URL.Query()
+	id := query.Get("id")
+	offset, err := strconv.ParseUint(query.Get("offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	entries, changed, err := s.replica.log.since(id, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return
+			}
+			offset = entry.Offset + 1
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		entries = nil
+		select {
+		case <-changed:
+			entries, changed, err = s.replica.log.since(id, offset)
+			if err != nil {
+				//The follower is too slow or the log changed, it reconnects and loads a snapshot
+				return
+			}
+		case <-heartbeat.C:
+			if err := enc.Encode(replicationEntry{Offset: offset}); err != nil {
+				return
+			}
+		case <-s.replica.streaming:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+//Handle: /api/replication/snapshot GET
+//Sends the position of the log and the pastes as JSON Lines
+func handleReplicationSnapshot(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkReplicationSecret(s, w, req) {
+		return
+	}
+
+	//The operations after the position are applied again by the follower, so they can be in the snapshot too
+	id, offset := s.replica.log.position()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", replicationPastesTrailer)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(replicationHeader{ID: id, Offset: offset}); err != nil {
+		return
+	}
+	sent := 0
+	err := eachPaste(req.Context(), s.replica.db, ListOptions{}, func(p Paste) error {
+		sent++
+		return enc.Encode(p)
+	})
+	if err != nil {
+		s.logger(req).Error("Cannot send snapshot", "error", err)
+		return
+	}
+	w.Header().Set(replicationPastesTrailer, strconv.Itoa(sent))
+}
+
+//Handle: /api/replication/promote POST
+//Promotes a follower to primary
+func handleReplicationPromote(s Server, w http.ResponseWriter, req *http.Request) {
+	if !checkReplicationSecret(s, w, req) {
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, ErrMethodNotAllowed)
+		return
+	}
+
+	if err := s.replica.promote(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	//The expired pastes were deleted by the primary, now they must be deleted here
+	err := eachPaste(req.Context(), s.db, ListOptions{}, func(p Paste) error {
+		s.scheduleExpire(p)
+		return nil
+	})
+	if err != nil {
+		s.logger(req).Error("Cannot schedule the expiration of the pastes", "error", err)
+	}
+	s.logger(req).Info("Promoted to primary")
+	fmt.Fprintln(w, "Promoted")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplicationLog(t *testing.T) {
+	l := newReplicationLog(2)
+	id, _ := l.position()
+	for i := 0; i < 3; i++ {
+		l.append(replicationDelete, strconv.Itoa(i), nil)
+	}
+
+	tt := []struct {
+		name   string
+		id     string
+		offset uint64
+		paths  []string
+		err    error
+	}{
+		{"Start", id, 1, []string{"1", "2"}, nil},
+		{"End", id, 3, nil, nil},
+		{"Dropped", id, 0, nil, ErrReplicationOffset},
+		{"Future", id, 4, nil, ErrReplicationOffset},
+		{"Other log", "other", 1, nil, ErrReplicationOffset},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, _, err := l.since(tc.id, tc.offset)
+			if err != tc.err {
+				t.Fatalf("Expected: %v; got: %v", tc.err, err)
+			}
+			if len(entries) != len(tc.paths) {
+				t.Fatalf("Expected: %d entries; got: %d", len(tc.paths), len(entries))
+			}
+			for i, entry := range entries {
+				if entry.Path != tc.paths[i] {
+					t.Errorf("Expected: %s; got: %s", tc.paths[i], entry.Path)
+				}
+			}
+		})
+	}
+}
+
+//testReplica is an instance served by httptest
+type testReplica struct {
+	srv    Server
+	server *httptest.Server
+}
+
+func newTestReplica(t *testing.T, primary string, logSize int) *testReplica {
+	r := &testReplica{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.srv.ServeHTTP(w, req)
+	}))
+	t.Cleanup(r.server.Close)
+
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	cfg.Replication = replicationConfig{Secret: "secret", Primary: primary, LogSize: logSize}
+	r.srv = NewServer(newReplicaDB(AdaptDatabase(NewMemoryDB()), cfg.Replication, newLogger(cfg)), cfg)
+	r.srv.handleReplicationRoutes()
+	//The streams must end before the httptest server is closed
+	t.Cleanup(func() { r.srv.Close() })
+	r.srv.replica.startFollowing()
+	return r
+}
+
+func (r *testReplica) waitFor(t *testing.T, path string, exists bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := r.srv.db.Get(context.Background(), path)
+		if (err == nil) == exists {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Paste %s not replicated, expected to exist: %v", path, exists)
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	primary := newTestReplica(t, "", 2)
+	follower := newTestReplica(t, primary.server.URL, 2)
+
+	if err := primary.srv.db.Store(ctx, "first", Paste{Path: "first", Source: "first"}); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	follower.waitFor(t, "first", true)
+	p, err := follower.srv.db.Get(ctx, "first")
+	if err != nil || p.Source != "first" {
+		t.Fatalf("Expected: first; got: %q, %v", p.Source, err)
+	}
+
+	if err := follower.srv.db.Store(ctx, "write", Paste{}); !errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseUnavailable, err)
+	}
+	if _, err := follower.srv.createPastePath(ctx); !errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseUnavailable, err)
+	}
+
+	//The follower misses more operations than the log keeps and loads a snapshot
+	follower.srv.replica.stopFollowing()
+	if err := primary.srv.db.Delete(ctx, "first"); err != nil {
+		t.Fatalf("Could not delete paste: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		path := "missed" + strconv.Itoa(i)
+		if err := primary.srv.db.Store(ctx, path, Paste{Path: path}); err != nil {
+			t.Fatalf("Could not store paste: %v", err)
+		}
+	}
+	follower.srv.replica.startFollowing()
+	follower.waitFor(t, "missed2", true)
+	follower.waitFor(t, "first", false)
+
+	if err := primary.srv.db.Store(ctx, "last", Paste{Path: "last"}); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	follower.waitFor(t, "last", true)
+
+	req, err := http.NewRequest(http.MethodPost, follower.server.URL+"/api/replication/promote", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not promote: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected: %d; got: %d", http.StatusForbidden, res.StatusCode)
+	}
+
+	req.Header.Set(replicationSecretHeader, "secret")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not promote: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected: %d; got: %d", http.StatusOK, res.StatusCode)
+	}
+
+	if err := follower.srv.db.Store(ctx, "promoted", Paste{Path: "promoted"}); err != nil {
+		t.Errorf("Could not store paste after promotion: %v", err)
+	}
+	if err := primary.srv.db.Store(ctx, "ignored", Paste{Path: "ignored"}); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := follower.srv.db.Get(ctx, "ignored"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultCfg
+	cfg.Replication = replicationConfig{Secret: "secret", Primary: "primary", LogSize: 2}
+	db := newReplicaDB(AdaptDatabase(NewMemoryDB()), cfg.Replication, newLogger(cfg))
+	for _, path := range []string{"kept", "stale"} {
+		db.db.Store(ctx, path, Paste{Path: path, Source: "old"})
+	}
+
+	var complete bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", replicationPastesTrailer)
+		enc := json.NewEncoder(w)
+		enc.Encode(replicationHeader{ID: "id", Offset: 1})
+		enc.Encode(Paste{Path: "kept", Source: "new"})
+		enc.Encode(Paste{Path: "added", Source: "new"})
+		if complete {
+			w.Header().Set(replicationPastesTrailer, "2")
+		}
+	}))
+	defer primary.Close()
+
+	tt := []struct {
+		name     string
+		complete bool
+		err      error
+		paths    []string
+	}{
+		{"Interrupted", false, ErrReplicationSnapshot, []string{"added", "kept", "stale"}},
+		{"Complete", true, nil, []string{"added", "kept"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			complete = tc.complete
+			if err := db.catchUp(ctx, primary.URL); !errors.Is(err, tc.err) {
+				t.Errorf("Expected: %v; got: %v", tc.err, err)
+			}
+			var paths []string
+			eachPaste(ctx, db.db, ListOptions{}, func(p Paste) error {
+				paths = append(paths, p.Path)
+				return nil
+			})
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("Expected: %v; got: %v", tc.paths, paths)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Errors declaration for the revisions
+var (
+	ErrPasteNotOwned       = fmt.Errorf("Only the owner can edit the paste")
+	ErrRevisionNotEditable = fmt.Errorf("Only the latest revision can be edited")
+)
+
+//diffMaxCells is the maximum size of the table used for comparing two revisions, about 1 MB
+//The lines before and after the changes are not counted, bigger changes are shown as replaced
+const diffMaxCells = 250000
+
+//revisionPath returns the path keeping a revision of the paste after a newer revision replaces it
+func revisionPath(path string, rev int) string {
+	return path + "/" + strconv.Itoa(rev)
+}
+
+//splitRevisionPath splits PATH/REV, rev is 0 if the path has no revision and ok is false if it is not valid
+func splitRevisionPath(p string) (path string, rev int, ok bool) {
+	i := strings.IndexByte(p, '/')
+	if i < 0 {
+		return p, 0, true
+	}
+	rev, err := strconv.Atoi(p[i+1:])
+	if err != nil || rev < 1 || strconv.Itoa(rev) != p[i+1:] {
+		return "", 0, false
+	}
+	return p[:i], rev, true
+}
+
+//revision returns the number of the revision, the pastes never edited are the first revision
+func (p Paste) revision() int {
+	if p.Revision == 0 {
+		return 1
+	}
+	return p.Revision
+}
+
+//isRevision reports if the paste is an old revision kept at revisionPath
+func (p Paste) isRevision() bool {
+	return strings.IndexByte(p.Path, '/') >= 0
+}
+
+//getRevision returns the paste at PATH or the revision at PATH/REV, the pastes are read with get
+func getRevision(ctx context.Context, p string, get func(context.Context, string) (Paste, error)) (Paste, error) {
+	path, rev, ok := splitRevisionPath(p)
+	if !ok {
+		return Paste{}, ErrDatabaseNotFound
+	}
+	latest, err := get(ctx, path)
+	if err != nil || rev == 0 || rev == latest.revision() {
+		return latest, err
+	}
+	if rev > latest.revision() {
+		return Paste{}, ErrDatabaseNotFound
+	}
+	return get(ctx, revisionPath(path, rev))
+}
+
+//history returns the revisions of the paste, the oldest first
+//The revisions deleted in the meantime are missing
+func (s Server) history(ctx context.Context, latest Paste) ([]Paste, error) {
+	var revisions []Paste
+	for rev := 1; rev < latest.revision(); rev++ {
+		p, err := s.db.Get(ctx, revisionPath(latest.Path, rev))
+		if errors.Is(err, ErrDatabaseNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, p)
+	}
+	return append(revisions, latest), nil
+}
+
+//editPaste replaces the source of the paste with a new revision, the previous revision is kept at revisionPath
+func (s Server) editPaste(ctx context.Context, p Paste, source, lang string) (Paste, error) {
+	source, err := validateCode(source, s.cfg.MaxPasteSize)
+	if err != nil {
+		return Paste{}, err
+	}
+
+	old := p
+	old.Revision = p.revision()
+	old.Path = revisionPath(p.Path, old.Revision)
+	//Two edits of the same revision cannot both keep it
+	ok, err := s.reservePath(ctx, old.Path)
+	if err != nil {
+		return Paste{}, err
+	}
+	if !ok {
+		return Paste{}, fmt.Errorf("%w: revision %d already replaced", ErrDatabaseConflict, old.Revision)
+	}
+	if err := s.db.Store(ctx, old.Path, old); err != nil {
+		return Paste{}, err
+	}
+	s.scheduleExpire(old)
+
+	css, code, lang := highlightCode(source, lang, s.cfg.UndefinedLang, s.cfg.HighlightStyle)
+	p.Source = source
+	p.Lang = lang
+	p.Style = template.CSS(css)
+	p.Content = template.HTML(code)
+	p.Encoding = ""
+	p.Created = time.Now()
+	p.Revision = old.Revision + 1
+	if err := s.db.Store(ctx, p.Path, p); err != nil {
+		return Paste{}, err
+	}
+	return p, nil
+}
+
+//deletePaste deletes the paste with its old revisions
+func (s Server) deletePaste(ctx context.Context, p Paste) error {
+	for rev := 1; rev < p.revision(); rev++ {
+		path := revisionPath(p.Path, rev)
+		if err := s.db.Delete(ctx, path); err != nil && !errors.Is(err, ErrDatabaseNotFound) {
+			return err
+		}
+		s.timers.cancel(path)
+	}
+	if err := s.db.Delete(ctx, p.Path); err != nil {
+		return err
+	}
+	s.timers.cancel(p.Path)
+	s.views.delete(p.Path)
+	return nil
+}
+
+//setExpire changes when the paste and its old revisions expire
+func (s Server) setExpire(ctx context.Context, p Paste, expire time.Time) error {
+	for rev := 1; rev < p.revision(); rev++ {
+		old, err := s.db.Get(ctx, revisionPath(p.Path, rev))
+		if errors.Is(err, ErrDatabaseNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		old.Expire = expire
+		if err := s.db.Store(ctx, old.Path, old); err != nil {
+			return err
+		}
+		s.scheduleExpire(old)
+	}
+	p.Expire = expire
+	if err := s.db.Store(ctx, p.Path, p); err != nil {
+		return err
+	}
+	s.scheduleExpire(p)
+	return nil
+}
+
+//diffLine is a line of the difference between two revisions
+type diffLine struct {
+	//Op is " " for the lines in both revisions, "-" for the removed ones and "+" for the added ones
+	Op   string
+	Text string
+}
+
+//diffLines returns the difference between the lines of a and b, the longest common subsequence is kept
+func diffLines(a, b string) []diffLine {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	var diff []diffLine
+
+	//The lines in common at the start and at the end are compared without the table
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		diff = append(diff, diffLine{" ", x[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	end := x[len(x)-suffix:]
+	x, y = x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+
+	if len(x)*len(y) > diffMaxCells {
+		for _, line := range x {
+			diff = append(diff, diffLine{"-", line})
+		}
+		for _, line := range y {
+			diff = append(diff, diffLine{"+", line})
+		}
+		return appendSame(diff, end)
+	}
+
+	//lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int32, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, diffLine{" ", x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, diffLine{"-", x[i]})
+			i++
+		default:
+			diff = append(diff, diffLine{"+", y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, diffLine{"-", x[i]})
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, diffLine{"+", y[j]})
+	}
+	return appendSame(diff, end)
+}
+
+//appendSame appends the lines in common to the diff
+func appendSame(diff []diffLine, lines []string) []diffLine {
+	for _, line := range lines {
+		diff = append(diff, diffLine{" ", line})
+	}
+	return diff
+}
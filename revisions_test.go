@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitRevisionPath(t *testing.T) {
+	tt := []struct {
+		input string
+		path  string
+		rev   int
+		ok    bool
+	}{
+		{"paste", "paste", 0, true},
+		{"paste/2", "paste", 2, true},
+		{"paste/0", "", 0, false},
+		{"paste/02", "", 0, false},
+		{"paste/-1", "", 0, false},
+		{"paste/two", "", 0, false},
+		{"paste/1/2", "", 0, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			path, rev, ok := splitRevisionPath(tc.input)
+			if path != tc.path || rev != tc.rev || ok != tc.ok {
+				t.Errorf("Expected: %q, %d, %v; got: %q, %d, %v", tc.path, tc.rev, tc.ok, path, rev, ok)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tt := []struct {
+		name string
+		a    string
+		b    string
+		diff []diffLine
+	}{
+		{"Same", "a\nb", "a\nb", []diffLine{{" ", "a"}, {" ", "b"}}},
+		{"Added", "a\nc", "a\nb\nc", []diffLine{{" ", "a"}, {"+", "b"}, {" ", "c"}}},
+		{"Removed", "a\nb\nc", "a\nc", []diffLine{{" ", "a"}, {"-", "b"}, {" ", "c"}}},
+		{"Replaced", "a\nb", "a\nc", []diffLine{{" ", "a"}, {"-", "b"}, {"+", "c"}}},
+		{"Moved", "a\nb\nc", "c\na\nb", []diffLine{{"+", "c"}, {" ", "a"}, {" ", "b"}, {"-", "c"}}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := diffLines(tc.a, tc.b); !reflect.DeepEqual(diff, tc.diff) {
+				t.Errorf("Expected: %v; got: %v", tc.diff, diff)
+			}
+		})
+	}
+
+	//The lines in common around the change are not counted for the size of the table
+	lines := make([]string, 2*diffMaxCells)
+	for i := range lines {
+		lines[i] = strconv.Itoa(i)
+	}
+	edited := append(append(append([]string{}, lines[:diffMaxCells]...), "edited"), lines[diffMaxCells+1:]...)
+	diff := diffLines(strings.Join(lines, "\n"), strings.Join(edited, "\n"))
+	if changed := diff[diffMaxCells : diffMaxCells+2]; len(diff) != len(lines)+1 || !reflect.DeepEqual(changed, []diffLine{{"-", lines[diffMaxCells]}, {"+", "edited"}}) {
+		t.Errorf("Expected: a single line replaced; got: %d lines, %v", len(diff), changed)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	s := NewServer(AdaptDatabase(NewMemoryDB()), cfg)
+	s.handleRoute("/", handleHome)
+	s.handleRoute("/raw/", handleRawPaste)
+	s.handleRoute("/mine", handleMyPastes)
+	s.handleRoute("/api/get", handleAPIGetPaste)
+
+	do := func(method, target string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+	create := func() (string, *http.Cookie) {
+		form := url.Values{"code": {"first line\nsecond line"}, "expire": {getExpireTime(t)}}
+		res := do(http.MethodPost, "/", form.Encode(), nil)
+		cookies := res.Result().Cookies()
+		if res.Code != http.StatusFound || len(cookies) != 1 {
+			t.Fatalf("Could not create paste: %d", res.Code)
+		}
+		return strings.TrimPrefix(res.Header().Get("Location"), "/"), cookies[0]
+	}
+	edit := func(target, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		return do(http.MethodPost, target, url.Values{"code": {code}}.Encode(), cookie)
+	}
+
+	path, cookie := create()
+	_, stranger := create()
+	if res := edit("/"+path, "first line\nedited line", cookie); res.Code != http.StatusFound {
+		t.Fatalf("Could not edit paste: %d\n%s", res.Code, res.Body)
+	}
+
+	tt := []struct {
+		name   string
+		method string
+		target string
+		code   int
+		body   string
+	}{
+		{"Latest", http.MethodGet, "/" + path, http.StatusOK, "Revision: 2"},
+		{"First", http.MethodGet, "/" + path + "/1", http.StatusOK, "second line"},
+		{"Current", http.MethodGet, "/" + path + "/2", http.StatusOK, `<span class="added">`},
+		{"Missing", http.MethodGet, "/" + path + "/3", http.StatusNotFound, ""},
+		{"Not valid", http.MethodGet, "/" + path + "/first", http.StatusNotFound, ""},
+		{"Raw first", http.MethodGet, "/raw/" + path + "/1", http.StatusOK, "first line\nsecond line"},
+		{"Raw current", http.MethodGet, "/raw/" + path + "/2", http.StatusOK, "first line\nedited line"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			res := do(tc.method, tc.target, "", cookie)
+			if res.Code != tc.code || !strings.Contains(res.Body.String(), tc.body) {
+				t.Errorf("Expected: %d with %q; got: %d\n%s", tc.code, tc.body, res.Code, res.Body)
+			}
+		})
+	}
+
+	t.Run("Edit", func(t *testing.T) {
+		if res := edit("/"+path, "stolen", stranger); res.Code != http.StatusBadRequest {
+			t.Errorf("Not owned, expected: %d; got: %d", http.StatusBadRequest, res.Code)
+		}
+		if res := edit("/"+path+"/1", "old", cookie); res.Code != http.StatusBadRequest {
+			t.Errorf("Old revision, expected: %d; got: %d", http.StatusBadRequest, res.Code)
+		}
+		if res := edit("/"+path, "", cookie); res.Code != http.StatusBadRequest {
+			t.Errorf("Empty, expected: %d; got: %d", http.StatusBadRequest, res.Code)
+		}
+	})
+
+	t.Run("API", func(t *testing.T) {
+		for rev, source := range map[int]string{0: "first line\nedited line", 1: "first line\nsecond line"} {
+			body, _ := json.Marshal(getPasteRequest{Name: path, Revision: rev})
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/get", bytes.NewReader(body)))
+			var output getPasteResponse
+			json.Unmarshal(res.Body.Bytes(), &output)
+			if expected := map[int]int{0: 2, 1: 1}[rev]; output.Revision != expected || output.Code != source {
+				t.Errorf("Expected: revision %d %q; got: %d %q", expected, source, output.Revision, output.Code)
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		res := do(http.MethodGet, "/mine", "", cookie)
+		if strings.Contains(res.Body.String(), path+"/1") {
+			t.Errorf("Expected: old revisions not listed\n%s", res.Body)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if res := do(http.MethodPost, "/mine", url.Values{"action": {"delete"}, "path": {path}}.Encode(), cookie); res.Code != http.StatusFound {
+			t.Fatalf("Could not delete paste: %d", res.Code)
+		}
+		if _, err := s.db.Get(ctx, revisionPath(path, 1)); err != ErrDatabaseNotFound {
+			t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+		}
+	})
+}
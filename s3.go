@@ -0,0 +1,717 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+//s3ExpireTag is the tag of the objects deleted by the lifecycle rules, the value is the number of days
+const s3ExpireTag = "yep-expire-days"
+
+//s3MaxExpireDays is the longest expiration handled by the lifecycle rules
+//The rules expire the objects after a power of two days so only a few rules are needed
+const s3MaxExpireDays = 4096
+
+//S3DB is a Database stored in a bucket of a S3 compatible object storage
+//The body of an object is the source, the style and the content of a paste, the other fields are in the metadata
+//The pastes are listed with indexes of empty objects, so only the pastes of a page are read
+type S3DB struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	lifecycle bool
+}
+
+//NewS3DB connects to the object storage at endpoint(https://host:port) and uses the bucket, the keys start with prefix
+//If lifecycle is true the rules deleting the expired pastes are added to the bucket
+func NewS3DB(endpoint, region, bucket, accessKey, secretKey, prefix string, lifecycle bool) (*S3DB, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: u.Scheme == "https",
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db := &S3DB{client: client, bucket: bucket, prefix: prefix, lifecycle: lifecycle}
+	exists, err := client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("Bucket does not exist: %s", bucket)
+	}
+	if lifecycle {
+		if err := db.setLifecycle(context.Background()); err != nil {
+			return nil, fmt.Errorf("Cannot set lifecycle rules: %v", err)
+		}
+	}
+	if err := db.indexPastes(context.Background()); err != nil {
+		return nil, fmt.Errorf("Cannot index the pastes: %v", err)
+	}
+	return db, nil
+}
+
+//s3Error converts the errors of the object storage to the ErrDatabase errors
+func s3Error(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	res := minio.ToErrorResponse(err)
+	switch {
+	case res.Code == "NoSuchKey":
+		return ErrDatabaseNotFound
+	case strings.Contains(res.Code, "QuotaExceeded"):
+		return fmt.Errorf("%w: %v", ErrDatabaseQuotaExceeded, err)
+	case res.Code == "SlowDown", res.Code == "ServiceUnavailable", res.Code == "":
+		//An empty code is a connection error
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	}
+	return err
+}
+
+//setLifecycle adds the rules deleting the expired pastes, the other rules of the bucket are kept
+func (db *S3DB) setLifecycle(ctx context.Context) error {
+	config, err := db.client.GetBucketLifecycle(ctx, db.bucket)
+	if minio.ToErrorResponse(err).Code == "NoSuchLifecycleConfiguration" {
+		config, err = lifecycle.NewConfiguration(), nil
+	}
+	if err != nil {
+		return s3Error(err)
+	}
+
+	rules := config.Rules[:0]
+	for _, rule := range config.Rules {
+		if !strings.HasPrefix(rule.ID, s3ExpireTag) {
+			rules = append(rules, rule)
+		}
+	}
+	for days := 1; days <= s3MaxExpireDays; days *= 2 {
+		rules = append(rules, lifecycle.Rule{
+			ID:         s3ExpireTag + "-" + strconv.Itoa(days),
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Tag: lifecycle.Tag{Key: s3ExpireTag, Value: strconv.Itoa(days)}},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(days)},
+		})
+	}
+	config.Rules = rules
+	return s3Error(db.client.SetBucketLifecycle(ctx, db.bucket, config))
+}
+
+//s3ExpireDays returns the days after which the lifecycle rules delete a paste expiring after ttl, 0 if no rule does
+func s3ExpireDays(ttl time.Duration) int {
+	for days := 1; days <= s3MaxExpireDays; days *= 2 {
+		if ttl <= time.Duration(days)*24*time.Hour {
+			return days
+		}
+	}
+	return 0
+}
+
+func (db *S3DB) key(name string) string { return db.prefix + name }
+
+//s3ReservedDir is the directory of the objects reserving the paths, listing the pastes skips it
+const s3ReservedDir = ".reserved/"
+
+func (db *S3DB) reservationKey(name string) string { return db.prefix + s3ReservedDir + name }
+
+//s3SequenceDir is the directory of the counters, listing the pastes skips it
+const s3SequenceDir = ".sequence/"
+
+func (db *S3DB) sequenceKey() string { return db.prefix + s3SequenceDir + "paths" }
+
+//s3IndexDir is the directory of the indexes, listing the pastes skips it
+//An index is a directory of empty objects named as the members of the indexes of Redis, sorted by creation time
+const s3IndexDir = ".index/"
+
+//s3ExpiresIndex is the index of the expiring pastes, sorted by expiration time
+//Its objects contain the keys of the other indexes of the paste, for removing them when the paste is deleted by the lifecycle rules
+const s3ExpiresIndex = "expires"
+
+//s3KeyEscaper escapes the slashes of the paths in the keys of the indexes, so the indexes are listed as a single directory
+var (
+	s3KeyEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	s3KeyUnescaper = strings.NewReplacer("%2F", "/", "%25", "%")
+)
+
+func (db *S3DB) indexDir(index string) string {
+	return db.prefix + s3IndexDir + s3KeyEscaper.Replace(index) + "/"
+}
+
+func (db *S3DB) indexKey(index string, t time.Time, name string) string {
+	return db.indexDir(index) + indexMember(t, s3KeyEscaper.Replace(name))
+}
+
+//indexedKey is set when the pastes stored before the indexes have been indexed
+func (db *S3DB) indexedKey() string { return db.prefix + s3IndexDir + "indexed" }
+
+//indexKeys returns the keys of the indexes listing the paste, without the index of the expiring pastes
+func (db *S3DB) indexKeys(p Paste) []string {
+	keys := []string{db.indexKey("created", p.Created, p.Path)}
+	for _, index := range pasteIndexes(p) {
+		keys = append(keys, db.indexKey(index, p.Created, p.Path))
+	}
+	return keys
+}
+
+//indexName returns the name of the paste of an index key
+func indexName(dir, key string) string {
+	member := strings.TrimPrefix(key, dir)
+	return s3KeyUnescaper.Replace(member[strings.IndexByte(member, ':')+1:])
+}
+
+//Metadata of the objects
+const (
+	s3MetaUser         = "User"
+	s3MetaUserID       = "User-Id"
+	s3MetaOwner        = "Owner"
+	s3MetaVisibility   = "Visibility"
+	s3MetaLang         = "Lang"
+	s3MetaEncoding     = "Encoding"
+	s3MetaCreated      = "Created"
+	s3MetaExpire       = "Expire"
+	s3MetaSourceLength = "Source-Length"
+	s3MetaStyleLength  = "Style-Length"
+	s3MetaRevision     = "Revision"
+)
+
+//s3Time formats a time for the metadata, the zero time is empty
+func s3Time(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+//pasteMetadata returns the paste described by the metadata of its object, the body is not read
+func pasteMetadata(name string, meta map[string]string) (Paste, error) {
+	p := Paste{Path: name, UserID: meta[s3MetaUserID], Owner: meta[s3MetaOwner], Visibility: meta[s3MetaVisibility], Encoding: meta[s3MetaEncoding]}
+	var err error
+	if p.User, err = url.QueryUnescape(meta[s3MetaUser]); err != nil {
+		return p, err
+	}
+	if p.Lang, err = url.QueryUnescape(meta[s3MetaLang]); err != nil {
+		return p, err
+	}
+	if created := meta[s3MetaCreated]; created != "" {
+		if p.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return p, err
+		}
+	}
+	if expire := meta[s3MetaExpire]; expire != "" {
+		if p.Expire, err = time.Parse(time.RFC3339Nano, expire); err != nil {
+			return p, err
+		}
+	}
+	if revision := meta[s3MetaRevision]; revision != "" {
+		if p.Revision, err = strconv.Atoi(revision); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+//pasteExpired reports if the paste is expired
+func pasteExpired(p Paste) bool {
+	return p.Expires() && !p.Expire.After(time.Now())
+}
+
+//Get implements DatabaseV2
+//Expired pastes are not returned even if the lifecycle rules have not deleted them yet
+func (db *S3DB) Get(ctx context.Context, name string) (Paste, error) {
+	obj, err := db.client.GetObject(ctx, db.bucket, db.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return Paste{}, s3Error(err)
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return Paste{}, s3Error(err)
+	}
+	p, err := pasteMetadata(name, info.UserMetadata)
+	if err != nil {
+		return Paste{}, err
+	}
+	if pasteExpired(p) {
+		return Paste{}, ErrDatabaseNotFound
+	}
+
+	body, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return Paste{}, s3Error(err)
+	}
+	sourceLen, err := strconv.Atoi(info.UserMetadata[s3MetaSourceLength])
+	if err != nil {
+		return Paste{}, err
+	}
+	styleLen, err := strconv.Atoi(info.UserMetadata[s3MetaStyleLength])
+	if err != nil {
+		return Paste{}, err
+	}
+	if sourceLen+styleLen > len(body) {
+		return Paste{}, fmt.Errorf("Object too short: %s", name)
+	}
+
+	p.Source = string(body[:sourceLen])
+	p.Style = template.CSS(body[sourceLen : sourceLen+styleLen])
+	p.Content = template.HTML(body[sourceLen+styleLen:])
+	return p, nil
+}
+
+//Store implements DatabaseV2
+func (db *S3DB) Store(ctx context.Context, name string, value Paste) error {
+	body := value.Source + string(value.Style) + string(value.Content)
+	opts := minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		UserMetadata: map[string]string{
+			s3MetaUser:         url.QueryEscape(value.User),
+			s3MetaUserID:       value.UserID,
+			s3MetaOwner:        value.Owner,
+			s3MetaVisibility:   value.Visibility,
+			s3MetaLang:         url.QueryEscape(value.Lang),
+			s3MetaEncoding:     value.Encoding,
+			s3MetaCreated:      s3Time(value.Created),
+			s3MetaExpire:       s3Time(value.Expire),
+			s3MetaSourceLength: strconv.Itoa(len(value.Source)),
+			s3MetaStyleLength:  strconv.Itoa(len(value.Style)),
+			s3MetaRevision:     strconv.Itoa(value.Revision),
+		},
+	}
+	if db.lifecycle && value.Expires() {
+		if days := s3ExpireDays(time.Until(value.Expire)); days != 0 {
+			opts.UserTags = map[string]string{s3ExpireTag: strconv.Itoa(days)}
+		}
+	}
+
+	old, err := db.stat(ctx, name)
+	if err != nil && !errors.Is(err, ErrDatabaseNotFound) {
+		return err
+	}
+	exists := err == nil
+
+	//The paste is indexed before it is stored, the index objects of a paste not stored are skipped by List
+	if err := db.index(ctx, value); err != nil {
+		return err
+	}
+	_, err = db.client.PutObject(ctx, db.bucket, db.key(name), strings.NewReader(body), int64(len(body)), opts)
+	if err != nil {
+		return s3Error(err)
+	}
+	if exists {
+		if err := db.unindex(ctx, old, value); err != nil {
+			return err
+		}
+	}
+	return s3Error(db.client.RemoveObject(ctx, db.bucket, db.reservationKey(name), minio.RemoveObjectOptions{}))
+}
+
+//Delete implements DatabaseV2
+func (db *S3DB) Delete(ctx context.Context, name string) error {
+	old, err := db.stat(ctx, name)
+	if errors.Is(err, ErrDatabaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s3Error(db.client.RemoveObject(ctx, db.bucket, db.key(name), minio.RemoveObjectOptions{})); err != nil {
+		return err
+	}
+	return db.unindex(ctx, old, Paste{})
+}
+
+//stat returns the paste without the body, expired pastes are returned too
+func (db *S3DB) stat(ctx context.Context, name string) (Paste, error) {
+	info, err := db.client.StatObject(ctx, db.bucket, db.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return Paste{}, s3Error(err)
+	}
+	return pasteMetadata(name, info.UserMetadata)
+}
+
+//index adds the paste to its indexes
+func (db *S3DB) index(ctx context.Context, p Paste) error {
+	keys := db.indexKeys(p)
+	for _, key := range keys {
+		if _, err := db.client.PutObject(ctx, db.bucket, key, strings.NewReader(""), 0, minio.PutObjectOptions{}); err != nil {
+			return s3Error(err)
+		}
+	}
+	if !p.Expires() {
+		return nil
+	}
+	body := strings.Join(keys, "\n")
+	_, err := db.client.PutObject(ctx, db.bucket, db.indexKey(s3ExpiresIndex, p.Expire, p.Path), strings.NewReader(body), int64(len(body)), minio.PutObjectOptions{})
+	return s3Error(err)
+}
+
+//unindex removes the index objects of old that are not used by current, current is the zero paste if deleted
+func (db *S3DB) unindex(ctx context.Context, old, current Paste) error {
+	used := make(map[string]bool)
+	if current.Path != "" {
+		for _, key := range db.indexKeys(current) {
+			used[key] = true
+		}
+		if current.Expires() {
+			used[db.indexKey(s3ExpiresIndex, current.Expire, current.Path)] = true
+		}
+	}
+
+	keys := db.indexKeys(old)
+	if old.Expires() {
+		keys = append(keys, db.indexKey(s3ExpiresIndex, old.Expire, old.Path))
+	}
+	return db.removeKeys(ctx, keys, used)
+}
+
+//removeKeys removes the objects, except the used ones
+func (db *S3DB) removeKeys(ctx context.Context, keys []string, used map[string]bool) error {
+	for _, key := range keys {
+		if used[key] {
+			continue
+		}
+		if err := s3Error(db.client.RemoveObject(ctx, db.bucket, key, minio.RemoveObjectOptions{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ReservePath implements DatabaseV2
+//The path is reserved by creating an object with a conditional write, so the storage must support If-None-Match
+func (db *S3DB) ReservePath(ctx context.Context, path string) (bool, error) {
+	reserved, err := db.reserve(ctx, path)
+	if !reserved || err != nil {
+		return false, err
+	}
+
+	info, err := db.client.StatObject(ctx, db.bucket, db.key(path), minio.StatObjectOptions{})
+	if err = s3Error(err); errors.Is(err, ErrDatabaseNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	p, err := pasteMetadata(path, info.UserMetadata)
+	return err == nil && pasteExpired(p), err
+}
+
+//reserve creates the object reserving the path, an ended reservation is replaced
+func (db *S3DB) reserve(ctx context.Context, path string) (bool, error) {
+	key := db.reservationKey(path)
+	put := func(opts minio.PutObjectOptions) (bool, error) {
+		opts.UserMetadata = map[string]string{s3MetaExpire: s3Time(time.Now().Add(pathReserveTime))}
+		_, err := db.client.PutObject(ctx, db.bucket, key, strings.NewReader(""), 0, opts)
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return false, nil
+		}
+		return err == nil, s3Error(err)
+	}
+
+	var opts minio.PutObjectOptions
+	opts.SetMatchETagExcept("*")
+	if reserved, err := put(opts); reserved || err != nil {
+		return reserved, err
+	}
+
+	info, err := db.client.StatObject(ctx, db.bucket, key, minio.StatObjectOptions{})
+	if err = s3Error(err); errors.Is(err, ErrDatabaseNotFound) {
+		//The reservation has just been removed by storing the paste
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	end, err := time.Parse(time.RFC3339Nano, info.UserMetadata[s3MetaExpire])
+	if err == nil && end.After(time.Now()) {
+		return false, nil
+	}
+	//Replace the ended reservation only if nobody else did
+	opts = minio.PutObjectOptions{}
+	opts.SetMatchETag(info.ETag)
+	return put(opts)
+}
+
+//NextSequence implements sequenceDatabase
+//The counter is an object replaced with conditional writes, a write failing because of another instance is retried
+func (db *S3DB) NextSequence(ctx context.Context, start func(context.Context) (uint64, error)) (uint64, error) {
+	key := db.sequenceKey()
+	for {
+		var n uint64
+		var opts minio.PutObjectOptions
+		obj, err := db.client.GetObject(ctx, db.bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return 0, s3Error(err)
+		}
+		info, err := obj.Stat()
+		if err == nil {
+			var body []byte
+			if body, err = ioutil.ReadAll(obj); err == nil {
+				n, err = strconv.ParseUint(string(body), 10, 64)
+			}
+			opts.SetMatchETag(info.ETag)
+		}
+		obj.Close()
+		if err = s3Error(err); errors.Is(err, ErrDatabaseNotFound) {
+			if n, err = start(ctx); err != nil {
+				return 0, err
+			}
+			opts.SetMatchETagExcept("*")
+		} else if err != nil {
+			return 0, err
+		}
+
+		next := strconv.FormatUint(n+1, 10)
+		_, err = db.client.PutObject(ctx, db.bucket, key, strings.NewReader(next), int64(len(next)), opts)
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			continue
+		}
+		if err != nil {
+			return 0, s3Error(err)
+		}
+		return n, nil
+	}
+}
+
+//walk calls fn for every paste object under prefix, without reading the metadata
+//The old revisions of the pastes are in subdirectories named as the pastes
+func (db *S3DB) walk(ctx context.Context, prefix string, fn func(minio.ObjectInfo) error) error {
+	for info := range db.client.ListObjects(ctx, db.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if info.Err != nil {
+			return s3Error(info.Err)
+		}
+		switch info.Key {
+		case db.prefix + s3ReservedDir, db.prefix + s3SequenceDir, db.prefix + s3IndexDir:
+			continue
+		}
+		if strings.HasSuffix(info.Key, "/") {
+			if err := db.walk(ctx, info.Key, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexPastes indexes the pastes stored before the indexes
+//It runs once for every bucket and prefix, it reads the metadata of every paste
+func (db *S3DB) indexPastes(ctx context.Context) error {
+	_, err := db.client.StatObject(ctx, db.bucket, db.indexedKey(), minio.StatObjectOptions{})
+	if err = s3Error(err); !errors.Is(err, ErrDatabaseNotFound) {
+		return err
+	}
+
+	err = db.walk(ctx, db.prefix, func(info minio.ObjectInfo) error {
+		p, err := db.stat(ctx, strings.TrimPrefix(info.Key, db.prefix))
+		if errors.Is(err, ErrDatabaseNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return db.index(ctx, p)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.client.PutObject(ctx, db.bucket, db.indexedKey(), strings.NewReader(""), 0, minio.PutObjectOptions{})
+	return s3Error(err)
+}
+
+//listedPaste returns the paste of an index object, false if the object is left by a paste deleted, expired or stored again
+func (db *S3DB) listedPaste(ctx context.Context, index, key string) (Paste, bool, error) {
+	p, err := db.Get(ctx, indexName(db.indexDir(index), key))
+	if errors.Is(err, ErrDatabaseNotFound) {
+		return Paste{}, false, nil
+	}
+	if err != nil {
+		return Paste{}, false, err
+	}
+	return p, db.indexKey(index, p.Created, p.Path) == key, nil
+}
+
+//List implements DatabaseV2
+//The index is listed from the cursor and only the pastes of the page are read
+//The object storage lists only in ascending order, so listing the newest first reads the whole index but not the pastes
+func (db *S3DB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	index := opts.index()
+	if index == "" {
+		index = "created"
+	}
+	dir := db.indexDir(index)
+
+	//The keys listed are after start and before end
+	var start, end string
+	if !opts.Since.IsZero() {
+		start = dir + indexMember(opts.Since, "")
+	}
+	if !opts.Until.IsZero() {
+		end = dir + indexMember(opts.Until, "")
+	}
+	if opts.Cursor != "" {
+		created, path, err := parseListCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if opts.Reverse {
+			end = db.indexKey(index, created, path)
+		} else {
+			start = db.indexKey(index, created, path)
+		}
+	}
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := db.client.ListObjects(listCtx, db.bucket, minio.ListObjectsOptions{Prefix: dir, StartAfter: start})
+	var keys []string
+	next := func() (string, bool, error) {
+		if opts.Reverse {
+			if len(keys) == 0 {
+				return "", false, nil
+			}
+			key := keys[len(keys)-1]
+			keys = keys[:len(keys)-1]
+			return key, true, nil
+		}
+		info, ok := <-objects
+		if !ok || (end != "" && info.Key >= end) {
+			return "", false, nil
+		}
+		return info.Key, true, s3Error(info.Err)
+	}
+	if opts.Reverse {
+		for info := range objects {
+			if info.Err != nil {
+				return nil, "", s3Error(info.Err)
+			}
+			if end != "" && info.Key >= end {
+				break
+			}
+			keys = append(keys, info.Key)
+		}
+	}
+
+	var pastes []Paste
+	//One more paste tells if there is a next page
+	for opts.Limit == 0 || len(pastes) <= opts.Limit {
+		key, ok, err := next()
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			break
+		}
+		p, listed, err := db.listedPaste(ctx, index, key)
+		if err != nil {
+			return nil, "", err
+		}
+		if listed && opts.match(p) {
+			pastes = append(pastes, p)
+		}
+	}
+
+	if opts.Limit == 0 || len(pastes) <= opts.Limit {
+		return pastes, "", nil
+	}
+	pastes = pastes[:opts.Limit]
+	return pastes, listCursor(pastes[len(pastes)-1]), nil
+}
+
+//removeExpired removes the index objects of the pastes deleted by the lifecycle rules
+//It returns the expired pastes not deleted yet
+func (db *S3DB) removeExpired(ctx context.Context) (map[string]bool, error) {
+	dir := db.indexDir(s3ExpiresIndex)
+	end := dir + indexMember(time.Now(), "")
+	expired := make(map[string]bool)
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for info := range db.client.ListObjects(listCtx, db.bucket, minio.ListObjectsOptions{Prefix: dir}) {
+		if info.Err != nil {
+			return nil, s3Error(info.Err)
+		}
+		if info.Key >= end {
+			break
+		}
+
+		name := indexName(dir, info.Key)
+		p, err := db.stat(ctx, name)
+		if err != nil && !errors.Is(err, ErrDatabaseNotFound) {
+			return nil, err
+		}
+		used := make(map[string]bool)
+		if err == nil {
+			if db.indexKey(s3ExpiresIndex, p.Expire, name) == info.Key {
+				expired[name] = true
+				continue
+			}
+			//The object is left by a paste stored again
+			for _, key := range db.indexKeys(p) {
+				used[key] = true
+			}
+		}
+
+		obj, err := db.client.GetObject(ctx, db.bucket, info.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		body, err := ioutil.ReadAll(obj)
+		obj.Close()
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		keys := append(strings.Split(string(body), "\n"), info.Key)
+		if err := db.removeKeys(ctx, keys, used); err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
+//Stats implements DatabaseV2
+//The pastes are listed without reading their metadata, only the expired pastes are read
+func (db *S3DB) Stats(ctx context.Context) (DatabaseStats, error) {
+	var stats DatabaseStats
+	expired, err := db.removeExpired(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	err = db.walk(ctx, db.prefix, func(info minio.ObjectInfo) error {
+		if !expired[strings.TrimPrefix(info.Key, db.prefix)] {
+			stats.Count++
+			stats.Size += info.Size
+		}
+		return nil
+	})
+	return stats, err
+}
+
+//ExpiresPastes implements expiringDatabase
+func (db *S3DB) ExpiresPastes() bool { return db.lifecycle }
+
+//Close implements DatabaseV2
+func (db *S3DB) Close() error { return nil }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+)
+
+//fakeS3 is an in-process S3 server, lifecycle configurations are kept in memory because gofakes3 does not support them
+//The conditional writes are checked here too
+type fakeS3 struct {
+	backend *s3mem.Backend
+	handler http.Handler
+
+	mu        sync.Mutex
+	lifecycle []byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := req.URL.Query()["lifecycle"]; !ok {
+		if req.Method == http.MethodPut && req.Header.Get("X-Amz-Decoded-Content-Length") == "0" {
+			//Empty objects are sent chunked but gofakes3 needs the length
+			req.Header.Set("Content-Length", "0")
+		}
+		if req.Method == http.MethodGet {
+			f.fixStartAfter(req)
+		}
+		if req.Method == http.MethodPut && !f.conditionMet(req) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`<Error><Code>PreconditionFailed</Code></Error>`))
+			return
+		}
+		f.handler.ServeHTTP(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if f.lifecycle == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchLifecycleConfiguration</Code></Error>`))
+			return
+		}
+		w.Write(f.lifecycle)
+	case http.MethodPut:
+		f.lifecycle, _ = ioutil.ReadAll(req.Body)
+	}
+}
+
+//fixStartAfter replaces a start-after key that does not exist with the key before it
+//gofakes3 skips the first key listed when the start-after key does not exist
+func (f *fakeS3) fixStartAfter(req *http.Request) {
+	q := req.URL.Query()
+	startAfter := q.Get("start-after")
+	if startAfter == "" {
+		return
+	}
+	bucket := strings.Trim(req.URL.Path, "/")
+	if _, err := f.backend.HeadObject(bucket, startAfter); err == nil {
+		return
+	}
+
+	q.Del("start-after")
+	objects, err := f.backend.ListBucket(bucket, &gofakes3.Prefix{HasPrefix: true, Prefix: q.Get("prefix")}, gofakes3.ListBucketPage{})
+	if err == nil {
+		for _, obj := range objects.Contents {
+			if obj.Key < startAfter && obj.Key > q.Get("start-after") {
+				q.Set("start-after", obj.Key)
+			}
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+}
+
+//conditionMet checks the If-None-Match and If-Match headers of a write
+func (f *fakeS3) conditionMet(req *http.Request) bool {
+	noneMatch, match := req.Header.Get("If-None-Match"), req.Header.Get("If-Match")
+	if noneMatch == "" && match == "" {
+		return true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	obj, err := f.backend.HeadObject(parts[0], parts[1])
+	if noneMatch == "*" {
+		return err != nil
+	}
+	return err == nil && match == `"`+hex.EncodeToString(obj.Hash)+`"`
+}
+
+func newTestS3DB(t *testing.T, lifecycle bool) (*S3DB, *fakeS3) {
+	fake := &fakeS3{backend: s3mem.New()}
+	fake.handler = gofakes3.New(fake.backend).Server()
+	if err := fake.backend.CreateBucket("yep"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	db, err := NewS3DB(server.URL, "us-east-1", "yep", "key", "secret", "pastes/", lifecycle)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	return db, fake
+}
+
+func TestS3DB(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestS3DB(t, true)
+	now := time.Now().Round(0)
+
+	paste := Paste{Path: "test", User: "user è", UserID: "id", Owner: "owner", Lang: "Go", Source: "package main\xff", Style: "body{}", Content: "<h1>test</h1>", Encoding: CompressionGzip, Created: now, Expire: now.Add(36 * time.Hour)}
+	if err := db.Store(ctx, paste.Path, paste); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	db.Store(ctx, "never", Paste{Path: "never", Source: "never expires", Created: now.Add(time.Minute)})
+	db.Store(ctx, "expired", Paste{Path: "expired", Source: "already expired", Created: now, Expire: now.Add(-time.Hour)})
+
+	got, err := db.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not get paste: %v", err)
+	}
+	if got.Path != paste.Path || got.User != paste.User || got.UserID != paste.UserID || got.Owner != paste.Owner || got.Lang != paste.Lang || got.Source != paste.Source || got.Style != paste.Style ||
+		got.Content != paste.Content || got.Encoding != paste.Encoding || !got.Created.Equal(paste.Created) || !got.Expire.Equal(paste.Expire) {
+		t.Errorf("Wrong paste: expected: %+v; got: %+v", paste, got)
+	}
+	if _, err := db.Get(ctx, "expired"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+	if _, err := db.Get(ctx, "missing"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		if !strings.Contains(string(fake.lifecycle), "<Key>"+s3ExpireTag+"</Key><Value>2</Value>") {
+			t.Errorf("Rules not set: %s", fake.lifecycle)
+		}
+		obj, err := fake.backend.HeadObject("yep", "pastes/test")
+		if err != nil {
+			t.Fatalf("Could not get object: %v", err)
+		}
+		if tags := obj.Metadata["X-Amz-Tagging"]; tags != s3ExpireTag+"=2" {
+			t.Errorf("Wrong tags: %q", tags)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		pastes, cursor, err := db.List(ctx, ListOptions{Limit: 1})
+		if err != nil || len(pastes) != 1 || pastes[0].Path != "test" || pastes[0].Source != paste.Source {
+			t.Fatalf("Wrong page: %+v, %v", pastes, err)
+		}
+		pastes, cursor, err = db.List(ctx, ListOptions{Limit: 1, Cursor: cursor})
+		if err != nil || len(pastes) != 1 || pastes[0].Path != "never" || cursor != "" {
+			t.Errorf("Wrong page: %+v, %q, %v", pastes, cursor, err)
+		}
+
+		stats, err := db.Stats(ctx)
+		if err != nil || stats.Count != 2 || stats.Size != int64(pasteSize(paste)+len("never expires")) {
+			t.Errorf("Wrong stats: %+v, %v", stats, err)
+		}
+	})
+
+	t.Run("Reserve", func(t *testing.T) {
+		db.client.PutObject(ctx, "yep", db.reservationKey("stale"), strings.NewReader(""), 0,
+			minio.PutObjectOptions{UserMetadata: map[string]string{s3MetaExpire: s3Time(now.Add(-time.Minute))}})
+		tt := []struct {
+			path     string
+			reserved bool
+		}{
+			{"free", true},
+			{"free", false},
+			{"never", false},
+			{"expired", true},
+			{"stale", true},
+			{"stale", false},
+		}
+		for _, tc := range tt {
+			if reserved, err := db.ReservePath(ctx, tc.path); reserved != tc.reserved || err != nil {
+				t.Errorf("Reserve %s: expected: %v; got: %v, %v", tc.path, tc.reserved, reserved, err)
+			}
+		}
+
+		stats, err := db.Stats(ctx)
+		if err != nil || stats.Count != 2 {
+			t.Errorf("Reservations listed: %+v, %v", stats, err)
+		}
+		db.Store(ctx, "free", Paste{Path: "free", Created: now})
+		if _, err := fake.backend.HeadObject("yep", db.reservationKey("free")); err == nil {
+			t.Errorf("Reservation not removed by Store")
+		}
+		db.Delete(ctx, "free")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := db.Delete(ctx, "never"); err != nil {
+			t.Fatalf("Could not delete paste: %v", err)
+		}
+		if _, err := db.Get(ctx, "never"); !errors.Is(err, ErrDatabaseNotFound) {
+			t.Errorf("Paste not deleted")
+		}
+	})
+}
+
+func TestS3DBList(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestS3DB(t, false)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		path := "paste" + strconv.Itoa(i)
+		p := Paste{Path: path, Source: "code", Created: start.Add(time.Duration(i) * time.Minute)}
+		if i%2 == 0 {
+			p.Visibility = VisibilityPublic
+		}
+		if i == 3 {
+			p.Path = "paste2/1"
+		}
+		db.Store(ctx, p.Path, p)
+	}
+	//Storing again with another creation time leaves only the new index objects
+	db.Store(ctx, "paste0", Paste{Path: "paste0", Source: "code", Created: start.Add(time.Hour)})
+
+	list := func(opts ListOptions) []string {
+		paths := []string{}
+		for {
+			pastes, cursor, err := db.List(ctx, opts)
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			for _, p := range pastes {
+				paths = append(paths, p.Path)
+			}
+			if cursor == "" {
+				return paths
+			}
+			opts.Cursor = cursor
+		}
+	}
+	tt := []struct {
+		name  string
+		opts  ListOptions
+		paths []string
+	}{
+		{"All", ListOptions{Limit: 3}, []string{"paste1", "paste2", "paste2/1", "paste4", "paste5", "paste6", "paste7", "paste8", "paste9", "paste0"}},
+		{"Public", ListOptions{Limit: 2, Visibility: VisibilityPublic}, []string{"paste2", "paste4", "paste6", "paste8"}},
+		{"Latest", ListOptions{Limit: 4, Latest: true, Until: start.Add(5 * time.Minute)}, []string{"paste1", "paste2", "paste4"}},
+		{"Reverse", ListOptions{Limit: 3, Reverse: true, Since: start.Add(5 * time.Minute)}, []string{"paste0", "paste9", "paste8", "paste7", "paste6", "paste5"}},
+		{"Reverse public", ListOptions{Limit: 1, Reverse: true, Visibility: VisibilityPublic, Until: start.Add(5 * time.Minute)}, []string{"paste4", "paste2"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if paths := list(tc.opts); !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("Expected: %v; got: %v", tc.paths, paths)
+			}
+		})
+	}
+
+	indexed := func(index string) int {
+		var count int
+		for range db.client.ListObjects(ctx, "yep", minio.ListObjectsOptions{Prefix: db.indexDir(index)}) {
+			count++
+		}
+		return count
+	}
+	t.Run("Index", func(t *testing.T) {
+		if count := indexed("created"); count != 10 {
+			t.Errorf("Expected: 10; got: %d", count)
+		}
+		if count := indexed("public"); count != 4 {
+			t.Errorf("Expected: 4; got: %d", count)
+		}
+	})
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		db.Store(ctx, "expired", Paste{Path: "expired", Source: "expired", Visibility: VisibilityPublic, Created: start, Expire: start.Add(-time.Minute)})
+		if stats, err := db.Stats(ctx); err != nil || stats.Count != 10 {
+			t.Errorf("Expected: 10 pastes; got: %+v, %v", stats, err)
+		}
+		//Deleted by the lifecycle rules
+		fake.backend.DeleteObject("yep", db.key("expired"))
+		if stats, err := db.Stats(ctx); err != nil || stats.Count != 10 {
+			t.Errorf("Expected: 10 pastes; got: %+v, %v", stats, err)
+		}
+		if count := indexed("created") + indexed("public") + indexed(s3ExpiresIndex); count != 14 {
+			t.Errorf("Expected: 14 index objects; got: %d", count)
+		}
+	})
+
+	t.Run("Reindex", func(t *testing.T) {
+		db.client.RemoveObject(ctx, "yep", db.indexedKey(), minio.RemoveObjectOptions{})
+		for _, index := range []string{"created", "public", s3ExpiresIndex} {
+			for info := range db.client.ListObjects(ctx, "yep", minio.ListObjectsOptions{Prefix: db.indexDir(index)}) {
+				db.client.RemoveObject(ctx, "yep", info.Key, minio.RemoveObjectOptions{})
+			}
+		}
+		if paths := list(ListOptions{}); len(paths) != 0 {
+			t.Fatalf("Index not removed: %v", paths)
+		}
+		if err := db.indexPastes(ctx); err != nil {
+			t.Fatalf("Could not index: %v", err)
+		}
+		if paths := list(ListOptions{}); !reflect.DeepEqual(paths, tt[0].paths) {
+			t.Errorf("Expected: %v; got: %v", tt[0].paths, paths)
+		}
+	})
+}
+
+func TestS3ExpireDays(t *testing.T) {
+	tm := []struct {
+		ttl  time.Duration
+		days int
+	}{
+		{time.Hour, 1},
+		{24 * time.Hour, 1},
+		{25 * time.Hour, 2},
+		{10 * 24 * time.Hour, 16},
+		{s3MaxExpireDays * 24 * time.Hour, s3MaxExpireDays},
+		{(s3MaxExpireDays + 1) * 24 * time.Hour, 0},
+	}
+
+	for _, tt := range tm {
+		t.Run(strconv.Itoa(tt.days), func(t *testing.T) {
+			if days := s3ExpireDays(tt.ttl); days != tt.days {
+				t.Errorf("Expected: %d; got: %d", tt.days, days)
+			}
+		})
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+//Errors declaration for the search
+var (
+	ErrSearchQueryEmpty   = fmt.Errorf("Search query empty")
+	ErrSearchDateNotValid = fmt.Errorf("Date not valid, use YYYY-MM-DD or RFC 3339")
+)
+
+//searchMaxTermLen is the length in bytes of the longest word indexed, longer words are usually encoded data
+const searchMaxTermLen = 64
+
+//Lengths in bytes of the snippets of the results
+const (
+	snippetBefore = 60
+	snippetLen    = 240
+)
+
+//searchDB is a DatabaseV2 keeping a full-text index of the sources of the pastes it stores
+type searchDB struct {
+	db    DatabaseV2
+	index *searchIndex
+}
+
+//newSearchDB creates a searchDB wrapping db, the pastes already in db are indexed
+func newSearchDB(ctx context.Context, db DatabaseV2) (*searchDB, error) {
+	sdb := &searchDB{db: db, index: newSearchIndex()}
+	err := eachPaste(ctx, db, ListOptions{}, func(p Paste) error {
+		sdb.index.add(p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sdb, nil
+}
+
+//findSearchDB returns the searchDB wrapped by db, nil if the search is disabled
+func findSearchDB(db DatabaseV2) *searchDB {
+	for {
+		switch d := db.(type) {
+		case *searchDB:
+			return d
+		case *replicaDB:
+			db = d.db
+		case *clusterDB:
+			db = d.local
+		default:
+			return nil
+		}
+	}
+}
+
+//Get implements DatabaseV2
+func (db *searchDB) Get(ctx context.Context, name string) (Paste, error) {
+	return db.db.Get(ctx, name)
+}
+
+//GetEncoded implements encodedDatabase
+func (db *searchDB) GetEncoded(ctx context.Context, name string) (Paste, error) {
+	if edb, ok := db.db.(encodedDatabase); ok {
+		return edb.GetEncoded(ctx, name)
+	}
+	return db.db.Get(ctx, name)
+}
+
+//Store implements DatabaseV2
+func (db *searchDB) Store(ctx context.Context, name string, value Paste) error {
+	if err := db.db.Store(ctx, name, value); err != nil {
+		return err
+	}
+	value.Path = name
+	db.index.add(value)
+	return nil
+}
+
+//Delete implements DatabaseV2
+func (db *searchDB) Delete(ctx context.Context, name string) error {
+	if err := db.db.Delete(ctx, name); err != nil {
+		return err
+	}
+	db.index.remove(name)
+	return nil
+}
+
+//ReservePath implements DatabaseV2
+func (db *searchDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	return db.db.ReservePath(ctx, path)
+}
+
+//List implements DatabaseV2
+func (db *searchDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	return db.db.List(ctx, opts)
+}
+
+//Stats implements DatabaseV2
+func (db *searchDB) Stats(ctx context.Context) (DatabaseStats, error) { return db.db.Stats(ctx) }
+
+//ExpiresPastes implements expiringDatabase
+func (db *searchDB) ExpiresPastes() bool { return expiresPastes(db.db) }
+
+//Close implements DatabaseV2
+func (db *searchDB) Close() error { return db.db.Close() }
+
+//searchIndex is an inverted index from the words of the sources to the pastes containing them
+type searchIndex struct {
+	mu sync.RWMutex
+	//postings are the occurrences of every word in every paste
+	postings map[string]map[string]int
+	//docs are the indexed pastes without their content, used for filtering the results
+	docs map[string]searchDoc
+}
+
+type searchDoc struct {
+	paste Paste
+	terms []string
+}
+
+//searchHit is a paste found by a search
+type searchHit struct {
+	paste Paste
+	score int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]int),
+		docs:     make(map[string]searchDoc),
+	}
+}
+
+//add indexes the paste, replacing the paste with the same path
+//The old revisions are not indexed
+func (idx *searchIndex) add(p Paste) {
+	if p.isRevision() {
+		return
+	}
+	counts := make(map[string]int)
+	for _, span := range wordSpans(p.Source) {
+		counts[strings.ToLower(p.Source[span[0]:span[1]])]++
+	}
+	terms := make([]string, 0, len(counts))
+	for term := range counts {
+		terms = append(terms, term)
+	}
+	p.Source, p.Content, p.Style = "", "", ""
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.unindex(p.Path)
+	for term, count := range counts {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string]int)
+		}
+		idx.postings[term][p.Path] = count
+	}
+	idx.docs[p.Path] = searchDoc{paste: p, terms: terms}
+}
+
+//remove removes the paste from the index
+func (idx *searchIndex) remove(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.unindex(path)
+}
+
+func (idx *searchIndex) unindex(path string) {
+	doc, ok := idx.docs[path]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(idx.postings[term], path)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, path)
+}
+
+//search returns the pastes containing every term and matching the filters of opts
+//allowed selects the pastes the user can see, the expired pastes are never returned
+//The pastes with more occurrences of the terms come first, then the newest
+func (idx *searchIndex) search(terms []string, opts ListOptions, allowed func(Paste) bool) []searchHit {
+	if len(terms) == 0 {
+		return nil
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	//Start from the rarest term so fewer pastes are checked
+	sort.Slice(terms, func(i, j int) bool { return len(idx.postings[terms[i]]) < len(idx.postings[terms[j]]) })
+	now := time.Now()
+	var hits []searchHit
+	for path, count := range idx.postings[terms[0]] {
+		score := count
+		for _, term := range terms[1:] {
+			n := idx.postings[term][path]
+			if n == 0 {
+				score = 0
+				break
+			}
+			score += n
+		}
+		if score == 0 {
+			continue
+		}
+		p := idx.docs[path].paste
+		if (p.Expires() && !p.Expire.After(now)) || !opts.match(p) || !allowed(p) {
+			continue
+		}
+		hits = append(hits, searchHit{p, score})
+	}
+	sortHits(hits)
+	return hits
+}
+
+//sortHits sorts the hits, the pastes with more occurrences of the terms come first, then the newest
+func sortHits(hits []searchHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return pasteBefore(hits[j].paste, hits[i].paste)
+	})
+}
+
+//isWordRune reports if r is part of a word, the identifiers with underscores are a single word
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+//wordSpans returns the start and the end of the indexed words of s
+func wordSpans(s string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start <= searchMaxTermLen {
+			spans = append(spans, [2]int{start, i})
+		}
+		start = -1
+	}
+	if start >= 0 && len(s)-start <= searchMaxTermLen {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+//searchTerms returns the words of the query, without duplicates
+func searchTerms(query string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, span := range wordSpans(query) {
+		term := strings.ToLower(query[span[0]:span[1]])
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+//snippetPart is a piece of a snippet, Match is set on the words of the query
+type snippetPart struct {
+	Text  string
+	Match bool
+}
+
+//snippet returns the part of the source around the first word of the query
+func snippet(source string, terms []string) []snippetPart {
+	match := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		match[term] = true
+	}
+	spans := wordSpans(source)
+	start := 0
+	for _, span := range spans {
+		if match[strings.ToLower(source[span[0]:span[1]])] {
+			start = span[0] - snippetBefore
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLen
+	if end > len(source) {
+		end = len(source)
+	}
+	//Do not cut a multi-byte character
+	for start > 0 && !utf8.RuneStart(source[start]) {
+		start--
+	}
+	for end < len(source) && !utf8.RuneStart(source[end]) {
+		end--
+	}
+
+	var parts []snippetPart
+	if start > 0 {
+		parts = append(parts, snippetPart{Text: "…"})
+	}
+	last := start
+	for _, span := range spans {
+		if span[0] < start || span[1] > end || !match[strings.ToLower(source[span[0]:span[1]])] {
+			continue
+		}
+		if span[0] > last {
+			parts = append(parts, snippetPart{Text: source[last:span[0]]})
+		}
+		parts = append(parts, snippetPart{Text: source[span[0]:span[1]], Match: true})
+		last = span[1]
+	}
+	if end > last {
+		parts = append(parts, snippetPart{Text: source[last:end]})
+	}
+	if end < len(source) {
+		parts = append(parts, snippetPart{Text: "…"})
+	}
+	return parts
+}
+
+//searchRequest is a search made with the page or with the API
+type searchRequest struct {
+	terms  []string
+	opts   ListOptions
+	offset int
+	limit  int
+}
+
+//searchPageSize is the number of results returned when the request does not choose it
+const searchPageSize = 20
+
+//searchMaxLimit is the maximum number of results returned at once
+const searchMaxLimit = 100
+
+//parseSearchRequest reads the search from the query parameters q, lang, user, since, until, offset and limit
+//until includes the whole day when it is a date
+func parseSearchRequest(query url.Values) (searchRequest, error) {
+	r := searchRequest{
+		terms: searchTerms(query.Get("q")),
+		opts: ListOptions{
+			Lang: query.Get("lang"),
+			User: query.Get("user"),
+		},
+		limit: searchPageSize,
+	}
+	if len(r.terms) == 0 {
+		return r, ErrSearchQueryEmpty
+	}
+
+	var err error
+	if r.opts.Since, err = parseSearchDate(query.Get("since"), false); err != nil {
+		return r, err
+	}
+	if r.opts.Until, err = parseSearchDate(query.Get("until"), true); err != nil {
+		return r, err
+	}
+	if n, err := strconv.Atoi(query.Get("offset")); err == nil && n > 0 {
+		r.offset = n
+	}
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+		r.limit = n
+	}
+	if r.limit > searchMaxLimit {
+		r.limit = searchMaxLimit
+	}
+	return r, nil
+}
+
+//parseSearchDate parses a date or an RFC 3339 time, the zero time if empty
+//If end is set a date is the end of the day
+func parseSearchDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, ErrSearchDateNotValid
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+//searchResult is a paste found by a search with the snippet of its source
+type searchResult struct {
+	Paste
+	Snippet []snippetPart
+}
+
+//searchPastes runs the search, the request sees the public pastes and the pastes of its uploader
+//It returns the page of results selected by offset and limit and the total number of results
+func (s Server) searchPastes(req *http.Request, r searchRequest) ([]searchResult, int, error) {
+	u, _ := s.requestUploader(req)
+	if account, err := s.apiAccount(req); err == nil && account != nil {
+		u.account = account
+	}
+	var hits []searchHit
+	var total int
+	if s.cluster != nil {
+		var err error
+		hits, total, err = s.cluster.search(req.Context(), s.search.index, r.terms, r.opts, u, r.offset+r.limit)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		hits = s.search.index.search(r.terms, r.opts, func(p Paste) bool {
+			return p.visibility() == VisibilityPublic || u.owns(p)
+		})
+		total = len(hits)
+	}
+
+	if r.offset >= len(hits) {
+		return nil, total, nil
+	}
+	hits = hits[r.offset:]
+	if len(hits) > r.limit {
+		hits = hits[:r.limit]
+	}
+
+	results := make([]searchResult, 0, len(hits))
+	for _, hit := range hits {
+		p, err := s.db.Get(req.Context(), hit.paste.Path)
+		if errors.Is(err, ErrDatabaseNotFound) {
+			//Expired in a database deleting the pastes by itself
+			s.search.index.remove(hit.paste.Path)
+			total--
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		results = append(results, searchResult{Paste: p, Snippet: snippet(p.Source, r.terms)})
+	}
+	return results, total, nil
+}
+
+//searchPageResult is a row of the search page
+type searchPageResult struct {
+	searchResult
+	CreatedFormatted string
+}
+
+//Handle: /search
+//The query parameters are the ones of parseSearchRequest
+func handleSearch(s Server, w http.ResponseWriter, req *http.Request) {
+	t, err := getTemplate(s.cfg.AssetsDir, "search")
+	if err != nil {
+		s.logger(req).Error("Cannot get template", "template", "search", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal server error")
+		return
+	}
+
+	query := req.URL.Query()
+	page := struct {
+		Header  string
+		Langs   []string
+		Form    url.Values
+		Error   string
+		Results []searchPageResult
+		Total   int
+		//Prev and Next are the query strings of the other pages, empty if there is none
+		Prev string
+		Next string
+	}{
+		Header: s.cfg.Header,
+		Langs:  getLanguages(),
+		Form:   query,
+	}
+
+	r, err := parseSearchRequest(query)
+	if err == nil {
+		var results []searchResult
+		results, page.Total, err = s.searchPastes(req, r)
+		for _, result := range results {
+			page.Results = append(page.Results, searchPageResult{result, result.Created.Format(s.cfg.TimeFormat)})
+		}
+	}
+	switch {
+	case err == ErrSearchQueryEmpty && query.Get("q") == "":
+		//The form without a search
+	case err == ErrSearchQueryEmpty || err == ErrSearchDateNotValid:
+		w.WriteHeader(http.StatusBadRequest)
+		page.Error = err.Error()
+	case err != nil:
+		s.logger(req).Error("Cannot search pastes", "error", err)
+		w.WriteHeader(databaseErrorStatus(err))
+		page.Error = http.StatusText(databaseErrorStatus(err))
+	}
+
+	pageQuery := func(offset int) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("offset", strconv.Itoa(offset))
+		return "?" + q.Encode()
+	}
+	if r.offset > 0 {
+		prev := r.offset - r.limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Prev = pageQuery(prev)
+	}
+	if r.offset+r.limit < page.Total {
+		page.Next = pageQuery(r.offset + r.limit)
+	}
+
+	if err := t.Execute(w, page); err != nil {
+		s.logger(req).Error("Cannot execute template", "template", "search", "error", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	db, err := newSearchDB(ctx, AdaptDatabase(NewMemoryDB()))
+	if err != nil {
+		t.Fatalf("Could not create database: %v", err)
+	}
+	start := time.Now().Add(-time.Hour)
+	pastes := []Paste{
+		{Path: "trace", User: "alice", Lang: "Java", Source: "java.lang.NullPointerException\n\tat Main.run(Main.java:10)"},
+		{Path: "go", User: "bob", Lang: "Go", Source: "panic: runtime error: invalid memory address or nil pointer dereference"},
+		{Path: "python", User: "alice", Lang: "Python", Source: "Traceback: KeyError 'user_id' KeyError"},
+		{Path: "expired", User: "carl", Lang: "Go", Source: "runtime error", Expire: time.Now().Add(-time.Minute)},
+		{Path: "deleted", User: "dan", Lang: "Go", Source: "runtime error"},
+	}
+	for i, p := range pastes {
+		p.Created = start.Add(time.Duration(i) * time.Minute)
+		if err := db.Store(ctx, p.Path, p); err != nil {
+			t.Fatalf("Could not store paste: %v", err)
+		}
+	}
+	db.Delete(ctx, "deleted")
+	//Storing again replaces the words of the paste
+	db.Store(ctx, "python", Paste{Path: "python", User: "alice", Lang: "Python", Source: "Traceback: KeyError 'user_id'", Created: start.Add(2 * time.Minute)})
+
+	tt := []struct {
+		name  string
+		query string
+		opts  ListOptions
+		paths []string
+	}{
+		{"Word", "nullpointerexception", ListOptions{}, []string{"trace"}},
+		{"Every word", "runtime ERROR", ListOptions{}, []string{"go"}},
+		{"Missing word", "runtime java", ListOptions{}, nil},
+		{"Identifier", "user_id", ListOptions{}, []string{"python"}},
+		{"Replaced", "keyerror", ListOptions{}, []string{"python"}},
+		{"Lang", "error", ListOptions{Lang: "Python"}, nil},
+		{"User", "traceback", ListOptions{User: "alice"}, []string{"python"}},
+		{"Since", "error", ListOptions{Since: start.Add(time.Minute)}, []string{"go"}},
+		{"Until", "error", ListOptions{Until: start.Add(time.Minute)}, nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var paths []string
+			for _, hit := range db.index.search(searchTerms(tc.query), tc.opts, func(Paste) bool { return true }) {
+				paths = append(paths, hit.paste.Path)
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("Expected: %v; got: %v", tc.paths, paths)
+			}
+		})
+	}
+
+	if _, ok := db.index.docs["deleted"]; ok {
+		t.Errorf("Expected: deleted paste removed from the index")
+	}
+	if n := db.index.postings["keyerror"]["python"]; n != 1 {
+		t.Errorf("Expected: 1 occurrence; got: %d", n)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tt := []struct {
+		name   string
+		source string
+		terms  []string
+		parts  []snippetPart
+	}{
+		{"Highlight", "Error: key Error", []string{"error"}, []snippetPart{{"Error", true}, {": key ", false}, {"Error", true}}},
+		{"No match", "package main", []string{"other"}, []snippetPart{{"package main", false}}},
+		{"Part of a word", "errors", []string{"error"}, []snippetPart{{"errors", false}}},
+		{"Cut", string(make([]byte, 100)) + "needle" + string(make([]byte, 300)), []string{"needle"}, []snippetPart{
+			{"…", false}, {string(make([]byte, 60)), false}, {"needle", true}, {string(make([]byte, 174)), false}, {"…", false},
+		}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if parts := snippet(tc.source, tc.terms); !reflect.DeepEqual(parts, tc.parts) {
+				t.Errorf("Expected: %+v; got: %+v", tc.parts, parts)
+			}
+		})
+	}
+}
+
+func TestAPISearch(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultCfg
+	cfg.AccessLog = false
+	db, err := newSearchDB(ctx, AdaptDatabase(NewMemoryDB()))
+	if err != nil {
+		t.Fatalf("Could not create database: %v", err)
+	}
+	s := NewServer(db, cfg)
+	s.handleRoute("/api/v1/search", handleAPISearch)
+	s.handleRoute("/search", handleSearch)
+
+	now := time.Now()
+	expire := now.Add(time.Hour)
+	for _, p := range []Paste{
+		{Path: "public", User: "alice", Lang: "Go", Visibility: VisibilityPublic, Source: "stack trace of public", Created: now},
+		{Path: "unlisted", User: "alice", Lang: "Go", Source: "stack trace of unlisted", Created: now},
+		{Path: "private", User: "alice", Lang: "Go", Visibility: VisibilityPrivate, Owner: hashToken("token"), Source: "stack trace of private", Created: now},
+		{Path: "old", User: "bob", Lang: "Python", Visibility: VisibilityPublic, Source: "stack trace of old", Created: now.AddDate(0, 0, -10), Expire: expire},
+	} {
+		db.Store(ctx, p.Path, p)
+	}
+
+	tt := []struct {
+		name  string
+		query string
+		owner string
+		code  int
+		paths []string
+	}{
+		{"Public", "?q=stack+trace", "", http.StatusOK, []string{"public", "old"}},
+		{"Owner", "?q=trace", "token", http.StatusOK, []string{"public", "private", "old"}},
+		{"Other owner", "?q=private", "other", http.StatusOK, []string{}},
+		{"Lang", "?q=trace&lang=Python", "", http.StatusOK, []string{"old"}},
+		{"User", "?q=trace&user=alice", "", http.StatusOK, []string{"public"}},
+		{"Since", "?q=trace&since=" + now.AddDate(0, 0, -1).Format("2006-01-02"), "", http.StatusOK, []string{"public"}},
+		{"Until", "?q=trace&until=" + now.AddDate(0, 0, -10).Format("2006-01-02"), "", http.StatusOK, []string{"old"}},
+		{"Limit", "?q=trace&limit=1&offset=1", "", http.StatusOK, []string{"old"}},
+		{"Empty", "?q=+", "", http.StatusBadRequest, nil},
+		{"Date not valid", "?q=trace&since=yesterday", "", http.StatusBadRequest, nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/search"+tc.query, nil)
+			if tc.owner != "" {
+				req.AddCookie(&http.Cookie{Name: ownerCookie, Value: tc.owner})
+			}
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, req)
+			if res.Code != tc.code {
+				t.Fatalf("Expected: %d; got: %d", tc.code, res.Code)
+			}
+			var output searchResponse
+			if err := json.Unmarshal(res.Body.Bytes(), &output); err != nil {
+				t.Fatalf("Could not decode output: %v", err)
+			}
+			if output.OK != (tc.code == http.StatusOK) {
+				t.Errorf("Expected: OK %v; got: %v", tc.code == http.StatusOK, output.OK)
+			}
+			paths := []string{}
+			for _, result := range output.Results {
+				paths = append(paths, result.Path)
+				if len(result.Highlights) == 0 {
+					t.Errorf("Expected: highlights in %q", result.Snippet)
+				}
+				//The same unit of /api/get
+				if result.Path == "old" && result.Expire != expire.UnixNano() {
+					t.Errorf("Expected: %d; got: %d", expire.UnixNano(), result.Expire)
+				}
+			}
+			if tc.paths != nil && !reflect.DeepEqual(paths, tc.paths) {
+				t.Errorf("Expected: %v; got: %v", tc.paths, paths)
+			}
+		})
+	}
+
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/search?q=public", nil))
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "<mark>public</mark>") {
+		t.Errorf("Expected: highlighted result; got: %d\n%s", res.Code, res.Body)
+	}
+}
+
+func TestSearchSharedDatabase(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tt := []struct {
+		name   string
+		db     databaseConfig
+		search bool
+	}{
+		{"SQLite", databaseConfig{Type: DatabaseSQLite, Path: filepath.Join(t.TempDir(), "yep.db")}, true},
+		{"Redis", databaseConfig{Type: DatabaseRedis, URL: "redis://" + mr.Addr(), Prefix: "yep:"}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultCfg
+			cfg.Database = tc.db
+			srv, err := openServer(cfg, newLogger(cfg), true)
+			if err != nil {
+				t.Fatalf("Could not open server: %v", err)
+			}
+			defer srv.Close()
+			if search := srv.search != nil; search != tc.search {
+				t.Errorf("Expected: search %v; got: %v", tc.search, search)
+			}
+		})
+	}
+}
@@ -1,32 +1,102 @@
 package main
 
-import "net/http"
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+)
 
 //Server is a YeP server
 //Implements http.Handler
 type Server struct {
-	db  Database
-	mux *http.ServeMux
-	cfg config
+	db    DatabaseV2
+	mux   *http.ServeMux
+	admin *http.ServeMux
+	cfg   config
+	log   *slog.Logger
+
+	timers *expireTimers
+	views  *viewCounter
+	paths  *pathCreator
+	//customPath is the pattern of the paths chosen by the users, nil if they are disabled
+	customPath *regexp.Regexp
+	routes     *routePrefixes
+	//cluster is the database of the cluster, nil if the cluster mode is disabled
+	cluster *clusterDB
+	//replica is the database replicated to the followers, nil if the replication is disabled
+	replica *replicaDB
+	//accounts are the user accounts, nil if they are disabled
+	accounts *accountStore
+	sessions *sessionStore
+	//oidc is the login with OpenID Connect, nil if it is disabled
+	oidc *oidcLogin
+	//search is the database keeping the full-text index, nil if the search is disabled
+	search *searchDB
 }
 
 //NewServer creates a new server
-func NewServer(db Database, cfg config) Server {
+func NewServer(db DatabaseV2, cfg config) Server {
 	s := Server{
-		db:  db,
-		mux: http.NewServeMux(),
-		cfg: cfg,
+		db:    db,
+		mux:   http.NewServeMux(),
+		admin: http.NewServeMux(),
+		cfg:   cfg,
+		log:   newLogger(cfg),
+
+		timers: newExpireTimers(),
+		views:  newViewCounter(),
+		routes: newRoutePrefixes(),
+	}
+	gen, err := newPathGenerator(cfg.Paths, cfg.PathLen, db)
+	if err != nil {
+		s.log.Error("Cannot create the path generator, using random paths", "error", err)
+		gen = randomPaths{cfg.PathLen}
 	}
+	s.paths = newPathCreator(gen, cfg.Paths.GrowAfter)
+	if cfg.CustomPaths.Pattern != "" {
+		//The pattern must match the whole path
+		pattern, err := regexp.Compile("^(?:" + cfg.CustomPaths.Pattern + ")$")
+		if err != nil {
+			s.log.Error("Cannot compile the pattern of the custom paths, they are disabled", "error", err)
+		} else {
+			s.customPath = pattern
+		}
+	}
+	s.cluster, _ = db.(*clusterDB)
+	s.replica, _ = db.(*replicaDB)
+	if s.replica != nil {
+		s.cluster, _ = s.replica.db.(*clusterDB)
+	}
+	s.search = findSearchDB(db)
 	return s
 }
 
+//handleRoute registers a route, the first segment of the pattern cannot be used as path by the pastes
 func (s *Server) handleRoute(pattern string, r Route) {
-	s.mux.HandleFunc(pattern, routeToHandler(r, s))
+	s.routes.add(pattern)
+	s.mux.HandleFunc(pattern, routeToHandler(observeRoute(pattern, r), s))
+}
+
+func (s *Server) handleAdminRoute(pattern string, r Route) {
+	s.admin.HandleFunc(pattern, routeToHandler(observeRoute(pattern, r), s))
+}
+
+//AdminHandler returns the http.Handler serving the admin routes
+func (s Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.serveLogged(s.admin, w, req)
+	})
+}
+
+//Close stops the expire timers and closes the database
+func (s Server) Close() error {
+	s.timers.stop()
+	return s.db.Close()
 }
 
 //Route is a Server Route
 type Route func(s Server, w http.ResponseWriter, req *http.Request)
 
 func (s Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.mux.ServeHTTP(w, req)
+	s.serveLogged(s.mux, w, req)
 }
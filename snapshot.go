@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//snapshotVersion is the version of the snapshots written
+//Fields added to snapshotPaste must be optional, older snapshots are loaded with the zero value
+const snapshotVersion = 1
+
+//ErrSnapshotVersion is used when the snapshot version is not supported
+var ErrSnapshotVersion = fmt.Errorf("Snapshot version not supported")
+
+//snapshot is the content of a snapshot file
+type snapshot struct {
+	Version int
+	Created time.Time
+	Pastes  []snapshotPaste
+}
+
+//snapshotPaste is a paste saved in a snapshot
+type snapshotPaste struct {
+	Path       string
+	User       string
+	UserID     string `json:",omitempty"`
+	Owner      string `json:",omitempty"`
+	Visibility string `json:",omitempty"`
+	Lang       string
+	Source     string
+	Style      string
+	Content    string
+	Encoding   string
+	Created    time.Time
+	Expire     time.Time
+	Revision   int `json:",omitempty"`
+}
+
+func newSnapshotPaste(p Paste) snapshotPaste {
+	return snapshotPaste{
+		Path:       p.Path,
+		User:       p.User,
+		UserID:     p.UserID,
+		Owner:      p.Owner,
+		Visibility: p.Visibility,
+		Lang:       p.Lang,
+		Source:     p.Source,
+		Style:      string(p.Style),
+		Content:    string(p.Content),
+		Encoding:   p.Encoding,
+		Created:    p.Created,
+		Expire:     p.Expire,
+		Revision:   p.Revision,
+	}
+}
+
+func (p snapshotPaste) paste() Paste {
+	return Paste{
+		Path:       p.Path,
+		User:       p.User,
+		UserID:     p.UserID,
+		Owner:      p.Owner,
+		Visibility: p.Visibility,
+		Lang:       p.Lang,
+		Source:     p.Source,
+		Style:      template.CSS(p.Style),
+		Content:    template.HTML(p.Content),
+		Encoding:   p.Encoding,
+		Created:    p.Created,
+		Expire:     p.Expire,
+		Revision:   p.Revision,
+	}
+}
+
+//writeSnapshot writes a snapshot of all the pastes in db
+func writeSnapshot(w io.Writer, db *MemoryDB) error {
+	pastes, _, err := db.List(ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{
+		Version: snapshotVersion,
+		Created: time.Now(),
+		Pastes:  make([]snapshotPaste, len(pastes)),
+	}
+	for i, p := range pastes {
+		snap.Pastes[i] = newSnapshotPaste(p)
+	}
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+//readSnapshot reads the pastes from a snapshot
+func readSnapshot(r io.Reader) ([]Paste, error) {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	pastes := make([]Paste, len(snap.Pastes))
+	for i, p := range snap.Pastes {
+		pastes[i] = p.paste()
+	}
+	return pastes, nil
+}
+
+//saveSnapshot saves atomically a snapshot of db to path
+func saveSnapshot(path string, db *MemoryDB) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeSnapshot(tmp, db); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//loadSnapshot stores the pastes of the snapshot file in db
+//Expired pastes are discarded, the loaded ones are returned for being scheduled for expiration
+//A missing snapshot file is not an error
+func loadSnapshot(ctx context.Context, db DatabaseV2, path string) ([]Paste, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pastes, err := readSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	loaded := make([]Paste, 0, len(pastes))
+	for _, p := range pastes {
+		if p.Expires() && !p.Expire.After(now) {
+			continue
+		}
+
+		//The database could be configured with a different compression
+		p, err := decodePaste(p)
+		if err != nil {
+			return loaded, err
+		}
+		if err := db.Store(ctx, p.Path, p); err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, p)
+	}
+	return loaded, nil
+}
+
+//snapshotter saves the snapshots of a MemoryDB
+type snapshotter struct {
+	db   *MemoryDB
+	path string
+	log  *slog.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSnapshotter(db *MemoryDB, path string, interval time.Duration, logger *slog.Logger) *snapshotter {
+	s := &snapshotter{
+		db:   db,
+		path: path,
+		log:  logger,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *snapshotter) run(interval time.Duration) {
+	defer close(s.done)
+	if interval == 0 {
+		<-s.stop
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveSnapshot(s.path, s.db); err != nil {
+				s.log.Error("Cannot save snapshot", "path", s.path, "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+//close stops the periodic snapshots and saves the last one
+func (s *snapshotter) close() error {
+	close(s.stop)
+	<-s.done
+	return saveSnapshot(s.path, s.db)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yep-snapshot")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	now := time.Now().Round(0)
+	pastes := []Paste{
+		{Path: "never", User: "user", Lang: "Go", Source: "never expires", Created: now},
+		{Path: "later", User: "user", Lang: "Go", Source: "expires later", Created: now, Expire: now.Add(time.Hour)},
+		{Path: "expired", User: "user", Lang: "Go", Source: "already expired", Created: now, Expire: now.Add(-time.Hour)},
+	}
+
+	src := NewMemoryDB()
+	for _, p := range pastes {
+		src.Store(p.Path, p)
+	}
+	src.EnableSnapshots(path, 0, newLogger(defaultCfg))
+	if err := src.Close(); err != nil {
+		t.Fatalf("Could not save snapshot: %v", err)
+	}
+
+	dst := NewMemoryDB()
+	loaded, err := loadSnapshot(context.Background(), AdaptDatabase(dst), path)
+	if err != nil {
+		t.Fatalf("Could not load snapshot: %v", err)
+	}
+	if len(loaded) != 2 {
+		t.Errorf("Wrong number of pastes loaded: expected: 2; got: %d", len(loaded))
+	}
+
+	for _, p := range pastes[:2] {
+		got, err := dst.Get(p.Path)
+		if err != nil {
+			t.Errorf("Paste not loaded: %s: %v", p.Path, err)
+			continue
+		}
+		if got.User != p.User || got.Lang != p.Lang || got.Source != p.Source || !got.Created.Equal(p.Created) || !got.Expire.Equal(p.Expire) {
+			t.Errorf("Wrong paste: expected: %+v; got: %+v", p, got)
+		}
+	}
+	if _, err := dst.Get("expired"); err != ErrDatabaseNotFound {
+		t.Errorf("Expired paste loaded")
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		loaded, err := loadSnapshot(context.Background(), AdaptDatabase(dst), filepath.Join(dir, "missing.json"))
+		if len(loaded) != 0 || err != nil {
+			t.Errorf("Expected nothing loaded; got: %d, %v", len(loaded), err)
+		}
+	})
+
+	t.Run("Future version", func(t *testing.T) {
+		_, err := readSnapshot(strings.NewReader(`{"Version": 1000, "Pastes": []}`))
+		if err != ErrSnapshotVersion {
+			t.Errorf("Expected: %v; got: %v", ErrSnapshotVersion, err)
+		}
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//ErrSQLiteVersion is used when the schema of the SQLite database is newer than the supported one
+var ErrSQLiteVersion = fmt.Errorf("SQLite schema version not supported")
+
+//sqliteMigrations are the statements upgrading the schema, the schema version is the number of applied migrations
+//New migrations are appended, the applied ones must not be changed
+var sqliteMigrations = []string{
+	`CREATE TABLE pastes (
+		path     TEXT PRIMARY KEY,
+		user     TEXT NOT NULL,
+		lang     TEXT NOT NULL,
+		source   BLOB NOT NULL,
+		style    BLOB NOT NULL,
+		content  BLOB NOT NULL,
+		encoding TEXT NOT NULL,
+		created  INTEGER NOT NULL,
+		expire   INTEGER NOT NULL
+	);
+	CREATE INDEX pastes_created ON pastes (created, path);
+	CREATE INDEX pastes_expire ON pastes (expire) WHERE expire != 0;`,
+	`CREATE TABLE reservations (
+		path   TEXT PRIMARY KEY,
+		expire INTEGER NOT NULL
+	);`,
+	`ALTER TABLE pastes ADD COLUMN user_id TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE pastes ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+	CREATE INDEX pastes_user_id ON pastes (user_id, created, path) WHERE user_id != '';
+	CREATE INDEX pastes_owner ON pastes (owner, created, path) WHERE owner != '';`,
+	`ALTER TABLE pastes ADD COLUMN visibility TEXT NOT NULL DEFAULT '';
+	CREATE INDEX pastes_public ON pastes (created, path) WHERE visibility = 'public';`,
+	`ALTER TABLE pastes ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE sequences (
+		name  TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);`,
+}
+
+//sqlitePathSequence is the name of the counter of the sequential paths
+const sqlitePathSequence = "paths"
+
+const sqliteColumns = "path, user, user_id, owner, visibility, lang, source, style, content, encoding, created, expire, revision"
+
+//SQLiteDB is a Database stored in a SQLite file
+//Expired pastes are never returned and they are deleted by Sweep
+type SQLiteDB struct {
+	db *sql.DB
+
+	sweeper *sweeper
+}
+
+//NewSQLiteDB opens the SQLite database at path, creating it if needed, and upgrades its schema
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	sdb := &SQLiteDB{db: db}
+	if err := sdb.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+//migrate applies the missing migrations
+func (db *SQLiteDB) migrate(ctx context.Context) error {
+	var version int
+	if err := db.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return sqliteError(err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("%w: %d", ErrSQLiteVersion, version)
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.db.BeginTx(ctx, nil)
+		if err != nil {
+			return sqliteError(err)
+		}
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Cannot apply migration %d: %w", version+1, sqliteError(err))
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return sqliteError(err)
+		}
+		if err := tx.Commit(); err != nil {
+			return sqliteError(err)
+		}
+	}
+	return nil
+}
+
+//sqliteError converts the errors of SQLite to the ErrDatabase errors
+func sqliteError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDatabaseNotFound
+	}
+
+	var serr *sqlite.Error
+	if !errors.As(err, &serr) {
+		return err
+	}
+	switch serr.Code() & 0xff {
+	case sqlite3.SQLITE_FULL:
+		return fmt.Errorf("%w: %v", ErrDatabaseQuotaExceeded, err)
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN:
+		return fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+	case sqlite3.SQLITE_CONSTRAINT:
+		return fmt.Errorf("%w: %v", ErrDatabaseConflict, err)
+	}
+	return err
+}
+
+//sqliteTime converts a time to the stored value, the zero time is stored as 0
+func sqliteTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+//parseSQLiteTime converts a stored value to a time
+func parseSQLiteTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//scanPaste reads a paste selected with sqliteColumns
+func scanPaste(row sqliteScanner) (Paste, error) {
+	var p Paste
+	var source, style, content []byte
+	var created, expire int64
+	if err := row.Scan(&p.Path, &p.User, &p.UserID, &p.Owner, &p.Visibility, &p.Lang, &source, &style, &content, &p.Encoding, &created, &expire, &p.Revision); err != nil {
+		return Paste{}, sqliteError(err)
+	}
+
+	p.Source = string(source)
+	p.Style = template.CSS(style)
+	p.Content = template.HTML(content)
+	p.Created = parseSQLiteTime(created)
+	p.Expire = parseSQLiteTime(expire)
+	return p, nil
+}
+
+//Get implements DatabaseV2
+func (db *SQLiteDB) Get(ctx context.Context, name string) (Paste, error) {
+	row := db.db.QueryRowContext(ctx,
+		"SELECT "+sqliteColumns+" FROM pastes WHERE path = ? AND (expire = 0 OR expire > ?)",
+		name, time.Now().UnixNano())
+	return scanPaste(row)
+}
+
+//Store implements DatabaseV2
+func (db *SQLiteDB) Store(ctx context.Context, name string, value Paste) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT OR REPLACE INTO pastes ("+sqliteColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		name, value.User, value.UserID, value.Owner, value.Visibility, value.Lang, []byte(value.Source), []byte(value.Style), []byte(value.Content),
+		value.Encoding, sqliteTime(value.Created), sqliteTime(value.Expire), value.Revision)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM reservations WHERE path = ?", name)
+	}
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	return sqliteError(tx.Commit())
+}
+
+//Delete implements DatabaseV2
+func (db *SQLiteDB) Delete(ctx context.Context, name string) error {
+	_, err := db.db.ExecContext(ctx, "DELETE FROM pastes WHERE path = ?", name)
+	return sqliteError(err)
+}
+
+//ReservePath implements DatabaseV2
+//The reservation is a single statement so it is atomic, ended reservations are replaced
+func (db *SQLiteDB) ReservePath(ctx context.Context, path string) (bool, error) {
+	now := time.Now().UnixNano()
+	res, err := db.db.ExecContext(ctx, `INSERT INTO reservations (path, expire)
+		SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM pastes WHERE path = ? AND (expire = 0 OR expire > ?))
+		ON CONFLICT (path) DO UPDATE SET expire = excluded.expire WHERE reservations.expire <= ?`,
+		path, now+int64(pathReserveTime), path, now, now)
+	if err != nil {
+		return false, sqliteError(err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+//NextSequence implements sequenceDatabase
+//The counter is incremented with a single statement so it is atomic
+func (db *SQLiteDB) NextSequence(ctx context.Context, start func(context.Context) (uint64, error)) (uint64, error) {
+	var exists int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sequences WHERE name = ?", sqlitePathSequence).Scan(&exists)
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+	if exists == 0 {
+		first, err := start(ctx)
+		if err != nil {
+			return 0, err
+		}
+		//Another instance can create the counter in the meantime, its value is kept
+		if _, err := db.db.ExecContext(ctx, "INSERT OR IGNORE INTO sequences (name, value) VALUES (?, ?)", sqlitePathSequence, int64(first)); err != nil {
+			return 0, sqliteError(err)
+		}
+	}
+
+	var next int64
+	err = db.db.QueryRowContext(ctx, "UPDATE sequences SET value = value + 1 WHERE name = ? RETURNING value", sqlitePathSequence).Scan(&next)
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+	return uint64(next - 1), nil
+}
+
+//List implements DatabaseV2
+func (db *SQLiteDB) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	where := []string{"(expire = 0 OR expire > ?)"}
+	args := []interface{}{time.Now().UnixNano()}
+	if opts.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, opts.User)
+	}
+	if opts.Lang != "" {
+		where = append(where, "lang = ?")
+		args = append(args, opts.Lang)
+	}
+	if opts.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, opts.UserID)
+	}
+	if opts.Owner != "" {
+		where = append(where, "owner = ?")
+		args = append(args, opts.Owner)
+	}
+	switch opts.Visibility {
+	case "":
+	case VisibilityUnlisted:
+		where = append(where, "visibility IN ('', ?)")
+		args = append(args, opts.Visibility)
+	default:
+		where = append(where, "visibility = ?")
+		args = append(args, opts.Visibility)
+	}
+	if opts.Latest {
+		where = append(where, "instr(path, '/') = 0")
+	}
+	if !opts.Since.IsZero() {
+		where = append(where, "created >= ?")
+		args = append(args, sqliteTime(opts.Since))
+	}
+	if !opts.Until.IsZero() {
+		where = append(where, "created < ?")
+		args = append(args, sqliteTime(opts.Until))
+	}
+	if opts.Cursor != "" {
+		created, path, err := parseListCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if opts.Reverse {
+			where = append(where, "(created < ? OR (created = ? AND path < ?))")
+		} else {
+			where = append(where, "(created > ? OR (created = ? AND path > ?))")
+		}
+		args = append(args, sqliteTime(created), sqliteTime(created), path)
+	}
+
+	order := " ORDER BY created, path"
+	if opts.Reverse {
+		order = " ORDER BY created DESC, path DESC"
+	}
+	query := "SELECT " + sqliteColumns + " FROM pastes WHERE " + strings.Join(where, " AND ") + order
+	if opts.Limit != 0 {
+		//One more paste tells if there is a next page
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", sqliteError(err)
+	}
+	defer rows.Close()
+
+	var pastes []Paste
+	for rows.Next() {
+		p, err := scanPaste(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		pastes = append(pastes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", sqliteError(err)
+	}
+
+	if opts.Limit == 0 || len(pastes) <= opts.Limit {
+		return pastes, "", nil
+	}
+	pastes = pastes[:opts.Limit]
+	return pastes, listCursor(pastes[len(pastes)-1]), nil
+}
+
+//Stats implements DatabaseV2
+func (db *SQLiteDB) Stats(ctx context.Context) (DatabaseStats, error) {
+	var stats DatabaseStats
+	err := db.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(length(source) + length(style) + length(content)), 0) FROM pastes WHERE expire = 0 OR expire > ?",
+		time.Now().UnixNano()).Scan(&stats.Count, &stats.Size)
+	return stats, sqliteError(err)
+}
+
+//ExpiresPastes implements expiringDatabase
+func (db *SQLiteDB) ExpiresPastes() bool { return db.sweeper != nil }
+
+//Sweep deletes the expired pastes, returning how many were deleted
+//The ended reservations are deleted too but they are not counted
+func (db *SQLiteDB) Sweep(ctx context.Context) (int64, error) {
+	now := time.Now().UnixNano()
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM reservations WHERE expire <= ?", now); err != nil {
+		return 0, sqliteError(err)
+	}
+	res, err := db.db.ExecContext(ctx, "DELETE FROM pastes WHERE expire != 0 AND expire <= ?", now)
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+	return res.RowsAffected()
+}
+
+//EnableSweep calls Sweep now and every interval until the database is closed
+//If interval is zero Sweep is called only now
+func (db *SQLiteDB) EnableSweep(interval time.Duration, logger *slog.Logger) {
+	db.sweeper = newSweeper(db, interval, logger)
+}
+
+//Close implements DatabaseV2
+func (db *SQLiteDB) Close() error {
+	if db.sweeper != nil {
+		db.sweeper.close()
+	}
+	return db.db.Close()
+}
+
+//sweeper deletes periodically the expired pastes of a SQLiteDB
+type sweeper struct {
+	db  *SQLiteDB
+	log *slog.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSweeper(db *SQLiteDB, interval time.Duration, logger *slog.Logger) *sweeper {
+	s := &sweeper{
+		db:   db,
+		log:  logger,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *sweeper) run(interval time.Duration) {
+	defer close(s.done)
+	s.sweep()
+	if interval == 0 {
+		<-s.stop
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *sweeper) sweep() {
+	deleted, err := s.db.Sweep(context.Background())
+	if err != nil {
+		s.log.Error("Cannot delete expired pastes", "error", err)
+		return
+	}
+	if deleted > 0 {
+		metricPastesExpired.Add(float64(deleted))
+		s.log.Info("Deleted expired pastes", "pastes", deleted)
+	}
+}
+
+//close stops the sweeps
+func (s *sweeper) close() {
+	close(s.stop)
+	<-s.done
+}
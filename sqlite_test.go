@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteDB(t *testing.T) (*SQLiteDB, string) {
+	dir, err := ioutil.TempDir("", "yep-sqlite")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "yep.db")
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	return db, path
+}
+
+func TestSQLiteDB(t *testing.T) {
+	ctx := context.Background()
+	db, path := newTestSQLiteDB(t)
+	now := time.Now().Round(0)
+
+	paste := Paste{Path: "test", User: "user", UserID: "id", Owner: "owner", Lang: "Go", Source: "package main", Style: "body{}", Content: "<h1>test</h1>", Encoding: CompressionGzip, Created: now, Expire: now.Add(time.Hour)}
+	if err := db.Store(ctx, paste.Path, paste); err != nil {
+		t.Fatalf("Could not store paste: %v", err)
+	}
+	db.Store(ctx, "never", Paste{Path: "never", Source: "never expires", Created: now})
+	db.Store(ctx, "expired", Paste{Path: "expired", Source: "already expired", Created: now, Expire: now.Add(-time.Hour)})
+
+	got, err := db.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Could not get paste: %v", err)
+	}
+	if got.User != paste.User || got.UserID != paste.UserID || got.Owner != paste.Owner || got.Lang != paste.Lang || got.Source != paste.Source || got.Style != paste.Style || got.Content != paste.Content ||
+		got.Encoding != paste.Encoding || !got.Created.Equal(paste.Created) || !got.Expire.Equal(paste.Expire) {
+		t.Errorf("Wrong paste: expected: %+v; got: %+v", paste, got)
+	}
+	if got, _ := db.Get(ctx, "never"); got.Expires() {
+		t.Errorf("Paste expires: %v", got.Expire)
+	}
+	if _, err := db.Get(ctx, "expired"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+
+	stats, err := db.Stats(ctx)
+	if err != nil || stats.Count != 2 || stats.Size != int64(pasteSize(paste)+len("never expires")) {
+		t.Errorf("Wrong stats: %+v, %v", stats, err)
+	}
+
+	t.Run("Reserve", func(t *testing.T) {
+		db.db.ExecContext(ctx, "INSERT INTO reservations (path, expire) VALUES ('stale', ?)", now.Add(-time.Minute).UnixNano())
+		tt := []struct {
+			path     string
+			reserved bool
+		}{
+			{"free", true},
+			{"free", false},
+			{"never", false},
+			{"expired", true},
+			{"stale", true},
+		}
+		for _, tc := range tt {
+			if reserved, err := db.ReservePath(ctx, tc.path); reserved != tc.reserved || err != nil {
+				t.Errorf("Reserve %s: expected: %v; got: %v, %v", tc.path, tc.reserved, reserved, err)
+			}
+		}
+
+		db.Store(ctx, "free", Paste{Path: "free", Created: now})
+		var count int
+		db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reservations WHERE path = 'free'").Scan(&count)
+		if count != 0 {
+			t.Errorf("Reservation not removed by Store")
+		}
+		db.Delete(ctx, "free")
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		deleted, err := db.Sweep(ctx)
+		if err != nil || deleted != 1 {
+			t.Errorf("Wrong sweep: expected 1 deleted; got: %d, %v", deleted, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := db.Delete(ctx, "never"); err != nil {
+			t.Fatalf("Could not delete paste: %v", err)
+		}
+		if _, err := db.Get(ctx, "never"); !errors.Is(err, ErrDatabaseNotFound) {
+			t.Errorf("Paste not deleted")
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Could not close database: %v", err)
+		}
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			t.Fatalf("Could not reopen database: %v", err)
+		}
+		defer db.Close()
+		if _, err := db.Get(ctx, "test"); err != nil {
+			t.Errorf("Paste not persisted: %v", err)
+		}
+	})
+
+	t.Run("Newer schema", func(t *testing.T) {
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			t.Fatalf("Could not reopen database: %v", err)
+		}
+		db.db.Exec("PRAGMA user_version = 1000")
+		db.Close()
+
+		if _, err := NewSQLiteDB(path); !errors.Is(err, ErrSQLiteVersion) {
+			t.Errorf("Expected: %v; got: %v", ErrSQLiteVersion, err)
+		}
+	})
+}
+
+func TestSQLiteDBList(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestSQLiteDB(t)
+	defer db.Close()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		lang := "Go"
+		if i%2 == 1 {
+			lang = "Python"
+		}
+		path := "paste" + strconv.Itoa(i)
+		p := Paste{Path: path, User: "user", Lang: lang, Source: "code", Created: start.Add(time.Duration(i) * time.Minute)}
+		if i%3 == 0 {
+			p.Owner = "owner"
+		}
+		if i == 4 {
+			p.UserID = "id"
+		}
+		if i%4 == 0 {
+			p.Visibility = VisibilityPublic
+		}
+		db.Store(ctx, path, p)
+	}
+
+	tm := []struct {
+		name  string
+		opts  ListOptions
+		count int
+	}{
+		{"All", ListOptions{Limit: 3}, 10},
+		{"Lang", ListOptions{Limit: 2, Lang: "Python"}, 5},
+		{"Created", ListOptions{Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute)}, 3},
+		{"Reverse created", ListOptions{Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute), Reverse: true}, 3},
+		{"User", ListOptions{User: "other"}, 0},
+		{"Owner", ListOptions{Limit: 2, Owner: "owner"}, 4},
+		{"UserID", ListOptions{UserID: "id"}, 1},
+		{"Public", ListOptions{Visibility: VisibilityPublic}, 3},
+		{"Unlisted", ListOptions{Limit: 2, Visibility: VisibilityUnlisted}, 7},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.name, func(t *testing.T) {
+			var pastes []Paste
+			err := eachPaste(ctx, db, tt.opts, func(p Paste) error {
+				pastes = append(pastes, p)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			if len(pastes) != tt.count {
+				t.Fatalf("Wrong number of pastes: expected: %d; got: %d", tt.count, len(pastes))
+			}
+			for i := 1; i < len(pastes); i++ {
+				if !tt.opts.before(pastes[i-1], pastes[i]) {
+					t.Errorf("Pastes not sorted: %s before %s", pastes[i-1].Path, pastes[i].Path)
+				}
+			}
+		})
+	}
+
+	t.Run("Limit", func(t *testing.T) {
+		pastes, cursor, err := db.List(ctx, ListOptions{Limit: 4})
+		if err != nil || len(pastes) != 4 || cursor == "" {
+			t.Errorf("Wrong page: %d pastes, cursor: %q, %v", len(pastes), cursor, err)
+		}
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		var paths []string
+		opts := ListOptions{Limit: 3, Reverse: true, Since: start.Add(time.Minute)}
+		for {
+			pastes, cursor, err := db.List(ctx, opts)
+			if err != nil {
+				t.Fatalf("Could not list: %v", err)
+			}
+			for _, p := range pastes {
+				paths = append(paths, p.Path)
+			}
+			if cursor == "" {
+				break
+			}
+			opts.Cursor = cursor
+		}
+		if len(paths) != 9 || paths[0] != "paste9" || paths[len(paths)-1] != "paste1" {
+			t.Errorf("Wrong pastes: %v", paths)
+		}
+		for i := 1; i < len(paths); i++ {
+			if paths[i-1] == paths[i] {
+				t.Errorf("Paste listed twice: %s", paths[i])
+			}
+		}
+	})
+}
@@ -1,13 +1,48 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-//ErrDatabaseNotFound is an error used when the database could not find the value
-var ErrDatabaseNotFound = fmt.Errorf("Value not found on the database")
+//Database types
+const (
+	DatabaseMemory = "memory"
+	DatabaseSQLite = "sqlite"
+	DatabaseRedis  = "redis"
+	DatabaseS3     = "s3"
+)
+
+//ErrDatabaseType is used when the database type is not known
+var ErrDatabaseType = fmt.Errorf("Unknown database type")
+
+//Errors returned by the databases, they can be wrapped so check them with errors.Is
+var (
+	//ErrDatabaseNotFound is an error used when the database could not find the value
+	ErrDatabaseNotFound = fmt.Errorf("Value not found on the database")
+	//ErrDatabaseConflict is used when the value already exists on the database
+	ErrDatabaseConflict = fmt.Errorf("Value already exists on the database")
+	//ErrDatabaseQuotaExceeded is used when the database cannot store more values
+	ErrDatabaseQuotaExceeded = fmt.Errorf("Database quota exceeded")
+	//ErrDatabaseUnavailable is used when the database cannot be reached
+	ErrDatabaseUnavailable = fmt.Errorf("Database unavailable")
+)
+
+//ErrCursorNotValid is used when the cursor passed to List is not valid
+var ErrCursorNotValid = fmt.Errorf("Cursor not valid")
 
-//Database is an interface for all the storage system
+//listPageSize is the number of pastes requested for every page when iterating over a Database
+const listPageSize = 100
+
+//Database is the simple interface for a storage system
+//It is used by the Server through AdaptDatabase, new storage systems should implement DatabaseV2
 type Database interface {
 	//Get returns the value associated with the name
 	Get(name string) (Paste, error)
@@ -17,6 +52,392 @@ type Database interface {
 	//Delete deletes a paste from the Database
 	Delete(name string)
 
-	//CreatePastePath creates a path for the paste with the given length
-	CreatePastePath(length int) string
+	//List returns the pastes matching the options sorted by creation time
+	//The returned cursor is used for requesting the next page, it is empty on the last page
+	List(opts ListOptions) ([]Paste, string, error)
+	//Stats returns statistics about the stored pastes
+	Stats() (DatabaseStats, error)
+
+	//Close flushes the pending writes and releases the resources used by the Database
+	Close() error
+}
+
+//DatabaseV2 is the interface for all the storage system
+//The operations are cancelled with the context and every failure is reported,
+//the errors should wrap one of the ErrDatabase errors when possible
+type DatabaseV2 interface {
+	//Get returns the value associated with the name
+	Get(ctx context.Context, name string) (Paste, error)
+	//Store stores the content with the associated name
+	Store(ctx context.Context, name string, value Paste) error
+	//Delete deletes a paste from the Database
+	Delete(ctx context.Context, name string) error
+
+	//ReservePath reserves the path for a new paste, it returns false if the path is used or already reserved
+	//The reservation must be atomic and it ends when the paste is stored or after pathReserveTime
+	ReservePath(ctx context.Context, path string) (bool, error)
+
+	//List returns the pastes matching the options sorted by creation time
+	//The returned cursor is used for requesting the next page, it is empty on the last page
+	List(ctx context.Context, opts ListOptions) ([]Paste, string, error)
+	//Stats returns statistics about the stored pastes
+	Stats(ctx context.Context) (DatabaseStats, error)
+
+	//Close flushes the pending writes and releases the resources used by the Database
+	Close() error
+}
+
+//expiringDatabase is implemented by the databases deleting the expired pastes by themselves
+//The Server does not schedule the expiration of the pastes stored in them
+type expiringDatabase interface {
+	ExpiresPastes() bool
+}
+
+//expiresPastes reports if db deletes the expired pastes by itself
+func expiresPastes(db DatabaseV2) bool {
+	edb, ok := db.(expiringDatabase)
+	return ok && edb.ExpiresPastes()
+}
+
+//sequenceDatabase is implemented by the databases keeping the counter of the sequential paths
+//The counter survives the restarts and it is shared by the instances using the database
+type sequenceDatabase interface {
+	//NextSequence increments the counter and returns its previous value
+	//If the counter does not exist yet it is created with the value returned by start
+	NextSequence(ctx context.Context, start func(context.Context) (uint64, error)) (uint64, error)
+}
+
+//findSequenceDB returns the database keeping the counter of the sequential paths, nil if db cannot keep it
+func findSequenceDB(db DatabaseV2) sequenceDatabase {
+	for {
+		switch d := db.(type) {
+		case sequenceDatabase:
+			return d
+		case *CompressDB:
+			db = d.db
+		case *searchDB:
+			db = d.db
+		case *replicaDB:
+			db = d.db
+		case *clusterDB:
+			db = d.local
+		default:
+			return nil
+		}
+	}
+}
+
+//AdaptDatabase adapts a Database to DatabaseV2
+//The context is checked before every operation
+func AdaptDatabase(db Database) DatabaseV2 {
+	return databaseAdapter{db}
+}
+
+type databaseAdapter struct{ db Database }
+
+//Get implements DatabaseV2
+func (a databaseAdapter) Get(ctx context.Context, name string) (Paste, error) {
+	if err := ctx.Err(); err != nil {
+		return Paste{}, err
+	}
+	return a.db.Get(name)
+}
+
+//Store implements DatabaseV2
+func (a databaseAdapter) Store(ctx context.Context, name string, value Paste) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.db.Store(name, value)
+}
+
+//Delete implements DatabaseV2
+func (a databaseAdapter) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.db.Delete(name)
+	return nil
+}
+
+//pathReserver is implemented by the Databases reserving the paths atomically
+type pathReserver interface {
+	ReservePath(path string) bool
+}
+
+//ReservePath implements DatabaseV2
+//If the Database is not a pathReserver the path is only checked
+func (a databaseAdapter) ReservePath(ctx context.Context, path string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if r, ok := a.db.(pathReserver); ok {
+		return r.ReservePath(path), nil
+	}
+	_, err := a.db.Get(path)
+	if errors.Is(err, ErrDatabaseNotFound) {
+		return true, nil
+	}
+	return false, err
+}
+
+//List implements DatabaseV2
+func (a databaseAdapter) List(ctx context.Context, opts ListOptions) ([]Paste, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return a.db.List(opts)
+}
+
+//Stats implements DatabaseV2
+func (a databaseAdapter) Stats(ctx context.Context) (DatabaseStats, error) {
+	if err := ctx.Err(); err != nil {
+		return DatabaseStats{}, err
+	}
+	return a.db.Stats()
+}
+
+//Close implements DatabaseV2
+func (a databaseAdapter) Close() error { return a.db.Close() }
+
+//databaseErrorStatus returns the HTTP status code describing a database error
+func databaseErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrDatabaseNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDatabaseConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrDatabaseQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrDatabaseUnavailable),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+//ListOptions selects the pastes returned by Database.List
+//Zero values match every paste
+type ListOptions struct {
+	//Cursor is the cursor returned by the previous page, empty for the first page
+	Cursor string
+	//Limit is the maximum number of pastes returned, 0 for no limit
+	Limit int
+
+	User string
+	Lang string
+	//UserID and Owner select the pastes of an uploader, the databases keep an index of them
+	UserID string
+	Owner  string
+	//Visibility selects the pastes with the visibility, the databases keep an index of the public ones
+	Visibility string
+	//Latest excludes the old revisions of the pastes
+	Latest bool
+	//Since and Until select the creation time, Since is included and Until excluded
+	Since time.Time
+	Until time.Time
+	//Reverse lists the newest pastes first, the cursor of the page continues in the same order
+	Reverse bool
+}
+
+//match reports if the paste matches the filters of the options
+func (opts ListOptions) match(p Paste) bool {
+	if opts.User != "" && opts.User != p.User {
+		return false
+	}
+	if opts.Lang != "" && opts.Lang != p.Lang {
+		return false
+	}
+	if opts.UserID != "" && opts.UserID != p.UserID {
+		return false
+	}
+	if opts.Owner != "" && opts.Owner != p.Owner {
+		return false
+	}
+	if opts.Visibility != "" && opts.Visibility != p.visibility() {
+		return false
+	}
+	if opts.Latest && p.isRevision() {
+		return false
+	}
+	if !opts.Since.IsZero() && p.Created.Before(opts.Since) {
+		return false
+	}
+	if !opts.Until.IsZero() && !p.Created.Before(opts.Until) {
+		return false
+	}
+	return true
+}
+
+//pasteIndexes returns the keys of the secondary indexes containing the paste
+//They index the pastes of every uploader and the public pastes
+func pasteIndexes(p Paste) []string {
+	var keys []string
+	if p.visibility() == VisibilityPublic {
+		keys = append(keys, "public")
+	}
+	if p.UserID != "" {
+		keys = append(keys, "user:"+p.UserID)
+	}
+	if p.Owner != "" {
+		keys = append(keys, "owner:"+p.Owner)
+	}
+	return keys
+}
+
+//index returns the key of the secondary index selected by the options, empty if none
+func (opts ListOptions) index() string {
+	if opts.UserID != "" {
+		return "user:" + opts.UserID
+	}
+	if opts.Owner != "" {
+		return "owner:" + opts.Owner
+	}
+	if opts.Visibility == VisibilityPublic {
+		return "public"
+	}
+	return ""
+}
+
+//DatabaseStats are statistics about the pastes stored in a Database
+type DatabaseStats struct {
+	//Count is the number of pastes
+	Count int
+	//Size is the size in bytes of the pastes
+	Size int64
+}
+
+//pasteSize returns the size of a paste as stored
+func pasteSize(p Paste) int {
+	return len(p.Source) + len(p.Content) + len(p.Style)
+}
+
+//eachPaste calls fn for every paste of db matching opts, stopping at the first error
+func eachPaste(ctx context.Context, db DatabaseV2, opts ListOptions, fn func(Paste) error) error {
+	opts.Limit = listPageSize
+	for {
+		pastes, cursor, err := db.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, p := range pastes {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		if cursor == "" {
+			return nil
+		}
+		opts.Cursor = cursor
+	}
+}
+
+//listCursor returns the cursor pointing after the paste
+func listCursor(p Paste) string {
+	cursor := strconv.FormatInt(p.Created.UnixNano(), 10) + ":" + p.Path
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+//parseListCursor returns the creation time and the path of the paste pointed by the cursor
+func parseListCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrCursorNotValid
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", ErrCursorNotValid
+	}
+	nano, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrCursorNotValid
+	}
+	return time.Unix(0, nano), parts[1], nil
+}
+
+//pasteBefore reports if a is listed before b
+func pasteBefore(a, b Paste) bool {
+	if !a.Created.Equal(b.Created) {
+		return a.Created.Before(b.Created)
+	}
+	return a.Path < b.Path
+}
+
+//before reports if a is listed before b in the order selected by the options
+func (opts ListOptions) before(a, b Paste) bool {
+	if opts.Reverse {
+		return pasteBefore(b, a)
+	}
+	return pasteBefore(a, b)
+}
+
+//persistent reports if the pastes are kept when the database is closed
+func (c databaseConfig) persistent() bool {
+	return (c.Type != DatabaseMemory && c.Type != "") || c.SnapshotPath != ""
+}
+
+//shared reports if the pastes can be stored by other instances using the same database
+func (c databaseConfig) shared() bool {
+	return c.Type == DatabaseRedis || c.Type == DatabaseS3
+}
+
+//openDatabase opens the Database described by dbCfg, wrapped as described by cfg
+//The pastes loaded from a snapshot are returned for being scheduled for expiration
+//If persist is false the database is opened only for reading the pastes
+func openDatabase(cfg config, dbCfg databaseConfig, logger *slog.Logger, persist bool) (DatabaseV2, []Paste, error) {
+	var mem *MemoryDB
+	var db DatabaseV2
+
+	switch dbCfg.Type {
+	case DatabaseMemory, "":
+		mem = NewMemoryDB()
+		db = AdaptDatabase(mem)
+	case DatabaseSQLite:
+		sdb, err := NewSQLiteDB(dbCfg.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot open SQLite database: %v", err)
+		}
+		if persist {
+			sdb.EnableSweep(dbCfg.SweepInterval.Duration, logger)
+		}
+		db = sdb
+	case DatabaseRedis:
+		rdb, err := NewRedisDB(dbCfg.URL, dbCfg.Prefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot open Redis database: %v", err)
+		}
+		db = rdb
+	case DatabaseS3:
+		sdb, err := NewS3DB(dbCfg.Endpoint, dbCfg.Region, dbCfg.Bucket, dbCfg.AccessKey, dbCfg.SecretKey, dbCfg.Prefix, dbCfg.Lifecycle)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot open S3 database: %v", err)
+		}
+		db = sdb
+	default:
+		return nil, nil, fmt.Errorf("%v: %s", ErrDatabaseType, dbCfg.Type)
+	}
+
+	if cfg.Compression != "" {
+		cdb, err := NewCompressDB(db, cfg.Compression, cfg.CompressionThreshold)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot enable compression: %v", err)
+		}
+		db = cdb
+	}
+
+	var loaded []Paste
+	if mem != nil && dbCfg.SnapshotPath != "" {
+		var err error
+		loaded, err = loadSnapshot(context.Background(), db, dbCfg.SnapshotPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot load snapshot: %v", err)
+		}
+		logger.Info("Loaded snapshot", "path", dbCfg.SnapshotPath, "pastes", len(loaded))
+		if persist {
+			mem.EnableSnapshots(dbCfg.SnapshotPath, dbCfg.SnapshotInterval.Duration, logger)
+		}
+	}
+
+	return db, loaded, nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAdaptDatabase(t *testing.T) {
+	db := AdaptDatabase(NewMemoryDB())
+	if _, err := db.Get(context.Background(), "missing"); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("Expected: %v; got: %v", ErrDatabaseNotFound, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Store(ctx, "test", Paste{Path: "test"}); err != context.Canceled {
+		t.Errorf("Expected: %v; got: %v", context.Canceled, err)
+	}
+	if _, err := db.Get(context.Background(), "test"); err == nil {
+		t.Errorf("Paste stored with a cancelled context")
+	}
+}
+
+//wrappedNotFoundDB is a Database adding the path to ErrDatabaseNotFound, it cannot reserve the paths
+type wrappedNotFoundDB struct{ Database }
+
+func (db wrappedNotFoundDB) Get(path string) (Paste, error) {
+	p, err := db.Database.Get(path)
+	if err == ErrDatabaseNotFound {
+		err = fmt.Errorf("%w: %s", ErrDatabaseNotFound, path)
+	}
+	return p, err
+}
+
+func TestAdaptDatabaseReservePath(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryDB()
+	mem.Store("used", Paste{Path: "used"})
+	db := AdaptDatabase(wrappedNotFoundDB{mem})
+
+	tt := []struct {
+		path string
+		ok   bool
+	}{
+		{"free", true},
+		{"used", false},
+	}
+	for _, tc := range tt {
+		if ok, err := db.ReservePath(ctx, tc.path); ok != tc.ok || err != nil {
+			t.Errorf("Expected: %v; got: %v, %v", tc.ok, ok, err)
+		}
+	}
+}
+
+func TestDatabaseErrorStatus(t *testing.T) {
+	tm := []struct {
+		err  error
+		code int
+	}{
+		{ErrDatabaseNotFound, http.StatusNotFound},
+		{fmt.Errorf("%w: test", ErrDatabaseConflict), http.StatusConflict},
+		{ErrDatabaseQuotaExceeded, http.StatusInsufficientStorage},
+		{ErrDatabaseUnavailable, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{fmt.Errorf("Unknown"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tm {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if code := databaseErrorStatus(tt.err); code != tt.code {
+				t.Errorf("Expected: %d; got: %d", tt.code, code)
+			}
+		})
+	}
+}
@@ -37,7 +37,7 @@ type TestDB struct{ db Database }
 
 func NewTestDB() *TestDB {
 	return &TestDB{
-		MemoryDB{},
+		NewMemoryDB(),
 	}
 }
 
@@ -61,4 +61,8 @@ func (db *TestDB) Store(name string, value Paste) error { return db.db.Store(nam
 
 func (db *TestDB) Delete(name string) { db.db.Delete(name) }
 
-func (db *TestDB) CreatePastePath(length int) string { return db.db.CreatePastePath(length) }
+func (db *TestDB) Close() error { return db.db.Close() }
+
+func (db *TestDB) List(opts ListOptions) ([]Paste, string, error) { return db.db.List(opts) }
+
+func (db *TestDB) Stats() (DatabaseStats, error) { return db.db.Stats() }
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/chroma/styles"
 
@@ -24,6 +25,10 @@ var (
 	ErrEmptyPaste         = fmt.Errorf("Empty Paste")
 	ErrExpireTimeNotValid = fmt.Errorf("Expire time not valid")
 
+	ErrExpireDateNotValid   = fmt.Errorf("Expire date not valid")
+	ErrExpireDateDisabled   = fmt.Errorf("Expire dates are disabled")
+	ErrExpireDateOutOfRange = fmt.Errorf("Expire date out of the allowed range")
+
 	ErrNoConfigFound = fmt.Errorf("No config found")
 )
 
@@ -35,12 +40,132 @@ type config struct {
 	TimeFormat     string
 	DefaultName    string
 	PathLen        int
+	Paths          pathsConfig
+	CustomPaths    customPathsConfig
 	HighlightStyle string
 	UndefinedLang  string
 	Header         string
 	AssetsDir      string
 	ExpireAfter    []*pasteDuration
+	ExpireDate     expireDateConfig
 	MaxPasteSize   int //in bytes
+	RecentPastes   int
+	Search         bool
+
+	Compression          string
+	CompressionThreshold int //in bytes
+
+	AdminAddr string
+
+	LogFormat   string
+	LogLevel    string
+	AccessLog   bool
+	AnonymizeIP bool
+
+	ShutdownTimeout pasteDuration
+
+	Database    databaseConfig
+	MigrateFrom *databaseConfig
+	Cluster     clusterConfig
+	Replication replicationConfig
+	Accounts    accountsConfig
+	OIDC        oidcConfig
+}
+
+//expireDateConfig is the config of the expiration dates chosen by the uploaders
+type expireDateConfig struct {
+	//Enabled allows choosing an expiration date instead of one of ExpireAfter
+	Enabled bool
+	//MinLifetime is the shortest time between the creation and the expiration date
+	MinLifetime pasteDuration
+	//MaxLifetime is the longest time between the creation and the expiration date, 0 for no limit
+	MaxLifetime pasteDuration
+}
+
+//oidcConfig is the config of the login with OpenID Connect
+type oidcConfig struct {
+	//Issuer is the URL of the provider, empty disables the login with OpenID Connect
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	//RedirectURL is the URL of /oidc/callback as seen by the browsers
+	RedirectURL string
+	Scopes      []string
+	//Required makes the login needed for creating and viewing the pastes
+	Required bool
+	//AllowedDomains are the domains of the emails allowed to log in, empty allows every domain
+	AllowedDomains []string
+	//AllowedGroups are the groups allowed to log in, empty allows every group
+	AllowedGroups []string
+	GroupsClaim   string
+	NameClaim     string
+}
+
+//accountsConfig is the config of the user accounts
+type accountsConfig struct {
+	Enabled bool
+	//Path is the JSON file with the accounts
+	Path string
+	//Registration allows everyone to create an account from the web UI
+	Registration bool
+	//Anonymous allows creating pastes without an account
+	Anonymous      bool
+	SessionTimeout pasteDuration
+}
+
+//replicationConfig is the config of the replication
+type replicationConfig struct {
+	//Secret is shared by the primary and its followers, empty disables the replication
+	Secret string
+	//Primary is the URL of the instance to follow, empty if this instance is the primary
+	Primary string
+	LogSize int
+}
+
+//pathsConfig is the config of the generation of the paste paths
+type pathsConfig struct {
+	Generator string
+	WordList  string
+	//GrowAfter is the number of collisions in a row after which the paths grow, 0 never grows
+	GrowAfter int
+}
+
+//customPathsConfig is the config of the paths chosen by the users
+type customPathsConfig struct {
+	//Pattern is the regular expression matching the allowed paths, empty disables the custom paths
+	Pattern  string
+	Reserved []string
+}
+
+//clusterConfig is the config of the cluster mode
+type clusterConfig struct {
+	//Self is the URL of this node used by the other nodes, empty disables the cluster mode
+	Self     string
+	Nodes    []string
+	Join     string
+	Secret   string
+	Replicas int
+}
+
+//databaseConfig is the config of the Database
+type databaseConfig struct {
+	Type string
+
+	SnapshotPath     string
+	SnapshotInterval pasteDuration
+
+	Path          string
+	SweepInterval pasteDuration
+
+	URL    string
+	Prefix string
+
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Lifecycle bool
 }
 
 func validateName(name, defaultName string) (string, error) {
@@ -84,6 +209,26 @@ func validateExpire(expire string, expireTimes []*pasteDuration) (*pasteDuration
 	return dur, nil
 }
 
+//validateExpireDate parses an expiration date in RFC 3339 and checks that it is allowed for a paste created at now
+func validateExpireDate(date string, now time.Time, cfg expireDateConfig) (time.Time, error) {
+	if !cfg.Enabled {
+		return time.Time{}, ErrExpireDateDisabled
+	}
+	expire, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return time.Time{}, ErrExpireDateNotValid
+	}
+
+	lifetime := expire.Sub(now)
+	if lifetime < cfg.MinLifetime.Duration || lifetime <= 0 {
+		return time.Time{}, fmt.Errorf("%w: at least %v from now", ErrExpireDateOutOfRange, cfg.MinLifetime.Duration)
+	}
+	if cfg.MaxLifetime.Duration > 0 && lifetime > cfg.MaxLifetime.Duration {
+		return time.Time{}, fmt.Errorf("%w: at most %v from now", ErrExpireDateOutOfRange, cfg.MaxLifetime.Duration)
+	}
+	return expire, nil
+}
+
 //hightlightCode formattes the code string passed and returns the css, code highlight in HTML and the language
 func highlightCode(code, lang string, undefinedLangName, highlightStyle string) (string, string, string) {
 	var lex chroma.Lexer
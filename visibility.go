@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+//Visibility levels of the pastes
+const (
+	//VisibilityPublic pastes are shown in the listings
+	VisibilityPublic = "public"
+	//VisibilityUnlisted pastes are seen only by who knows the link
+	VisibilityUnlisted = "unlisted"
+	//VisibilityPrivate pastes are seen only by their owner
+	VisibilityPrivate = "private"
+)
+
+//Errors declaration for the visibility
+var (
+	ErrVisibilityNotValid = fmt.Errorf("Visibility not valid, use public, unlisted or private")
+	ErrPrivateNeedsOwner  = fmt.Errorf("Private pastes need an account or an owner token")
+)
+
+//validateVisibility checks the visibility chosen by the user, empty is unlisted
+func validateVisibility(visibility string) (string, error) {
+	switch visibility {
+	case "":
+		return VisibilityUnlisted, nil
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return visibility, nil
+	}
+	return "", ErrVisibilityNotValid
+}
+
+//visibility returns the visibility of the paste, the pastes stored without one are unlisted
+func (p Paste) visibility() string {
+	if p.Visibility == "" {
+		return VisibilityUnlisted
+	}
+	return p.Visibility
+}
+
+//canView reports if the request can see the paste
+//The private pastes are seen by the uploader logged in the web UI, with the owner token or with an API key
+func (s Server) canView(req *http.Request, p Paste) bool {
+	return p.visibility() != VisibilityPrivate || s.requestOwns(req, p)
+}
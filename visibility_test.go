@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateVisibility(t *testing.T) {
+	tt := []struct {
+		input  string
+		output string
+		err    error
+	}{
+		{"", VisibilityUnlisted, nil},
+		{"public", VisibilityPublic, nil},
+		{"unlisted", VisibilityUnlisted, nil},
+		{"private", VisibilityPrivate, nil},
+		{"Public", "", ErrVisibilityNotValid},
+		{"secret", "", ErrVisibilityNotValid},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			output, err := validateVisibility(tc.input)
+			if output != tc.output || err != tc.err {
+				t.Errorf("Expected: %q, %v; got: %q, %v", tc.output, tc.err, output, err)
+			}
+		})
+	}
+}
+
+func TestPrivatePastes(t *testing.T) {
+	s, _, key := newAccountsServer(t, true)
+	s.handleRoute("/", handleHome)
+	s.handleRoute("/raw/", handleRawPaste)
+	s.handleRoute("/api/new", handleAPINewPaste)
+	s.handleRoute("/api/get", handleAPIGetPaste)
+
+	do := func(method, target string, body []byte, cookie *http.Cookie, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+	apiNew := func(visibility, auth string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(newPasteRequest{Code: "example paste", ExpireTime: getExpireTime(t), Visibility: visibility})
+		return do(http.MethodPost, "/api/new", body, nil, auth)
+	}
+	apiGet := func(path string) []byte {
+		body, _ := json.Marshal(getPasteRequest{Name: path})
+		return body
+	}
+
+	create := func(visibility string) (string, *http.Cookie) {
+		form := url.Values{"code": {"example paste"}, "expire": {getExpireTime(t)}, "visibility": {visibility}}
+		res := do(http.MethodPost, "/", []byte(form.Encode()), nil, "")
+		cookies := res.Result().Cookies()
+		if res.Code != http.StatusFound || len(cookies) != 1 {
+			t.Fatalf("Could not create paste: %d", res.Code)
+		}
+		return strings.TrimPrefix(res.Header().Get("Location"), "/"), cookies[0]
+	}
+	owned, cookie := create(VisibilityPrivate)
+	_, stranger := create(VisibilityPublic)
+
+	res := apiNew(VisibilityPrivate, key)
+	var created newPasteResponse
+	if err := json.Unmarshal(res.Body.Bytes(), &created); err != nil || !created.OK {
+		t.Fatalf("Could not create paste: %d %s", res.Code, res.Body)
+	}
+
+	if res := apiNew(VisibilityPrivate, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("Private without owner, expected: %d; got: %d", http.StatusBadRequest, res.Code)
+	}
+	if res := apiNew("secret", ""); res.Code != http.StatusBadRequest {
+		t.Errorf("Visibility not valid, expected: %d; got: %d", http.StatusBadRequest, res.Code)
+	}
+
+	tt := []struct {
+		name   string
+		target string
+		body   []byte
+		cookie *http.Cookie
+		auth   string
+		code   int
+	}{
+		{"Owner", "/" + owned, nil, cookie, "", http.StatusOK},
+		{"Owner raw", "/raw/" + owned, nil, cookie, "", http.StatusOK},
+		{"Anonymous", "/" + owned, nil, nil, "", http.StatusNotFound},
+		{"Anonymous raw", "/raw/" + owned, nil, nil, "", http.StatusNotFound},
+		{"Other owner", "/" + owned, nil, stranger, "", http.StatusNotFound},
+		{"Owner API", "/api/get", apiGet(owned), cookie, "", http.StatusOK},
+		{"Anonymous API", "/api/get", apiGet(owned), nil, "", http.StatusNotFound},
+		{"Key", "/api/get", apiGet(created.Path), nil, key, http.StatusOK},
+		{"Key of other paste", "/api/get", apiGet(owned), nil, key, http.StatusNotFound},
+		{"Without key", "/" + created.Path, nil, nil, "", http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := do(http.MethodGet, tc.target, tc.body, tc.cookie, tc.auth); res.Code != tc.code {
+				t.Errorf("Expected: %d; got: %d", tc.code, res.Code)
+			}
+		})
+	}
+}